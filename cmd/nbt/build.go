@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/daemon"
+)
+
+/* Runs a build with the project's daemon, exiting with the exit code of the build. */
+func runBuild(args []string) error {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	socket := flags.String("socket", daemon.DefaultSocket, "socket of the project's daemon")
+	flags.Parse(args)
+	code, err := daemon.Build(*socket, flags.Args(), os.Stdout, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("%w (start the daemon with \"nbt daemon\")", err)
+	}
+	os.Exit(code)
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/daemon"
+)
+
+/* Runs the project's build program as a daemon, which serves builds until killed. The program is told where to
+listen through the environment, so it does not need to handle any argument of its own. */
+func runDaemon(args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	socket := flags.String("socket", daemon.DefaultSocket, "socket to serve builds on")
+	flags.Parse(args)
+	command := flags.Args()
+	if len(command) == 0 {
+		command = []string{"go", "run", "./nbt"}
+	}
+	/* The program may change its working directory. */
+	path, err := filepath.Abs(*socket)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), daemon.SocketEnv+"="+path)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("daemon: build program %q exited with status %d", command, exitErr.ExitCode())
+		}
+		return err
+	}
+	return fmt.Errorf("daemon: build program %q exited without serving builds; it should call daemon.Main", command)
+}
@@ -0,0 +1,80 @@
+/*
+nbt: Command line tool for working with nbt builds.
+
+Usage:
+
+	nbt cache stats [-dir DIR] [-max-size BYTES]
+	nbt cache clean [-dir DIR]
+	nbt worker -token-file PATH [-listen ADDRESS] [-j N]
+	nbt daemon [-socket PATH] [PROGRAM [ARGS...]]
+	nbt build [-socket PATH] [ARGS...]
+
+The daemon command runs the project's build program, "go run ./nbt" by default, serving builds on the socket
+until killed. The program must call daemon.Main.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/cache"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: nbt cache <stats|clean> [flags]\n       nbt worker [flags]\n       nbt daemon [flags] [program [args...]]\n       nbt build [flags] [args...]")
+	os.Exit(2)
+}
+
+var commands = map[string]func(args []string) error{
+	"build":  runBuild,
+	"cache":  runCache,
+	"daemon": runDaemon,
+	"worker": runWorker,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := command(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "nbt:", err)
+		os.Exit(1)
+	}
+}
+
+func runCache(args []string) error {
+	if len(args) < 1 {
+		usage()
+	}
+	flags := flag.NewFlagSet("cache "+args[0], flag.ExitOnError)
+	defaultDir, err := cache.DefaultDir()
+	if err != nil {
+		return err
+	}
+	dir := flags.String("dir", defaultDir, "directory of the cache")
+	maxSize := flags.Int64("max-size", 0, "size limit of the cache in bytes, zero for no limit")
+	flags.Parse(args[1:])
+	c, err := cache.Open(*dir, *maxSize)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "stats":
+		stats, err := c.Stats()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("directory: %s\n%v\n", *dir, stats)
+	case "clean":
+		return c.Clean()
+	default:
+		usage()
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/remote"
+)
+
+/* Runs a worker which runs the commands of remotable tasks for other machines. */
+func runWorker(args []string) error {
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	address := flags.String("listen", "127.0.0.1:7070", "address to listen on")
+	tokenFile := flags.String("token-file", "", "file holding the token that clients must present (required)")
+	jobs := flags.Uint("j", uint(runtime.NumCPU()), "maximum number of commands to run at the same time")
+	flags.Parse(args)
+	if *tokenFile == "" {
+		return errors.New("worker: -token-file is required, since clients can run any command on the worker")
+	}
+	data, err := os.ReadFile(*tokenFile)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return errors.New("worker: the token file is empty")
+	}
+	listener, err := net.Listen("tcp", *address)
+	if err != nil {
+		return err
+	}
+	log.Printf("nbt worker: listening on %v\n", listener.Addr())
+	return remote.NewWorker(*jobs, token).Serve(listener)
+}
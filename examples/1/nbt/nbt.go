@@ -4,67 +4,45 @@ import (
 	"encoding/binary"
 	"fmt"
 	"hash/fnv"
-	"os/exec"
+	"os"
 
+	"gitlab.com/kyle_anderson/nbt/pkg/cc"
 	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
 )
 
-const (
-	hashBaseCompileC uint64 = iota
-	hashBaseLinkProgram
-)
-
-type taskCompileC struct {
-	source, dest string
-}
-
-func (t *taskCompileC) Hash() uint64 {
-	h := fnv.New64()
-	if err := binary.Write(h, binary.LittleEndian, hashBaseCompileC); err != nil {
-		panic(fmt.Errorf(`(*taskCompileC).Hash: error writing hash: %w`, err))
-	}
-	h.Write([]byte(t.source))
-	h.Write([]byte(t.dest))
-	return h.Sum64()
-}
-func (t *taskCompileC) Matches(other nbt.Task) bool {
-	if tcc, ok := other.(*taskCompileC); ok {
-		return tcc.dest == t.dest
-	}
-	return false
-}
+const hashBaseAll uint64 = 0
 
-func (t *taskCompileC) Perform(h nbt.Handler) error {
-	stdout, err := exec.Command("gcc", "-o", t.dest, "-c", t.source).CombinedOutput()
-	fmt.Println(string(stdout), err)
-	return err
+/* Builds the program and writes the compilation database for editors. */
+type taskAll struct {
+	program *cc.LinkTask
 }
 
-type taskLinkProgram struct{}
-
-func (t *taskLinkProgram) Hash() uint64 {
+func (t *taskAll) Hash() uint64 {
 	h := fnv.New64()
-	if err := binary.Write(h, binary.LittleEndian, hashBaseLinkProgram); err != nil {
-		panic(fmt.Errorf(`(*taskLinkProgram).Hash: error writing hash: %w`, err))
+	if err := binary.Write(h, binary.LittleEndian, hashBaseAll); err != nil {
+		panic(fmt.Errorf(`(*taskAll).Hash: error writing hash: %w`, err))
 	}
 	return h.Sum64()
 }
-func (t *taskLinkProgram) Matches(other nbt.Task) bool {
-	_, ok := other.(*taskLinkProgram)
+func (t *taskAll) Matches(other nbt.Task) bool {
+	_, ok := other.(*taskAll)
 	return ok
 }
 
-func (t *taskLinkProgram) Perform(h nbt.Handler) error {
-	h.Require(&taskCompileC{"hello.c", "hello.o"})
-	h.Require(&taskCompileC{"main.c", "main.o"})
-	h.Wait()
-	stdout, err := exec.Command("gcc", "-o", "hello.out", "hello.o", "main.o").CombinedOutput()
-	fmt.Println(string(stdout), err)
-	return err
+func (t *taskAll) Perform(h nbt.Handler) error {
+	h.RequireAndWait(t.program, cc.CompileCommands("compile_commands.json", t.program))
+	return nil
 }
 
 func main() {
+	toolchain := &cc.Toolchain{CC: "gcc", Flags: []string{"-Wall"}}
+	/* Objects only need compiling when they are older than their source or any of the headers the source included
+	when it was last compiled, so changing hello.h recompiles both sources. */
+	program := toolchain.Program(cc.Target{Name: "hello", Sources: []string{"hello.c", "main.c"}})
 	/* For the completed software, an automatic main task would be created
 	which would read os.Args and find the tasks listed there, then require them and wait. */
-	nbt.Start(&taskLinkProgram{}, 1)
+	options := nbt.Options{MaxParallelTasks: 4, Staleness: nbt.StalenessModTime}
+	if !nbt.StartWithOptions(&taskAll{program}, options).Succeeded() {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,84 @@
+/*
+atomicfile: Writes files by writing temporary files in the same directories and renaming them into place,
+so that readers, such as other builds or editors, never observe a partial file, and a build interrupted while
+writing leaves the previous file in place.
+*/
+package atomicfile
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+/* Prefix of the names of temporary files, which directories read by other processes may skip. */
+const TempPrefix = ".tmp-"
+
+/* A temporary file which replaces another file once committed. */
+type File struct {
+	*os.File
+	done bool
+}
+
+/* Creates a temporary file in the given directory, which must be on the same file system as the file it is
+committed to. */
+func Create(dir string) (*File, error) {
+	f, err := os.CreateTemp(dir, TempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &File{File: f}, nil
+}
+
+/* Closes the file and renames it to the given path with the given permissions, replacing any file there. */
+func (f *File) Commit(path string, mode fs.FileMode) error {
+	f.done = true
+	err := f.Close()
+	if err == nil {
+		err = os.Chmod(f.Name(), mode)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+/* Closes and removes the file unless it was committed, so that it may be deferred. */
+func (f *File) Discard() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.Close()
+	os.Remove(f.Name())
+}
+
+/* Writes the file at the given path with write, creating its directory if needed. The file is only replaced
+if write succeeds. */
+func Write(path string, mode fs.FileMode, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := Create(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Discard()
+	if err := write(f); err != nil {
+		return err
+	}
+	return f.Commit(path, mode)
+}
+
+/* Writes the data to the file at the given path, like os.WriteFile. */
+func WriteFile(path string, data []byte, mode fs.FileMode) error {
+	return Write(path, mode, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
@@ -0,0 +1,42 @@
+package atomicfile
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, `sub`, `file`)
+	if err := WriteFile(path, []byte(`first`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf(`unexpected file %v, error %v`, info, err)
+	}
+
+	failure := errors.New(`failed`)
+	err := Write(path, 0o644, func(w io.Writer) error {
+		w.Write([]byte(`second`))
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf(`expected the error of write, got %v`, err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != `first` {
+		t.Errorf(`file was changed to %q, error %v`, data, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf(`temporary files were left behind: %v`, entries)
+	}
+
+	if err := WriteFile(path, []byte(`third`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != `third` {
+		t.Errorf(`unexpected contents %q, error %v`, data, err)
+	}
+}
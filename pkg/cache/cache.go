@@ -0,0 +1,326 @@
+/*
+cache: A content-addressed store for the outputs of build actions, kept in a local directory.
+The contents of output files are stored once each under their SHA-256 digest in the "cas" directory,
+and the outputs of each action are listed in a manifest under the action's key in the "ac" directory.
+Files are written to temporary names and renamed into place, so several builds may share a cache.
+*/
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/kyle_anderson/nbt/internal/atomicfile"
+)
+
+const (
+	actionDir  = "ac"
+	contentDir = "cas"
+)
+
+/* A cache stored in a local directory. Entries are evicted in least recently used order
+whenever the cache grows beyond its size limit. */
+type Local struct {
+	dir string
+	/* Maximum size of the cache in bytes, or zero for no limit. */
+	maxSize int64
+}
+
+/* Opens the cache in the given directory, creating it if needed. A maxSize of zero means no limit. */
+func Open(dir string, maxSize int64) (*Local, error) {
+	for _, sub := range []string{actionDir, contentDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &Local{dir, maxSize}, nil
+}
+
+/* Returns the directory used for the cache when none is specified. */
+func DefaultDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "nbt"), nil
+}
+
+/* The outputs of an action. */
+type manifest struct {
+	Outputs []output `json:"outputs"`
+}
+
+type output struct {
+	Path   string      `json:"path"`
+	Digest string      `json:"digest"`
+	Mode   fs.FileMode `json:"mode"`
+}
+
+/* Error given for keys that cannot be used as the names of files. */
+type ErrInvalidKey struct {
+	Key string
+}
+
+func (err *ErrInvalidKey) Error() string { return fmt.Sprintf("invalid cache key %q", err.Key) }
+
+/* Checks that the key can safely be used as the name of a file or the last element of a URL. */
+func validateKey(key string) error {
+	if key == "" || strings.ContainsAny(key, `/\.`) {
+		return &ErrInvalidKey{key}
+	}
+	return nil
+}
+
+func (c *Local) actionPath(key string) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(c.dir, actionDir, key), nil
+}
+
+func (c *Local) contentPath(digest string) string {
+	return filepath.Join(c.dir, contentDir, digest[:2], digest)
+}
+
+func (c *Local) Restore(key string, outputs []string) (bool, error) {
+	path, err := c.actionPath(key)
+	if err != nil {
+		return false, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return false, fmt.Errorf("corrupt manifest %q: %w", path, err)
+	}
+	if !m.covers(outputs) {
+		return false, nil
+	}
+	/* Contents may have been evicted independently of the manifest, in which case the entry is unusable. */
+	used := []string{path}
+	for _, o := range m.Outputs {
+		blob := c.contentPath(o.Digest)
+		if _, err := os.Stat(blob); errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		used = append(used, blob)
+	}
+	for _, o := range m.Outputs {
+		if err := copyFile(c.contentPath(o.Digest), o.Path, o.Mode); err != nil {
+			return false, fmt.Errorf("restoring %q: %w", o.Path, err)
+		}
+	}
+	now := time.Now()
+	for _, p := range used {
+		/* Marks the entry as recently used. Failing to do so only affects the order of eviction. */
+		os.Chtimes(p, now, now)
+	}
+	return true, nil
+}
+
+/* Returns true if the manifest holds exactly the given outputs. */
+func (m *manifest) covers(outputs []string) bool {
+	if len(m.Outputs) != len(outputs) {
+		return false
+	}
+	for i, o := range m.Outputs {
+		if o.Path != outputs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Local) Store(key string, outputs []string) error {
+	path, err := c.actionPath(key)
+	if err != nil {
+		return err
+	}
+	m := manifest{Outputs: make([]output, 0, len(outputs))}
+	for _, o := range outputs {
+		stored, err := c.storeContent(o)
+		if err != nil {
+			return fmt.Errorf("storing %q: %w", o, err)
+		}
+		m.Outputs = append(m.Outputs, stored)
+	}
+	data, err := json.Marshal(&m)
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(path, data, 0o644); err != nil {
+		return err
+	}
+	return c.Trim()
+}
+
+/* Copies the file into the content store, returning its entry. */
+func (c *Local) storeContent(path string) (output, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return output{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return output{}, err
+	}
+	/* The digest is only known once the contents are copied, so they are copied to a temporary file first. */
+	tmp, err := atomicfile.Create(filepath.Join(c.dir, contentDir))
+	if err != nil {
+		return output{}, err
+	}
+	defer tmp.Discard()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), f); err != nil {
+		return output{}, err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	blob := c.contentPath(digest)
+	if err := os.MkdirAll(filepath.Dir(blob), 0o755); err != nil {
+		return output{}, err
+	}
+	if err := tmp.Commit(blob, 0o644); err != nil {
+		return output{}, err
+	}
+	return output{path, digest, info.Mode().Perm()}, nil
+}
+
+/* Information about the contents of a cache. */
+type Stats struct {
+	/* Number of actions with stored outputs. */
+	Entries int
+	/* Number of distinct output files stored. */
+	Blobs int
+	/* Total size of the cache in bytes. */
+	Size int64
+	/* The size limit of the cache in bytes, or zero if it is unlimited. */
+	MaxSize int64
+}
+
+func (s Stats) String() string {
+	limit := "unlimited"
+	if s.MaxSize > 0 {
+		limit = fmt.Sprint(s.MaxSize)
+	}
+	return fmt.Sprintf("entries: %d\nblobs: %d\nsize: %d bytes\nlimit: %s", s.Entries, s.Blobs, s.Size, limit)
+}
+
+func (c *Local) Stats() (stats Stats, err error) {
+	files, err := c.files()
+	if err != nil {
+		return
+	}
+	stats.MaxSize = c.maxSize
+	for _, f := range files {
+		if f.isAction {
+			stats.Entries++
+		} else {
+			stats.Blobs++
+		}
+		stats.Size += f.size
+	}
+	return
+}
+
+/* Removes everything from the cache. */
+func (c *Local) Clean() error {
+	for _, sub := range []string{actionDir, contentDir} {
+		dir := filepath.Join(c.dir, sub)
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Evicts the least recently used files until the cache is within its size limit. */
+func (c *Local) Trim() error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+	files, err := c.files()
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, f := range files {
+		size += f.size
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].used.Before(files[j].used) })
+	for _, f := range files {
+		if size <= c.maxSize {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		size -= f.size
+	}
+	return nil
+}
+
+/* A file within the cache. */
+type cacheFile struct {
+	path     string
+	size     int64
+	used     time.Time
+	isAction bool
+}
+
+func (c *Local) files() (files []cacheFile, err error) {
+	for _, sub := range []string{actionDir, contentDir} {
+		err = filepath.WalkDir(filepath.Join(c.dir, sub), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || strings.HasPrefix(d.Name(), atomicfile.TempPrefix) {
+				return nil
+			}
+			info, err := d.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				/* Removed by another build in the meantime. */
+				return nil
+			} else if err != nil {
+				return err
+			}
+			files = append(files, cacheFile{path, info.Size(), info.ModTime(), sub == actionDir})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func copyFile(from, to string, mode fs.FileMode) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return atomicfile.Write(to, mode, func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+}
@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+var _ nbt.Cache = (*Local)(nil)
+
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestLocal(t *testing.T) {
+	t.Run(`restores stored outputs`, func(t *testing.T) {
+		work := t.TempDir()
+		c, err := Open(t.TempDir(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs := []string{filepath.Join(work, `a.o`), filepath.Join(work, `sub`, `b.o`)}
+		os.Mkdir(filepath.Join(work, `sub`), 0o755)
+		writeFile(t, outputs[0], `object a`)
+		writeFile(t, outputs[1], `object b`)
+
+		if hit, err := c.Restore(`key`, outputs); err != nil || hit {
+			t.Fatalf(`expected a miss before storing, got hit=%v err=%v`, hit, err)
+		}
+		if err := c.Store(`key`, outputs); err != nil {
+			t.Fatal(`Store: `, err)
+		}
+		os.RemoveAll(filepath.Join(work, `sub`))
+		writeFile(t, outputs[0], `modified`)
+		if hit, err := c.Restore(`key`, outputs); err != nil || !hit {
+			t.Fatalf(`expected a hit after storing, got hit=%v err=%v`, hit, err)
+		}
+		if a, b := readFile(t, outputs[0]), readFile(t, outputs[1]); a != `object a` || b != `object b` {
+			t.Errorf(`unexpected restored contents %q and %q`, a, b)
+		}
+		if hit, _ := c.Restore(`key`, outputs[:1]); hit {
+			t.Error(`hit for an entry with different outputs`)
+		}
+	})
+
+	t.Run(`stores identical contents once`, func(t *testing.T) {
+		work := t.TempDir()
+		c, _ := Open(t.TempDir(), 0)
+		for i := 0; i < 3; i++ {
+			output := filepath.Join(work, fmt.Sprint(i))
+			writeFile(t, output, `same`)
+			if err := c.Store(fmt.Sprint(`key`, i), []string{output}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if stats, err := c.Stats(); err != nil {
+			t.Fatal(err)
+		} else if stats.Entries != 3 || stats.Blobs != 1 {
+			t.Errorf(`unexpected stats: %+v`, stats)
+		}
+	})
+
+	t.Run(`evicts the least recently used entries`, func(t *testing.T) {
+		work := t.TempDir()
+		/* Room for the two most recent entries, but not a third. */
+		c, _ := Open(t.TempDir(), 2*(1000+200))
+		contents := make([]byte, 1000)
+		start := time.Now().Add(-time.Hour)
+		outputs := make([][]string, 3)
+		for i := range outputs {
+			outputs[i] = []string{filepath.Join(work, fmt.Sprint(i))}
+			contents[0] = byte(i)
+			writeFile(t, outputs[i][0], string(contents))
+			if err := c.Store(fmt.Sprint(`key`, i), outputs[i]); err != nil {
+				t.Fatal(err)
+			}
+			/* Modification times are too coarse on some systems to order entries stored in quick succession. */
+			files, _ := c.files()
+			for _, f := range files {
+				if f.used.After(start.Add(time.Duration(i) * time.Minute)) {
+					when := start.Add(time.Duration(i) * time.Minute)
+					os.Chtimes(f.path, when, when)
+				}
+			}
+			if i == 1 {
+				/* Using the first entry makes the second the least recently used. */
+				if hit, _ := c.Restore(`key0`, outputs[0]); !hit {
+					t.Fatal(`expected a hit for the first entry`)
+				}
+			}
+		}
+		for i, expected := range []bool{true, false, true} {
+			if hit, err := c.Restore(fmt.Sprint(`key`, i), outputs[i]); err != nil {
+				t.Error(err)
+			} else if hit != expected {
+				t.Errorf(`entry %d: hit=%v, expected %v`, i, hit, expected)
+			}
+		}
+		if stats, _ := c.Stats(); stats.Size > stats.MaxSize {
+			t.Errorf(`cache of size %d exceeds its limit of %d`, stats.Size, stats.MaxSize)
+		}
+	})
+
+	t.Run(`clean empties the cache`, func(t *testing.T) {
+		work := t.TempDir()
+		c, _ := Open(t.TempDir(), 0)
+		output := filepath.Join(work, `out`)
+		writeFile(t, output, `contents`)
+		c.Store(`key`, []string{output})
+		if err := c.Clean(); err != nil {
+			t.Fatal(err)
+		}
+		if stats, _ := c.Stats(); stats.Entries != 0 || stats.Blobs != 0 || stats.Size != 0 {
+			t.Errorf(`cache not empty after cleaning: %+v`, stats)
+		}
+		if hit, _ := c.Restore(`key`, []string{output}); hit {
+			t.Error(`hit after cleaning`)
+		}
+	})
+
+	t.Run(`rejects keys that are not plain names`, func(t *testing.T) {
+		c, _ := Open(t.TempDir(), 0)
+		for _, key := range []string{``, `../escape`, `a/b`, `.`} {
+			var invalid *ErrInvalidKey
+			if _, err := c.Restore(key, nil); !errors.As(err, &invalid) {
+				t.Errorf(`key %q: expected ErrInvalidKey, got %v`, key, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* Default limit on the duration of a single request to an HTTP backend. */
+const DefaultHTTPTimeout = 30 * time.Second
+
+/* A backend using plain HTTP GET and PUT requests, with entries at "<base URL>/ac/<key>" and
+"<base URL>/cas/<digest>". The server only has to store the bodies of requests and return them:
+the entries under "ac" are the manifests of this package, not the ActionResult messages of Bazel,
+so the cache cannot be shared with Bazel clients. */
+type HTTP struct {
+	baseURL string
+	client  *http.Client
+}
+
+/* Returns a backend for the server at the given base URL. If client is nil, a client with a timeout of
+DefaultHTTPTimeout is used. */
+func NewHTTP(baseURL string, client *http.Client) *HTTP {
+	if client == nil {
+		client = &http.Client{Timeout: DefaultHTTPTimeout}
+	}
+	return &HTTP{strings.TrimSuffix(baseURL, "/"), client}
+}
+
+/* Error given when the server responds to a request with an unexpected status. */
+type ErrHTTPStatus struct {
+	Method, URL string
+	StatusCode  int
+}
+
+func (err *ErrHTTPStatus) Error() string {
+	return fmt.Sprintf("%s %s: unexpected status %d %s", err.Method, err.URL, err.StatusCode, http.StatusText(err.StatusCode))
+}
+
+func (b *HTTP) url(area Area, key string) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s/%s", b.baseURL, area, key), nil
+}
+
+func (b *HTTP) Get(area Area, key string, w io.Writer) (bool, error) {
+	url, err := b.url(area, key)
+	if err != nil {
+		return false, err
+	}
+	response, err := b.client.Get(url)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+		_, err := io.Copy(w, response.Body)
+		return err == nil, err
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, &ErrHTTPStatus{http.MethodGet, url, response.StatusCode}
+	}
+}
+
+func (b *HTTP) Put(area Area, key string, r io.Reader, size int64) error {
+	url, err := b.url(area, key)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPut, url, r)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = size
+	response, err := b.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return &ErrHTTPStatus{http.MethodPut, url, response.StatusCode}
+	}
+	return nil
+}
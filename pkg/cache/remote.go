@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+
+	"gitlab.com/kyle_anderson/nbt/internal/atomicfile"
+)
+
+/* The area of a backend holding an entry. */
+type Area string
+
+const (
+	/* Manifests of the outputs of actions, keyed by the keys of the actions. */
+	AreaAction Area = actionDir
+	/* Contents of files, keyed by their SHA-256 digests. */
+	AreaContent Area = contentDir
+)
+
+/* Storage for the entries of a cache, such as a remote server. */
+type Backend interface {
+	/* Writes the entry with the given key to w. Returns false if there is no such entry. */
+	Get(area Area, key string, w io.Writer) (bool, error)
+	/* Stores the entry with the given key, of the given size in bytes. */
+	Put(area Area, key string, r io.Reader, size int64) error
+}
+
+/* A cache storing entries in a backend, using the same layout of manifests and contents as the local cache.
+Once the backend cannot be reached or refuses the credentials, the cache is disabled: every later lookup misses
+and nothing more is stored, so that a build does not wait for an unreachable server over and over.
+Other failures, such as a server error for one request, only fail that request. */
+type Remote struct {
+	backend  Backend
+	disabled atomic.Bool
+}
+
+func NewRemote(backend Backend) *Remote {
+	return &Remote{backend: backend}
+}
+
+/* Error given when the backend of a remote cache fails. */
+type ErrBackend struct {
+	Err error
+	/* Set if the failure disabled the cache. */
+	Disabled bool
+}
+
+func (err *ErrBackend) Error() string {
+	if err.Disabled {
+		return fmt.Sprintf("remote cache disabled after failure: %v", err.Err)
+	}
+	return fmt.Sprintf("remote cache failed: %v", err.Err)
+}
+func (err *ErrBackend) Unwrap() error { return err.Err }
+
+/* Returns true if the error of the backend means that later requests would fail too: the server could not
+be reached or refused the credentials. Other errors, such as those writing restored files or those of invalid
+keys, only fail the request that gave them. */
+func disables(err error) bool {
+	var statusErr *ErrHTTPStatus
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden
+	}
+	/* Clients wrap every error of a request in a url.Error, including those reading the body being sent. */
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if urlErr.Timeout() {
+			return true
+		}
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func (c *Remote) fail(err error) error {
+	disabled := disables(err)
+	if disabled {
+		c.disabled.Store(true)
+	}
+	return &ErrBackend{err, disabled}
+}
+
+func (c *Remote) get(area Area, key string, w io.Writer) (bool, error) {
+	found, err := c.backend.Get(area, key, w)
+	if err != nil {
+		return false, c.fail(err)
+	}
+	return found, nil
+}
+
+func (c *Remote) put(area Area, key string, r io.Reader, size int64) error {
+	if err := c.backend.Put(area, key, r, size); err != nil {
+		return c.fail(err)
+	}
+	return nil
+}
+
+/* Error given when a backend returns contents that do not match their digest. */
+type ErrCorrupt struct {
+	Digest string
+}
+
+func (err *ErrCorrupt) Error() string { return fmt.Sprintf("contents of %s do not match their digest", err.Digest) }
+
+/* Sentinel used to abandon writing an output whose contents are missing from the backend. */
+var errContentMissing = errors.New("content missing")
+
+func (c *Remote) Restore(key string, outputs []string) (bool, error) {
+	if c.disabled.Load() {
+		return false, nil
+	}
+	var data bytes.Buffer
+	if found, err := c.get(AreaAction, key, &data); err != nil || !found {
+		return false, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data.Bytes(), &m); err != nil {
+		return false, fmt.Errorf("corrupt manifest for %s: %w", key, err)
+	}
+	if !m.covers(outputs) {
+		return false, nil
+	}
+	for _, o := range m.Outputs {
+		err := atomicfile.Write(o.Path, o.Mode, func(w io.Writer) error {
+			h := sha256.New()
+			if found, err := c.get(AreaContent, o.Digest, io.MultiWriter(w, h)); err != nil {
+				return err
+			} else if !found {
+				return errContentMissing
+			}
+			if hex.EncodeToString(h.Sum(nil)) != o.Digest {
+				return &ErrCorrupt{o.Digest}
+			}
+			return nil
+		})
+		if errors.Is(err, errContentMissing) {
+			/* The contents were evicted independently of the manifest. Outputs already restored are
+			overwritten when the task is performed. */
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("restoring %q: %w", o.Path, err)
+		}
+	}
+	return true, nil
+}
+
+func (c *Remote) Store(key string, outputs []string) error {
+	if c.disabled.Load() {
+		return nil
+	}
+	m := manifest{Outputs: make([]output, 0, len(outputs))}
+	for _, path := range outputs {
+		o, err := c.storeContent(path)
+		if err != nil {
+			return fmt.Errorf("storing %q: %w", path, err)
+		}
+		m.Outputs = append(m.Outputs, o)
+	}
+	data, err := json.Marshal(&m)
+	if err != nil {
+		return err
+	}
+	/* The manifest is stored last, so that it never refers to contents that were not stored. */
+	return c.put(AreaAction, key, bytes.NewReader(data), int64(len(data)))
+}
+
+func (c *Remote) storeContent(path string) (output, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return output{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return output{}, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return output{}, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return output{}, err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	if err := c.put(AreaContent, digest, f, info.Size()); err != nil {
+		return output{}, err
+	}
+	return output{path, digest, info.Mode().Perm()}, nil
+}
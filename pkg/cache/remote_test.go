@@ -0,0 +1,281 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+var _ nbt.Cache = (*Remote)(nil)
+
+/* An in-memory cache server with the layout of URLs expected by HTTP. */
+type testServer struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+	/* Requests made to the server, as `METHOD path`. */
+	requests []string
+}
+
+func newTestServer(t *testing.T) (*testServer, *httptest.Server) {
+	s := &testServer{entries: make(map[string][]byte)}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Method+` `+r.URL.Path)
+	if !strings.HasPrefix(r.URL.Path, `/ac/`) && !strings.HasPrefix(r.URL.Path, `/cas/`) {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if data, ok := s.entries[r.URL.Path]; ok {
+			w.Write(data)
+		} else {
+			http.NotFound(w, r)
+		}
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.entries[r.URL.Path] = data
+	default:
+		http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+	}
+}
+
+/* Replaces the contents of every entry in the given area. */
+func (s *testServer) replace(area Area, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for path := range s.entries {
+		if strings.HasPrefix(path, `/`+string(area)+`/`) {
+			s.entries[path] = data
+		}
+	}
+}
+
+var errWrite = errors.New(`write failed`)
+
+/* A writer that always fails. */
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) { return 0, errWrite }
+
+/* A cacheable task writing fixed contents to its output. */
+type writeTask struct {
+	output, contents string
+	runs             int
+}
+
+func (t *writeTask) Hash() uint64 { return 0 }
+func (t *writeTask) Matches(other nbt.Task) bool {
+	converted, ok := other.(*writeTask)
+	return ok && converted.output == t.output
+}
+func (t *writeTask) Perform(nbt.Handler) error {
+	t.runs++
+	return os.WriteFile(t.output, []byte(t.contents), 0o644)
+}
+func (t *writeTask) Action() nbt.ActionSpec {
+	return nbt.ActionSpec{Outputs: []string{t.output}, Command: []string{`write`, t.contents}}
+}
+
+func TestRemote(t *testing.T) {
+	store := func(t *testing.T, c nbt.Cache, contents string) (output string) {
+		output = filepath.Join(t.TempDir(), `out`)
+		writeFile(t, output, contents)
+		if err := c.Store(`key`, []string{output}); err != nil {
+			t.Fatal(`Store: `, err)
+		}
+		return
+	}
+
+	t.Run(`restores through the server`, func(t *testing.T) {
+		s, server := newTestServer(t)
+		c := NewRemote(NewHTTP(server.URL+`/`, nil))
+		output := store(t, c, `contents`)
+		os.Remove(output)
+		if hit, err := c.Restore(`key`, []string{output}); err != nil || !hit {
+			t.Fatalf(`expected a hit, got hit=%v err=%v`, hit, err)
+		}
+		if contents := readFile(t, output); contents != `contents` {
+			t.Errorf(`unexpected restored contents %q`, contents)
+		}
+		for _, request := range s.requests {
+			if !strings.HasPrefix(request, `GET /ac/`) && !strings.HasPrefix(request, `GET /cas/`) &&
+				!strings.HasPrefix(request, `PUT /ac/`) && !strings.HasPrefix(request, `PUT /cas/`) {
+				t.Errorf(`unexpected request %q`, request)
+			}
+		}
+	})
+
+	t.Run(`misses for unknown keys`, func(t *testing.T) {
+		_, server := newTestServer(t)
+		c := NewRemote(NewHTTP(server.URL, nil))
+		if hit, err := c.Restore(`unknown`, nil); err != nil || hit {
+			t.Errorf(`expected a miss, got hit=%v err=%v`, hit, err)
+		}
+	})
+
+	t.Run(`leaves outputs alone when contents are missing`, func(t *testing.T) {
+		s, server := newTestServer(t)
+		c := NewRemote(NewHTTP(server.URL, nil))
+		output := store(t, c, `contents`)
+		for path := range s.entries {
+			if strings.HasPrefix(path, `/cas/`) {
+				delete(s.entries, path)
+			}
+		}
+		writeFile(t, output, `local`)
+		if hit, err := c.Restore(`key`, []string{output}); err != nil || hit {
+			t.Errorf(`expected a miss, got hit=%v err=%v`, hit, err)
+		}
+		if contents := readFile(t, output); contents != `local` {
+			t.Errorf(`output was changed to %q`, contents)
+		}
+	})
+
+	t.Run(`rejects corrupt contents`, func(t *testing.T) {
+		s, server := newTestServer(t)
+		c := NewRemote(NewHTTP(server.URL, nil))
+		output := store(t, c, `contents`)
+		s.replace(AreaContent, []byte(`tampered`))
+		writeFile(t, output, `local`)
+		var corrupt *ErrCorrupt
+		if _, err := c.Restore(`key`, []string{output}); !errors.As(err, &corrupt) {
+			t.Errorf(`expected ErrCorrupt, got %v`, err)
+		}
+		if contents := readFile(t, output); contents != `local` {
+			t.Errorf(`output was changed to %q`, contents)
+		}
+	})
+
+	t.Run(`is disabled once the server fails`, func(t *testing.T) {
+		_, server := newTestServer(t)
+		c := NewRemote(NewHTTP(server.URL, nil))
+		server.Close()
+		var backendErr *ErrBackend
+		if _, err := c.Restore(`key`, nil); !errors.As(err, &backendErr) {
+			t.Errorf(`expected ErrBackend, got %v`, err)
+		}
+		if hit, err := c.Restore(`key`, nil); hit || err != nil {
+			t.Errorf(`expected a silent miss once disabled, got hit=%v err=%v`, hit, err)
+		}
+		if err := c.Store(`key`, nil); err != nil {
+			t.Errorf(`expected storing to be skipped once disabled, got %v`, err)
+		}
+	})
+
+	t.Run(`stays enabled after local failures`, func(t *testing.T) {
+		s, server := newTestServer(t)
+		c := NewRemote(NewHTTP(server.URL, nil))
+		output := store(t, c, `contents`)
+		var backendErr *ErrBackend
+		for path := range s.entries {
+			if !strings.HasPrefix(path, `/cas/`) {
+				continue
+			}
+			/* Writing the restored contents fails, as it would on a full disk. */
+			_, err := c.get(AreaContent, strings.TrimPrefix(path, `/cas/`), errWriter{})
+			if !errors.Is(err, errWrite) || !errors.As(err, &backendErr) || backendErr.Disabled {
+				t.Errorf(`expected the write error without disabling the cache, got %v`, err)
+			}
+		}
+		var invalid *ErrInvalidKey
+		if _, err := c.Restore(`../key`, []string{output}); !errors.As(err, &invalid) {
+			t.Errorf(`expected ErrInvalidKey, got %v`, err)
+		}
+		os.Remove(output)
+		if hit, err := c.Restore(`key`, []string{output}); err != nil || !hit {
+			t.Errorf(`expected a hit after the failures, got hit=%v err=%v`, hit, err)
+		}
+	})
+
+	t.Run(`server errors`, func(t *testing.T) {
+		for i, test := range []struct {
+			status   int
+			disables bool
+		}{
+			{http.StatusServiceUnavailable, false},
+			{http.StatusInternalServerError, false},
+			{http.StatusUnauthorized, true},
+			{http.StatusForbidden, true},
+		} {
+			test := test // Capture
+			t.Run(fmt.Sprint(i), func(t *testing.T) {
+				var requests int
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					requests++
+					http.Error(w, `failed`, test.status)
+				}))
+				defer server.Close()
+				c := NewRemote(NewHTTP(server.URL, nil))
+				var statusErr *ErrHTTPStatus
+				var backendErr *ErrBackend
+				_, err := c.Restore(`key`, nil)
+				if !errors.As(err, &statusErr) || statusErr.StatusCode != test.status {
+					t.Errorf(`expected ErrHTTPStatus with status %d, got %v`, test.status, err)
+				}
+				if !errors.As(err, &backendErr) || backendErr.Disabled != test.disables {
+					t.Errorf(`expected the cache to be disabled: %v, got %v`, test.disables, err)
+				}
+				c.Restore(`key`, nil)
+				expected := 2
+				if test.disables {
+					expected = 1
+				}
+				if requests != expected {
+					t.Errorf(`server received %d requests, expected %d`, requests, expected)
+				}
+			})
+		}
+	})
+}
+
+func TestRemoteBuild(t *testing.T) {
+	_, server := newTestServer(t)
+	output := filepath.Join(t.TempDir(), `out`)
+
+	first := &writeTask{output: output, contents: `built`}
+	if result := nbt.StartWithOptions(first, nbt.Options{MaxParallelTasks: 1, Cache: NewRemote(NewHTTP(server.URL, nil))}); !result.Succeeded() {
+		t.Fatal(`first build failed: `, result.Failed)
+	}
+	os.Remove(output)
+
+	/* Another machine sharing the server restores the output instead of performing the task. */
+	second := &writeTask{output: output, contents: `built`}
+	if result := nbt.StartWithOptions(second, nbt.Options{MaxParallelTasks: 1, Cache: NewRemote(NewHTTP(server.URL, nil))}); !result.Succeeded() {
+		t.Fatal(`second build failed: `, result.Failed)
+	}
+	if second.runs != 0 {
+		t.Error(`task was performed despite a cache hit`)
+	}
+	if contents := readFile(t, output); contents != `built` {
+		t.Errorf(`unexpected restored contents %q`, contents)
+	}
+
+	t.Run(`unreachable server`, func(t *testing.T) {
+		server.Close()
+		task := &writeTask{output: output, contents: `offline`}
+		result := nbt.StartWithOptions(task, nbt.Options{MaxParallelTasks: 1, Cache: NewRemote(NewHTTP(server.URL, nil))})
+		if !result.Succeeded() || task.runs != 1 {
+			t.Errorf(`expected the task to be performed locally, succeeded=%v runs=%d`, result.Succeeded(), task.runs)
+		}
+	})
+}
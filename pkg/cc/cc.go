@@ -0,0 +1,316 @@
+/*
+cc: Tasks for building C and C++ programs and libraries with a Unix-like toolchain, such as gcc or clang.
+Each task implements nbt.CacheableTask, so builds using nbt.Options.Staleness or a cache skip the tasks whose
+outputs are up to date. Compiling writes a depfile next to each object file, so changes to included headers are
+found by later builds.
+*/
+package cc
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* The programs and flags used to build targets. The zero value uses cc, c++ and ar from the PATH. */
+type Toolchain struct {
+	/* The C compiler, which also links programs without C++ sources. Defaults to "cc". */
+	CC string
+	/* The C++ compiler, which also links programs with C++ sources. Defaults to "c++". */
+	CXX string
+	/* The archiver making static libraries. Defaults to "ar". */
+	AR string
+	/* Flags for compiling every source, such as "-O2" or "-Wall". */
+	Flags []string
+	/* Directories searched for included headers. */
+	IncludeDirs []string
+	/* Preprocessor definitions, in the form "NAME" or "NAME=value". */
+	Defines []string
+	/* Flags for linking every program, placed before the inputs, such as "-static". */
+	LinkFlags []string
+	/* Libraries linked into every program, placed after the inputs, such as "-lm". */
+	LinkLibs []string
+	/* The directory under which each target has its own output directory, named after the target.
+	Defaults to "build". */
+	OutputDir string
+}
+
+/* A program or library built from sources. */
+type Target struct {
+	/* The name of the output, such as "hello" for a program or "hello" for the library "libhello.a". */
+	Name    string
+	Sources []string
+	/* Flags, include directories and definitions for the sources of this target only,
+	added after those of the toolchain. */
+	Flags       []string
+	IncludeDirs []string
+	Defines     []string
+	/* Libraries linked into the target, if it is a program. */
+	Libraries []*ArchiveTask
+	/* The directory the objects and the output of the target are written to.
+	Defaults to the target's Name within the toolchain's OutputDir. */
+	OutputDir string
+}
+
+func (tc *Toolchain) outputDir(target *Target) string {
+	if target.OutputDir != "" {
+		return target.OutputDir
+	}
+	dir := tc.OutputDir
+	if dir == "" {
+		dir = "build"
+	}
+	return filepath.Join(dir, target.Name)
+}
+
+/* Returns the path of the object file for the source within the given directory. The whole path of the source is
+kept, with ".o" appended, so that sources with the same name in different directories, or with different
+extensions, have different objects. Parent directory elements are replaced by "__" to keep objects within dir. */
+func ObjectPath(dir, source string) string {
+	source = filepath.Clean(source)
+	source = source[len(filepath.VolumeName(source)):]
+	elements := strings.Split(strings.TrimLeft(filepath.ToSlash(source), "/"), "/")
+	for i, element := range elements {
+		if element == ".." {
+			elements[i] = "__"
+		}
+	}
+	return filepath.Join(dir, filepath.Join(elements...)+".o")
+}
+
+/* Returns true if the source is C++ rather than C, judging by its extension. */
+func isCXX(source string) bool {
+	switch filepath.Ext(source) {
+	case ".cc", ".cpp", ".cxx", ".c++", ".C":
+		return true
+	}
+	return false
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+/* Returns a task compiling the source to the object file, with the extra flags of the target, which may be nil. */
+func (tc *Toolchain) Compile(source, object string, target *Target) *CompileTask {
+	compiler := orDefault(tc.CC, "cc")
+	if isCXX(source) {
+		compiler = orDefault(tc.CXX, "c++")
+	}
+	command := []string{compiler}
+	command = append(command, tc.Flags...)
+	if target != nil {
+		command = append(command, target.Flags...)
+	}
+	includes, defines := tc.IncludeDirs, tc.Defines
+	if target != nil {
+		includes = append(append([]string(nil), includes...), target.IncludeDirs...)
+		defines = append(append([]string(nil), defines...), target.Defines...)
+	}
+	for _, dir := range includes {
+		command = append(command, "-I"+dir)
+	}
+	for _, define := range defines {
+		command = append(command, "-D"+define)
+	}
+	depfile := object + ".d"
+	command = append(command, "-c", source, "-o", object, "-MD", "-MF", depfile)
+	return &CompileTask{Source: source, Object: object, command: command, depfile: depfile}
+}
+
+/* Returns a task archiving the objects into a static library. */
+func (tc *Toolchain) Archive(output string, objects ...*CompileTask) *ArchiveTask {
+	command := []string{orDefault(tc.AR, "ar"), "rcs", output}
+	for _, object := range objects {
+		command = append(command, object.Object)
+	}
+	return &ArchiveTask{Output: output, Objects: objects, command: command}
+}
+
+/* Returns a task linking the objects and libraries into a program. */
+func (tc *Toolchain) Link(output string, objects []*CompileTask, libraries []*ArchiveTask) *LinkTask {
+	linker := orDefault(tc.CC, "cc")
+	for _, object := range objects {
+		if isCXX(object.Source) {
+			linker = orDefault(tc.CXX, "c++")
+			break
+		}
+	}
+	command := append([]string{linker}, tc.LinkFlags...)
+	command = append(command, "-o", output)
+	for _, object := range objects {
+		command = append(command, object.Object)
+	}
+	for _, library := range libraries {
+		command = append(command, library.Output)
+	}
+	command = append(command, tc.LinkLibs...)
+	return &LinkTask{Output: output, Objects: objects, Libraries: libraries, command: command}
+}
+
+func (tc *Toolchain) compileAll(target *Target, dir string) []*CompileTask {
+	objects := make([]*CompileTask, len(target.Sources))
+	for i, source := range target.Sources {
+		objects[i] = tc.Compile(source, ObjectPath(filepath.Join(dir, "obj"), source), target)
+	}
+	return objects
+}
+
+/* Returns a task building the target as the static library lib<Name>.a. */
+func (tc *Toolchain) Library(target Target) *ArchiveTask {
+	dir := tc.outputDir(&target)
+	return tc.Archive(filepath.Join(dir, "lib"+target.Name+".a"), tc.compileAll(&target, dir)...)
+}
+
+/* Returns a task building the target as a program. */
+func (tc *Toolchain) Program(target Target) *LinkTask {
+	dir := tc.outputDir(&target)
+	return tc.Link(filepath.Join(dir, target.Name), tc.compileAll(&target, dir), target.Libraries)
+}
+
+/* Error given when a command of the toolchain fails. */
+type ErrCommandFailed struct {
+	Command []string
+	Err     error
+}
+
+func (err *ErrCommandFailed) Error() string {
+	return fmt.Sprintf("command %q failed: %v", err.Command, err.Err)
+}
+
+func (err *ErrCommandFailed) Unwrap() error { return err.Err }
+
+/* Runs the command, relaying its output to the standard output and error of the process as they are at the time. */
+func run(command []string, output string) error {
+	if err := os.MkdirAll(filepath.Dir(output), 0o755); err != nil {
+		return err
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return &ErrCommandFailed{command, err}
+	}
+	return nil
+}
+
+/* Kinds of tasks, distinguishing the hashes of tasks with the same output. */
+const (
+	hashBaseCompile byte = iota
+	hashBaseArchive
+	hashBaseLink
+	hashBaseCompileCommands
+)
+
+func hashOutput(base byte, output string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte{base})
+	h.Write([]byte(filepath.Clean(output)))
+	return h.Sum64()
+}
+
+/* Compiles a source file to an object file. Tasks with the same object are the same task. */
+type CompileTask struct {
+	Source, Object string
+	command        []string
+	depfile        string
+}
+
+func (t *CompileTask) Hash() uint64 { return hashOutput(hashBaseCompile, t.Object) }
+func (t *CompileTask) Matches(other nbt.Task) bool {
+	converted, ok := other.(*CompileTask)
+	return ok && filepath.Clean(converted.Object) == filepath.Clean(t.Object)
+}
+func (t *CompileTask) String() string { return "compile " + t.Object }
+
+/* Returns the command line compiling the source. */
+func (t *CompileTask) Command() []string { return t.command }
+
+func (t *CompileTask) Action() nbt.ActionSpec {
+	return nbt.ActionSpec{
+		/* The source is required as a file, so that rules may generate it. */
+		Requires: []nbt.Task{nbt.File(t.Source)},
+		Inputs:   []string{t.Source},
+		Outputs:  []string{t.Object, t.depfile},
+		Command:  t.command,
+		Depfile:  t.depfile,
+	}
+}
+
+func (t *CompileTask) Perform(h nbt.Handler) error {
+	h.RequireAndWait(nbt.File(t.Source))
+	return run(t.command, t.Object)
+}
+
+/* Archives object files into a static library. Tasks with the same output are the same task. */
+type ArchiveTask struct {
+	Output  string
+	Objects []*CompileTask
+	command []string
+}
+
+func (t *ArchiveTask) Hash() uint64 { return hashOutput(hashBaseArchive, t.Output) }
+func (t *ArchiveTask) Matches(other nbt.Task) bool {
+	converted, ok := other.(*ArchiveTask)
+	return ok && filepath.Clean(converted.Output) == filepath.Clean(t.Output)
+}
+func (t *ArchiveTask) String() string { return "archive " + t.Output }
+
+func (t *ArchiveTask) Action() nbt.ActionSpec {
+	action := nbt.ActionSpec{Outputs: []string{t.Output}, Command: t.command}
+	for _, object := range t.Objects {
+		action.Requires = append(action.Requires, object)
+		action.Inputs = append(action.Inputs, object.Object)
+	}
+	return action
+}
+
+func (t *ArchiveTask) Perform(h nbt.Handler) error {
+	h.RequireAndWait(t.Action().Requires...)
+	/* The archiver adds to an existing archive, which may hold objects that are no longer part of the library. */
+	if err := os.Remove(t.Output); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return run(t.command, t.Output)
+}
+
+/* Links object files and libraries into a program. Tasks with the same output are the same task. */
+type LinkTask struct {
+	Output    string
+	Objects   []*CompileTask
+	Libraries []*ArchiveTask
+	command   []string
+}
+
+func (t *LinkTask) Hash() uint64 { return hashOutput(hashBaseLink, t.Output) }
+func (t *LinkTask) Matches(other nbt.Task) bool {
+	converted, ok := other.(*LinkTask)
+	return ok && filepath.Clean(converted.Output) == filepath.Clean(t.Output)
+}
+func (t *LinkTask) String() string { return "link " + t.Output }
+
+func (t *LinkTask) Action() nbt.ActionSpec {
+	action := nbt.ActionSpec{Outputs: []string{t.Output}, Command: t.command}
+	for _, object := range t.Objects {
+		action.Requires = append(action.Requires, object)
+		action.Inputs = append(action.Inputs, object.Object)
+	}
+	for _, library := range t.Libraries {
+		action.Requires = append(action.Requires, library)
+		action.Inputs = append(action.Inputs, library.Output)
+	}
+	return action
+}
+
+func (t *LinkTask) Perform(h nbt.Handler) error {
+	h.RequireAndWait(t.Action().Requires...)
+	return run(t.command, t.Output)
+}
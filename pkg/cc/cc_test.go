@@ -0,0 +1,208 @@
+package cc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+func TestObjectPath(t *testing.T) {
+	tests := []struct {
+		dir, source, expected string
+	}{
+		{`obj`, `hello.c`, `obj/hello.c.o`},
+		{`obj`, `src/./hello.c`, `obj/src/hello.c.o`},
+		{`obj`, `hello.cpp`, `obj/hello.cpp.o`},
+		{`obj`, `../lib/x.c`, `obj/__/lib/x.c.o`},
+		{`obj`, `/usr/src/x.c`, `obj/usr/src/x.c.o`},
+	}
+	for i, test := range tests {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			if actual := ObjectPath(test.dir, test.source); actual != filepath.FromSlash(test.expected) {
+				t.Errorf(`got %q, expected %q`, actual, test.expected)
+			}
+		})
+	}
+}
+
+/* Writes stand-ins for cc, c++ and ar to dir, which log their arguments to the returned file. The compilers copy
+their source to their output and write a depfile, and linking and archiving concatenate the inputs. */
+func stubToolchain(t *testing.T, dir string) (toolchain *Toolchain, log string) {
+	t.Helper()
+	log = filepath.Join(dir, `log`)
+	compiler := `#!/bin/sh
+echo "$(basename "$0") $*" >> '` + log + `'
+out= dep= src= inputs=
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-o) out=$2; shift ;;
+	-MF) dep=$2; shift ;;
+	-c) src=$2; shift ;;
+	-*) ;;
+	*) inputs="$inputs $1" ;;
+	esac
+	shift
+done
+if [ -n "$src" ]; then
+	cat "$src" > "$out" || exit 1
+	echo "$out: $src" > "$dep"
+else
+	cat $inputs > "$out"
+fi
+`
+	archiver := `#!/bin/sh
+echo "ar $*" >> '` + log + `'
+shift
+out=$1
+shift
+cat "$@" > "$out"
+`
+	for name, script := range map[string]string{`cc`: compiler, `c++`: compiler, `ar`: archiver} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Toolchain{
+		CC: filepath.Join(dir, `cc`), CXX: filepath.Join(dir, `c++`), AR: filepath.Join(dir, `ar`),
+		Flags: []string{`-O2`}, IncludeDirs: []string{`include`}, Defines: []string{`DEBUG`},
+		OutputDir: filepath.Join(dir, `build`),
+	}, log
+}
+
+func readLog(t *testing.T, log string) []string {
+	t.Helper()
+	data, err := os.ReadFile(log)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestProgram(t *testing.T) {
+	dir := t.TempDir()
+	toolchain, log := stubToolchain(t, dir)
+	source := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		os.WriteFile(path, []byte(contents), 0o644)
+		return path
+	}
+	greet := toolchain.Library(Target{Name: `greet`, Sources: []string{source(`greet/greet.c`, `greet `)}})
+	program := toolchain.Program(Target{
+		Name:      `hello`,
+		Sources:   []string{source(`main.c`, `main `), source(`util.cpp`, `util `)},
+		Defines:   []string{`VERSION=2`},
+		Libraries: []*ArchiveTask{greet},
+	})
+	database := filepath.Join(dir, `compile_commands.json`)
+	main := nbt.Task(&groupTask{[]nbt.Task{program, CompileCommands(database, program)}})
+	options := nbt.Options{MaxParallelTasks: 4, Staleness: nbt.StalenessModTime}
+	if result := nbt.StartWithOptions(main, options); !result.Succeeded() {
+		t.Fatal(`build failed: `, result.Failed)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, `build`, `hello`, `hello`)); err != nil || string(data) != `main util greet ` {
+		t.Errorf(`program %q, %v`, data, err)
+	}
+	commands := readLog(t, log)
+	if len(commands) != 5 {
+		t.Fatalf(`expected 5 commands, got %q`, commands)
+	}
+	expectedObject := filepath.Join(dir, `build`, `hello`, `obj`, ObjectPath(``, filepath.Join(dir, `main.c`)))
+	compileMain := fmt.Sprintf(`cc -O2 -Iinclude -DDEBUG -DVERSION=2 -c %s -o %s -MD -MF %s.d`,
+		filepath.Join(dir, `main.c`), expectedObject, expectedObject)
+	if !contains(commands, compileMain) {
+		t.Errorf(`expected %q among %q`, compileMain, commands)
+	}
+	for _, prefix := range []string{`c++ -O2 -Iinclude -DDEBUG -DVERSION=2 -c`, `ar rcs`, `c++ -o`} {
+		if !hasPrefix(commands, prefix) {
+			t.Errorf(`expected a command starting with %q among %q`, prefix, commands)
+		}
+	}
+	/* The library is compiled without the definitions of the program. */
+	if !hasPrefix(commands, `cc -O2 -Iinclude -DDEBUG -c `+filepath.Join(dir, `greet`, `greet.c`)) {
+		t.Errorf(`expected the library to be compiled with only the toolchain's flags, got %q`, commands)
+	}
+
+	var entries []compileCommand
+	if data, err := os.ReadFile(database); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	/* The log only has the name of the compiler, while the database has its path. */
+	if len(entries) != 3 || entries[0].File != filepath.Join(dir, `main.c`) || entries[0].Output != expectedObject ||
+		entries[0].Arguments[0] != toolchain.CC || `cc `+strings.Join(entries[0].Arguments[1:], ` `) != compileMain ||
+		!filepath.IsAbs(entries[0].Directory) {
+		t.Errorf(`unexpected compile commands %+v`, entries)
+	}
+
+	/* Nothing has changed, so nothing runs again. */
+	if result := nbt.StartWithOptions(main, options); !result.Succeeded() {
+		t.Fatal(`second build failed: `, result.Failed)
+	}
+	if again := readLog(t, log); len(again) != len(commands) {
+		t.Errorf(`expected no more commands, got %q`, again[len(commands):])
+	}
+}
+
+func TestCompileFailure(t *testing.T) {
+	dir := t.TempDir()
+	toolchain, _ := stubToolchain(t, dir)
+	/* The source is missing, so the File task fails before the compiler is run. */
+	missing := toolchain.Compile(filepath.Join(dir, `missing.c`), filepath.Join(dir, `missing.o`), nil)
+	result := nbt.StartWithOptions(missing, nbt.Options{MaxParallelTasks: 1})
+	var noRule *nbt.ErrNoRule
+	if result.Succeeded() || !errors.As(result.Failed[0].Err, &noRule) {
+		t.Errorf(`expected the missing source to fail the build, got %v`, result.Failed)
+	}
+
+	/* The stub compiler fails to read a directory. */
+	os.Mkdir(filepath.Join(dir, `directory.c`), 0o755)
+	broken := toolchain.Compile(filepath.Join(dir, `directory.c`), filepath.Join(dir, `directory.o`), nil)
+	result = nbt.StartWithOptions(broken, nbt.Options{MaxParallelTasks: 1})
+	var failed *ErrCommandFailed
+	if result.Succeeded() || !errors.As(result.Failed[0].Err, &failed) || failed.Command[0] != toolchain.CC {
+		t.Errorf(`expected the compiler to fail, got %v`, result.Failed)
+	}
+}
+
+func contains(commands []string, command string) bool {
+	for _, c := range commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPrefix(commands []string, prefix string) bool {
+	for _, c := range commands {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Requires all of its tasks. */
+type groupTask struct {
+	tasks []nbt.Task
+}
+
+func (g *groupTask) Hash() uint64 { return 0 }
+func (g *groupTask) Matches(other nbt.Task) bool {
+	_, ok := other.(*groupTask)
+	return ok
+}
+func (g *groupTask) Perform(h nbt.Handler) error {
+	h.RequireAndWait(g.tasks...)
+	return nil
+}
@@ -0,0 +1,90 @@
+package cc
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/kyle_anderson/nbt/internal/atomicfile"
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* An entry of a compilation database, as read by clangd and other editor tooling. */
+type compileCommand struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Arguments []string `json:"arguments"`
+	Output    string   `json:"output"`
+}
+
+/* Returns the compile tasks of the given tasks, which may be compile, archive or link tasks, without duplicates. */
+func compileTasks(tasks []nbt.Task) []*CompileTask {
+	var compiles []*CompileTask
+	seen := make(map[string]bool)
+	add := func(objects []*CompileTask) {
+		for _, object := range objects {
+			if path := filepath.Clean(object.Object); !seen[path] {
+				seen[path] = true
+				compiles = append(compiles, object)
+			}
+		}
+	}
+	for _, task := range tasks {
+		switch task := task.(type) {
+		case *CompileTask:
+			add([]*CompileTask{task})
+		case *ArchiveTask:
+			add(task.Objects)
+		case *LinkTask:
+			add(task.Objects)
+			for _, library := range task.Libraries {
+				add(library.Objects)
+			}
+		}
+	}
+	return compiles
+}
+
+/* Writes the compilation database (compile_commands.json) for the sources of the given tasks, which may be compile,
+archive or link tasks. Other tasks are ignored. Commands are run from dir, which should be absolute. */
+func WriteCompileCommands(w io.Writer, dir string, tasks ...nbt.Task) error {
+	commands := []compileCommand{}
+	for _, compile := range compileTasks(tasks) {
+		commands = append(commands, compileCommand{dir, compile.Source, compile.command, compile.Object})
+	}
+	data, err := json.MarshalIndent(commands, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+/* Writes the compilation database for the sources of the targets to a file. The targets are not built. */
+type CompileCommandsTask struct {
+	Path    string
+	Targets []nbt.Task
+}
+
+/* Returns a task writing compile_commands.json to the given path for the sources of the targets. */
+func CompileCommands(path string, targets ...nbt.Task) *CompileCommandsTask {
+	return &CompileCommandsTask{path, targets}
+}
+
+func (t *CompileCommandsTask) Hash() uint64 { return hashOutput(hashBaseCompileCommands, t.Path) }
+func (t *CompileCommandsTask) Matches(other nbt.Task) bool {
+	converted, ok := other.(*CompileCommandsTask)
+	return ok && filepath.Clean(converted.Path) == filepath.Clean(t.Path)
+}
+func (t *CompileCommandsTask) String() string { return "compile commands " + t.Path }
+
+func (t *CompileCommandsTask) Perform(nbt.Handler) error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(t.Path, 0o644, func(w io.Writer) error {
+		return WriteCompileCommands(w, dir, t.Targets...)
+	})
+}
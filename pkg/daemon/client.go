@@ -0,0 +1,37 @@
+package daemon
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+)
+
+/* Error given when the connection to the daemon is lost during a build. */
+var ErrDisconnected = errors.New("lost connection to the daemon during the build")
+
+/* Runs a build with the daemon listening on the given socket, relaying the output of the build.
+Returns the exit code of the build. ErrDisconnected is returned if the daemon went away during the build,
+and other errors if the daemon could not be reached, in which case the build may be run directly instead. */
+func Build(socket string, args []string, stdout, stderr io.Writer) (int, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if err := gob.NewEncoder(conn).Encode(&request{args}); err != nil {
+		return 0, err
+	}
+	decoder := gob.NewDecoder(conn)
+	for {
+		var message response
+		if err := decoder.Decode(&message); err != nil {
+			return ExitFailed, ErrDisconnected
+		}
+		if message.Done {
+			return message.ExitCode, nil
+		}
+		stdout.Write(message.Stdout)
+		stderr.Write(message.Stderr)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+daemon: Keeps the tasks of a project in memory between builds, so that builds do not have to discover the graph
+of tasks again from the main task. A daemon is the project's own build program calling Main, started by the daemon
+command of the nbt tool, which names the socket to listen on in the environment variable SocketEnv.
+It serves builds one at a time to thin clients over a Unix socket, using an nbt.Session.
+Everything written to standard output, standard error and the standard logger of the process during a build
+is relayed to the client, and the client exits with the same code as a direct run of the build would.
+*/
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+	"gitlab.com/kyle_anderson/nbt/pkg/watch"
+)
+
+/* Path of the socket of a project's daemon, relative to the root of the project. */
+const DefaultSocket = ".nbt/daemon.sock"
+
+/* Environment variable holding the path of the socket on which Main serves builds, instead of running one. */
+const SocketEnv = "NBT_DAEMON_SOCKET"
+
+/* Exit codes of builds, which are the same whether the build is run directly or by a daemon. */
+const (
+	ExitSuccess = 0
+	/* Some of the tasks failed. */
+	ExitFailed = 1
+	/* The arguments did not name a build. */
+	ExitUsage = 2
+)
+
+/* Returns the main task of the build named by the given command line arguments. */
+type RootFunc func(args []string) (nbt.Task, error)
+
+/* Builds the main task named by the arguments with the given function, returning the exit code of the build. */
+func run(build func(nbt.Task, nbt.Options) *nbt.Result, roots RootFunc, args []string, options nbt.Options, stderr io.Writer) int {
+	root, err := roots(args)
+	if err != nil {
+		fmt.Fprintln(stderr, "nbt:", err)
+		return ExitUsage
+	}
+	if !build(root, options).Succeeded() {
+		return ExitFailed
+	}
+	return ExitSuccess
+}
+
+/* Runs a build directly, without a daemon, returning its exit code. */
+func Run(roots RootFunc, args []string, options nbt.Options) int {
+	return run(nbt.StartWithOptions, roots, args, options, os.Stderr)
+}
+
+/* The entry point of a project's build program. When SocketEnv is set, serves builds on the socket it names
+until killed. When the first argument is "--watch", runs the build named by the remaining arguments,
+and runs it again whenever its input files change, until interrupted. Otherwise runs the build named by
+the arguments, with the project's daemon if one is running, or directly if not. Exits with the exit code of the build. */
+func Main(roots RootFunc, options nbt.Options) {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "--watch" {
+		os.Exit(runWatch(roots, args[1:], options))
+	}
+	if socket := os.Getenv(SocketEnv); socket != "" {
+		listener, err := Listen(socket)
+		if err == nil {
+			err = NewServer(roots, options).Serve(listener)
+		}
+		fmt.Fprintln(os.Stderr, "nbt daemon:", err)
+		os.Exit(ExitFailed)
+	}
+	code, err := Build(DefaultSocket, args, os.Stdout, os.Stderr)
+	if errors.Is(err, ErrDisconnected) {
+		fmt.Fprintln(os.Stderr, "nbt:", err)
+	} else if err != nil {
+		/* There is no daemon running. */
+		code = Run(roots, args, options)
+	}
+	os.Exit(code)
+}
+
+/* Runs the build named by the arguments in watch mode until interrupted. */
+func runWatch(roots RootFunc, args []string, options nbt.Options) int {
+	root, err := roots(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "nbt:", err)
+		return ExitUsage
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	watcher := watch.New()
+	defer watcher.Close()
+	session := nbt.NewSession(options.DebugIdentity)
+	watch.Loop(ctx, session, root, watcher, watch.Options{Build: options, Report: func(result *nbt.Result, changed []string) {
+		outcome := "succeeded"
+		if !result.Succeeded() {
+			outcome = "failed"
+		}
+		if changed != nil {
+			fmt.Fprintf(os.Stderr, "nbt: rebuilt after changes to %s\n", strings.Join(changed, ", "))
+		}
+		fmt.Fprintf(os.Stderr, "nbt: build %s, watching %d files for changes\n", outcome, len(session.Inputs()))
+	}})
+	return ExitSuccess
+}
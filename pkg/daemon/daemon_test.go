@@ -0,0 +1,188 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* A task that prints its name and requires its children. */
+type printTask struct {
+	name     string
+	children []nbt.Task
+	fails    bool
+	runs     *atomic.Int32
+}
+
+func (t *printTask) Hash() uint64 { return uint64(len(t.name)) }
+func (t *printTask) Matches(other nbt.Task) bool {
+	converted, ok := other.(*printTask)
+	return ok && converted.name == t.name
+}
+func (t *printTask) Perform(h nbt.Handler) error {
+	t.runs.Add(1)
+	h.RequireAndWait(t.children...)
+	fmt.Println(`performed`, t.name)
+	if t.fails {
+		log.Println(`failing`, t.name)
+		return errors.New(`failed`)
+	}
+	return nil
+}
+
+type testProject struct {
+	runs atomic.Int32
+}
+
+func (p *testProject) roots(args []string) (nbt.Task, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf(`expected one argument, got %q`, args)
+	}
+	leaf := &printTask{name: `leaf`, runs: &p.runs}
+	switch args[0] {
+	case `good`:
+		return &printTask{name: `good`, children: []nbt.Task{leaf}, runs: &p.runs}, nil
+	case `bad`:
+		return &printTask{name: `bad`, children: []nbt.Task{leaf}, fails: true, runs: &p.runs}, nil
+	}
+	return nil, fmt.Errorf(`unknown build %q`, args[0])
+}
+
+/* Starts a daemon for the project, returning the path of its socket. */
+func startDaemon(t *testing.T, project *testProject) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), `daemon.sock`)
+	listener, err := Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go NewServer(project.roots, nbt.Options{MaxParallelTasks: 2}).Serve(listener)
+	return socket
+}
+
+func TestDaemon(t *testing.T) {
+	project := &testProject{}
+	socket := startDaemon(t, project)
+
+	for i, test := range []struct {
+		args           []string
+		code           int
+		stdout, stderr string
+		/* Number of tasks performed by the build. */
+		runs int32
+	}{
+		{[]string{`good`}, ExitSuccess, "performed leaf\nperformed good\n", ``, 2},
+		/* Only the main task is new to the daemon. */
+		{[]string{`bad`}, ExitFailed, "performed bad\n", "failing bad\n", 1},
+		{[]string{`good`}, ExitSuccess, ``, ``, 0},
+		/* Failed tasks run again. */
+		{[]string{`bad`}, ExitFailed, "performed bad\n", "failing bad\n", 1},
+		{[]string{`unknown`}, ExitUsage, ``, "nbt: unknown build \"unknown\"\n", 0},
+		{nil, ExitUsage, ``, "nbt: expected one argument, got []\n", 0},
+	} {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			before := project.runs.Load()
+			var stdout, stderr bytes.Buffer
+			code, err := Build(socket, test.args, &stdout, &stderr)
+			if err != nil {
+				t.Fatal(`Build: `, err)
+			}
+			if code != test.code {
+				t.Errorf(`exit code %d, expected %d`, code, test.code)
+			}
+			if stdout.String() != test.stdout {
+				t.Errorf(`stdout %q, expected %q`, stdout.String(), test.stdout)
+			}
+			/* The log also relays the failures of tasks, which include the addresses of the tasks. */
+			if !bytes.Contains(stderr.Bytes(), []byte(test.stderr)) {
+				t.Errorf(`stderr %q, expected it to contain %q`, stderr.String(), test.stderr)
+			}
+			if runs := project.runs.Load() - before; runs != test.runs {
+				t.Errorf(`%d tasks performed, expected %d`, runs, test.runs)
+			}
+		})
+	}
+}
+
+func TestExitCodesMatchDirectRuns(t *testing.T) {
+	socket := startDaemon(t, &testProject{})
+	for _, args := range [][]string{{`good`}, {`bad`}, {`unknown`}} {
+		var stderr bytes.Buffer
+		direct := run(nbt.StartWithOptions, (&testProject{}).roots, args, nbt.Options{MaxParallelTasks: 2}, &stderr)
+		daemon, err := Build(socket, args, &bytes.Buffer{}, &bytes.Buffer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if direct != daemon {
+			t.Errorf(`%q: direct run exited with %d, daemon with %d`, args, direct, daemon)
+		}
+	}
+}
+
+func TestConcurrentServers(t *testing.T) {
+	sockets := []string{startDaemon(t, &testProject{}), startDaemon(t, &testProject{})}
+	var wg sync.WaitGroup
+	outputs := make([]bytes.Buffer, len(sockets)*5)
+	for i := range outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := Build(sockets[i%len(sockets)], []string{`good`}, &outputs[i], &bytes.Buffer{}); err != nil {
+				t.Error(`Build: `, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	/* Each server performs the tasks on its first build only, and no build receives the output of another. */
+	var performed int
+	for i := range outputs {
+		switch output := outputs[i].String(); output {
+		case "performed leaf\nperformed good\n":
+			performed++
+		case ``:
+		default:
+			t.Errorf(`unexpected output %q`, output)
+		}
+	}
+	if performed != len(sockets) {
+		t.Errorf(`%d builds performed the tasks, expected %d`, performed, len(sockets))
+	}
+}
+
+func TestListen(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), `sub`, `daemon.sock`)
+	listener, err := Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var running *ErrRunning
+	if _, err := Listen(socket); !errors.As(err, &running) {
+		t.Errorf(`expected ErrRunning while the daemon is listening, got %v`, err)
+	}
+	/* Leaves the socket file behind, as a daemon that was killed would. */
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	if _, err := os.Stat(socket); err != nil {
+		t.Fatal(`socket was removed: `, err)
+	}
+	if listener, err = Listen(socket); err != nil {
+		t.Errorf(`failed to replace a stale socket: %v`, err)
+	} else {
+		listener.Close()
+	}
+
+	if _, err := Build(filepath.Join(t.TempDir(), `none.sock`), nil, nil, nil); err == nil || errors.Is(err, ErrDisconnected) {
+		t.Errorf(`expected a connection error without a daemon, got %v`, err)
+	}
+}
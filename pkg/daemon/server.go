@@ -0,0 +1,184 @@
+package daemon
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* A request from a client to run a build. */
+type request struct {
+	Args []string
+}
+
+/* A message to a client about its build. Every message other than the last relays output of the build. */
+type response struct {
+	Stdout, Stderr []byte
+	/* Set on the last message of a build. */
+	Done     bool
+	ExitCode int
+}
+
+/* Error given when a daemon is already listening on a socket. */
+type ErrRunning struct {
+	Socket string
+}
+
+func (err *ErrRunning) Error() string { return "a daemon is already listening on " + err.Socket }
+
+/* Listens on the Unix socket at the given path, creating its directory if needed.
+A socket left behind by a daemon that is no longer running is replaced. */
+func Listen(socket string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socket), 0o755); err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		return nil, &ErrRunning{socket}
+	}
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", socket)
+}
+
+/* Serves builds to clients, keeping the state of tasks between builds. Builds run one at a time, and since
+their output is captured from the whole process, only one build runs at a time in a process even with several
+servers. Nothing else in the process should write to standard output or standard error during a build,
+since it would be relayed to the client of the build. */
+type Server struct {
+	roots   RootFunc
+	options nbt.Options
+	/* Held while building, since builds of a session must not run at the same time. */
+	mu      sync.Mutex
+	session *nbt.Session
+}
+
+/* Returns a server running builds named by roots with the given options. */
+func NewServer(roots RootFunc, options nbt.Options) *Server {
+	return &Server{roots: roots, options: options, session: nbt.NewSession(options.DebugIdentity)}
+}
+
+/* Serves clients connecting to the listener until it is closed. */
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+/* Runs the build requested over the connection. */
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	var req request
+	if err := gob.NewDecoder(conn).Decode(&req); err != nil {
+		log.Printf("nbt daemon: reading request: %v\n", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(s.buildContext())
+	defer cancel()
+	go func() {
+		/* Clients send nothing more, so the connection only becomes readable once the client hangs up,
+		in which case the build is cancelled. */
+		conn.Read(make([]byte, 1))
+		cancel()
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	encoder := gob.NewEncoder(conn)
+	var encoderMu sync.Mutex
+	send := func(message response) {
+		encoderMu.Lock()
+		defer encoderMu.Unlock()
+		/* Errors are noticed through the cancellation of the build. */
+		encoder.Encode(&message)
+	}
+	options := s.options
+	options.Context = ctx
+	var code int
+	captureOutput(send, func(stderr io.Writer) {
+		code = run(s.session.Build, s.roots, req.Args, options, stderr)
+	})
+	send(response{Done: true, ExitCode: code})
+}
+
+func (s *Server) buildContext() context.Context {
+	if s.options.Context != nil {
+		return s.options.Context
+	}
+	return context.Background()
+}
+
+/* Held while the output of the process is captured, which only one build can do at a time. */
+var captureMu sync.Mutex
+
+/* Calls f with the standard output, standard error and standard logger of the process redirected to messages,
+which are given to send. Output written by f after it returns is not captured.
+Waits for any other capture in the process to finish first. */
+func captureOutput(send func(response), f func(stderr io.Writer)) {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		send(response{Stderr: []byte("nbt daemon: " + err.Error() + "\n")})
+		f(io.Discard)
+		return
+	}
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdoutReader.Close()
+		stdoutWriter.Close()
+		send(response{Stderr: []byte("nbt daemon: " + err.Error() + "\n")})
+		f(io.Discard)
+		return
+	}
+	var relays sync.WaitGroup
+	relay := func(r *os.File, isStderr bool) {
+		defer relays.Done()
+		defer r.Close()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				data := append([]byte(nil), buf[:n]...)
+				if isStderr {
+					send(response{Stderr: data})
+				} else {
+					send(response{Stdout: data})
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	relays.Add(2)
+	go relay(stdoutReader, false)
+	go relay(stderrReader, true)
+
+	stdout, stderr, logOutput := os.Stdout, os.Stderr, log.Writer()
+	os.Stdout, os.Stderr = stdoutWriter, stderrWriter
+	log.SetOutput(stderrWriter)
+	defer func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		log.SetOutput(logOutput)
+		stdoutWriter.Close()
+		stderrWriter.Close()
+		relays.Wait()
+	}()
+	f(stderrWriter)
+}
@@ -0,0 +1,184 @@
+/*
+depfile: Reads the Make-format dependency files written by compilers, such as by the -MD and -MF options of gcc and
+clang, which list the headers each source file includes. Escaped spaces, escaped hashes, doubled dollar signs and
+line continuations are understood, as written by gcc.
+*/
+package depfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/* A rule of a depfile, stating that the targets depend on the prerequisites. */
+type Rule struct {
+	Targets       []string
+	Prerequisites []string
+}
+
+/* Error given for depfiles that are not in the expected format. */
+type ErrSyntax struct {
+	/* The line the rule with the error starts on, counting from one. */
+	Line    int
+	Message string
+}
+
+func (err *ErrSyntax) Error() string {
+	return fmt.Sprintf("depfile line %d: %s", err.Line, err.Message)
+}
+
+/* Parses the rules of a depfile. */
+func Parse(r io.Reader) ([]Rule, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	line := 1
+	for len(data) > 0 {
+		logical, rest, lines := nextLine(data)
+		rule, ok, err := parseRule(logical)
+		if err != nil {
+			return rules, &ErrSyntax{line, err.Error()}
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+		data, line = rest, line+lines
+	}
+	return rules, nil
+}
+
+/* Reads the rules of the depfile at the given path. */
+func ReadFile(path string) ([]Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+/* Returns the prerequisites of all of the rules without duplicates, in the order they first appear. */
+func Prerequisites(rules []Rule) []string {
+	var prerequisites []string
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		for _, prerequisite := range rule.Prerequisites {
+			if cleaned := filepath.Clean(prerequisite); !seen[cleaned] {
+				seen[cleaned] = true
+				prerequisites = append(prerequisites, prerequisite)
+			}
+		}
+	}
+	return prerequisites
+}
+
+/* Splits off the first logical line of the data, joining lines ending in a backslash with a space.
+Returns the logical line, the remaining data and the number of physical lines consumed. */
+func nextLine(data []byte) (logical, rest []byte, lines int) {
+	for {
+		lines++
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			return append(logical, data...), nil, lines
+		}
+		physical := bytes.TrimSuffix(data[:end], []byte{'\r'})
+		data = data[end+1:]
+		if !continues(physical) {
+			return append(logical, physical...), data, lines
+		}
+		logical = append(append(logical, physical[:len(physical)-1]...), ' ')
+	}
+}
+
+/* Returns true if the line ends in an odd number of backslashes, so that its last backslash escapes the newline. */
+func continues(line []byte) bool {
+	n := 0
+	for n < len(line) && line[len(line)-1-n] == '\\' {
+		n++
+	}
+	return n%2 == 1
+}
+
+func isSpace(c byte) bool { return c == ' ' || c == '\t' }
+
+/* Parses a logical line. Returns false for lines with no rule, such as blank lines and comments. */
+func parseRule(line []byte) (rule Rule, ok bool, err error) {
+	colon := false
+	for i := 0; i < len(line); {
+		if isSpace(line[i]) {
+			i++
+			continue
+		}
+		if line[i] == '#' {
+			break
+		}
+		var word []byte
+		var ended bool
+		word, i, ended = parseWord(line, i)
+		if len(word) > 0 {
+			if colon {
+				rule.Prerequisites = append(rule.Prerequisites, string(word))
+			} else {
+				rule.Targets = append(rule.Targets, string(word))
+			}
+		}
+		if ended {
+			if colon {
+				return rule, false, fmt.Errorf("more than one colon")
+			}
+			if len(rule.Targets) == 0 {
+				return rule, false, fmt.Errorf("rule without targets")
+			}
+			colon = true
+		}
+	}
+	if !colon {
+		if len(rule.Targets) > 0 {
+			return rule, false, fmt.Errorf("missing colon after %q", rule.Targets[0])
+		}
+		return rule, false, nil
+	}
+	return rule, true, nil
+}
+
+/* Parses the word starting at the given index, unescaping it. Returns the index after the word, and true if the
+word is ended by the colon separating targets from prerequisites, which is a colon followed by a space or the end
+of the line. Other colons, such as those of Windows drive letters, are part of the word. */
+func parseWord(line []byte, i int) (word []byte, next int, colon bool) {
+	for i < len(line) && !isSpace(line[i]) {
+		switch c := line[i]; {
+		case c == '\\':
+			/* 2N backslashes followed by a space are N backslashes ending the word, and 2N+1 are N backslashes
+			and a space within it. The same goes for hashes. Other backslashes are literal, as in Windows paths. */
+			n := 0
+			for i+n < len(line) && line[i+n] == '\\' {
+				n++
+			}
+			if i+n < len(line) && (isSpace(line[i+n]) || line[i+n] == '#') {
+				word = append(word, bytes.Repeat([]byte{'\\'}, n/2)...)
+				i += n
+				if n%2 == 1 {
+					word = append(word, line[i])
+					i++
+				}
+			} else {
+				word = append(word, line[i:i+n]...)
+				i += n
+			}
+		case c == '$' && i+1 < len(line) && line[i+1] == '$':
+			word = append(word, '$')
+			i += 2
+		case c == ':' && (i+1 == len(line) || isSpace(line[i+1])):
+			return word, i + 1, true
+		default:
+			word = append(word, c)
+			i++
+		}
+	}
+	return word, i, false
+}
@@ -0,0 +1,105 @@
+package depfile
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []Rule
+		/* The line of the syntax error expected, or zero for none. */
+		errLine int
+	}{
+		{input: ``},
+		{input: "\n\n  \n"},
+		{
+			input:    `hello.o: hello.c hello.h`,
+			expected: []Rule{{[]string{`hello.o`}, []string{`hello.c`, `hello.h`}}},
+		},
+		/* As written by gcc -MD, with continuations. */
+		{
+			input: "hello.o: hello.c hello.h \\\n /usr/include/stdio.h \\\n  /usr/include/features.h\n",
+			expected: []Rule{{[]string{`hello.o`}, []string{
+				`hello.c`, `hello.h`, `/usr/include/stdio.h`, `/usr/include/features.h`,
+			}}},
+		},
+		/* Continuations with Windows line endings, and a continuation before the prerequisites. */
+		{
+			input:    "hello.o \\\r\n : hello.c \\\r\n hello.h\r\n",
+			expected: []Rule{{[]string{`hello.o`}, []string{`hello.c`, `hello.h`}}},
+		},
+		/* The phony targets written by -MP. */
+		{
+			input: "hello.o: hello.c hello.h\n\nhello.h:\n",
+			expected: []Rule{
+				{[]string{`hello.o`}, []string{`hello.c`, `hello.h`}},
+				{[]string{`hello.h`}, nil},
+			},
+		},
+		{
+			input:    `my\ file.o: my\ file.c dir\ with\ spaces/a\ b.h`,
+			expected: []Rule{{[]string{`my file.o`}, []string{`my file.c`, `dir with spaces/a b.h`}}},
+		},
+		/* Two backslashes before a space are a backslash ending the word, and three are a backslash and a space. */
+		{
+			input:    `out.o: a\\ b\\\ c`,
+			expected: []Rule{{[]string{`out.o`}, []string{`a\`, `b\ c`}}},
+		},
+		{
+			input:    `out.o: cost$$.h \#hash.h`,
+			expected: []Rule{{[]string{`out.o`}, []string{`cost$.h`, `#hash.h`}}},
+		},
+		/* Colons not followed by a space, and backslashes not before a space, are part of the path. */
+		{
+			input:    `c:\build\out.o: c:\src\main.c D:/include/x.h`,
+			expected: []Rule{{[]string{`c:\build\out.o`}, []string{`c:\src\main.c`, `D:/include/x.h`}}},
+		},
+		{
+			input:    "a.o b.o:\tshared.h\n# A comment\n",
+			expected: []Rule{{[]string{`a.o`, `b.o`}, []string{`shared.h`}}},
+		},
+		/* A backslash escaping a backslash does not continue the line. */
+		{
+			input:    "out.o: a\\\\\nb.o: b",
+			expected: []Rule{{[]string{`out.o`}, []string{`a\\`}}, {[]string{`b.o`}, []string{`b`}}},
+		},
+		{input: "out.o: a \\\nb\nmissing colon", errLine: 3},
+		{input: `: orphan.h`, errLine: 1},
+		{input: "\nout.o: a: b", errLine: 2},
+	}
+	for i, test := range tests {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			rules, err := Parse(strings.NewReader(test.input))
+			if test.errLine != 0 {
+				var syntax *ErrSyntax
+				if !errors.As(err, &syntax) || syntax.Line != test.errLine {
+					t.Fatalf(`expected a syntax error on line %d, got %v`, test.errLine, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rules, test.expected) {
+				t.Errorf(`parsed %q, expected %q`, rules, test.expected)
+			}
+		})
+	}
+}
+
+func TestPrerequisites(t *testing.T) {
+	rules := []Rule{
+		{[]string{`a.o`}, []string{`a.c`, `common.h`, `./a.h`}},
+		{[]string{`b.o`}, []string{`b.c`, `common.h`, `a.h`}},
+	}
+	expected := []string{`a.c`, `common.h`, `./a.h`, `b.c`}
+	if prerequisites := Prerequisites(rules); !reflect.DeepEqual(prerequisites, expected) {
+		t.Errorf(`got %q, expected %q`, prerequisites, expected)
+	}
+}
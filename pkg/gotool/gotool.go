@@ -0,0 +1,283 @@
+/*
+gotool: Tasks for building, testing and generating Go packages with the go command.
+The inputs of each task are the files of the package and of its dependencies outside the standard library,
+as listed by go list, so that builds using nbt.Options.Staleness or a cache skip the tasks whose inputs have not
+changed. The files are listed when the task runs, once the tasks it requires have generated their files, so a session
+only notices a file added to a package once another input of the task changes. Changes to the Go toolchain itself
+are not noticed, other than through Toolchain.Env.
+*/
+package gotool
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* How the go command is run. The zero value runs go from the PATH in the working directory of the process. */
+type Toolchain struct {
+	/* The go command. Defaults to "go". */
+	Go string
+	/* The directory commands are run in, such as the root of a module. Package paths are resolved from here. */
+	Dir string
+	/* Environment variables for the go command in the form "KEY=value", such as "GOOS=linux",
+	added to the environment of the process. */
+	Env []string
+	/* Flags for building and testing, such as "-trimpath" or "-tags=integration". */
+	BuildFlags []string
+}
+
+/* Error given when the go command fails. */
+type ErrCommandFailed struct {
+	Command []string
+	Err     error
+	/* What the command wrote to its standard error. */
+	Stderr string
+}
+
+func (err *ErrCommandFailed) Error() string {
+	if err.Stderr == "" {
+		return fmt.Sprintf("command %q failed: %v", err.Command, err.Err)
+	}
+	return fmt.Sprintf("command %q failed: %v\n%s", err.Command, err.Err, err.Stderr)
+}
+
+func (err *ErrCommandFailed) Unwrap() error { return err.Err }
+
+func (tc *Toolchain) command(args ...string) []string {
+	goCommand := tc.Go
+	if goCommand == "" {
+		goCommand = "go"
+	}
+	return append([]string{goCommand}, args...)
+}
+
+/* Runs the go command with the given arguments, writing its standard output to stdout. */
+func (tc *Toolchain) run(command []string, stdout io.Writer) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = tc.Dir
+	cmd.Env = append(os.Environ(), tc.Env...)
+	var stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return &ErrCommandFailed{command, err, stderr.String()}
+	}
+	/* Warnings, such as those of go vet, are passed on. */
+	os.Stderr.Write(stderr.Bytes())
+	return nil
+}
+
+/* The parts of the output of go list -json that name files. */
+type listedPackage struct {
+	Dir      string
+	Standard bool
+	GoFiles, CgoFiles, CFiles, CXXFiles, HFiles, SFiles, SysoFiles, EmbedFiles,
+	TestGoFiles, XTestGoFiles, TestEmbedFiles, XTestEmbedFiles []string
+	Module *struct {
+		GoMod string
+	}
+}
+
+/* Returns the files read when building the package, or testing it if test is set, sorted. */
+func (tc *Toolchain) listInputs(pkg string, test bool) ([]string, error) {
+	args := []string{"list", "-deps", "-json"}
+	if test {
+		args = append(args, "-test")
+	}
+	command := tc.command(append(args, pkg)...)
+	var out bytes.Buffer
+	if err := tc.run(command, &out); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	add := func(dir string, names ...string) {
+		for _, name := range names {
+			path := name
+			if dir != "" {
+				if filepath.IsAbs(name) {
+					/* Files generated by the go command itself, such as the main package of tests, are in its cache. */
+					continue
+				}
+				path = filepath.Join(dir, name)
+			}
+			if !filepath.IsAbs(path) && tc.Dir != "" {
+				path = filepath.Join(tc.Dir, path)
+			}
+			seen[path] = true
+		}
+	}
+	decoder := json.NewDecoder(&out)
+	for {
+		var listed listedPackage
+		if err := decoder.Decode(&listed); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("parsing the output of %q: %w", command, err)
+		}
+		if listed.Standard {
+			continue
+		}
+		files := [][]string{
+			listed.GoFiles, listed.CgoFiles, listed.CFiles, listed.CXXFiles, listed.HFiles, listed.SFiles,
+			listed.SysoFiles, listed.EmbedFiles,
+		}
+		/* The test files of packages are listed either way, but are only read when testing. */
+		if test {
+			files = append(files, listed.TestGoFiles, listed.XTestGoFiles, listed.TestEmbedFiles, listed.XTestEmbedFiles)
+		}
+		for _, names := range files {
+			add(listed.Dir, names...)
+		}
+		if listed.Module != nil && listed.Module.GoMod != "" {
+			add("", listed.Module.GoMod)
+			if sum := filepath.Join(filepath.Dir(listed.Module.GoMod), "go.sum"); fileExists(sum) {
+				add("", sum)
+			}
+		}
+	}
+	inputs := make([]string, 0, len(seen))
+	for input := range seen {
+		inputs = append(inputs, input)
+	}
+	sort.Strings(inputs)
+	return inputs, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+/* Returns the action of a task with the given command and outputs, whose inputs are listed for the package
+once the required tasks are complete. */
+func (tc *Toolchain) action(pkg string, test bool, command, outputs []string, requires []nbt.Task) nbt.ActionSpec {
+	return nbt.ActionSpec{
+		Requires:   requires,
+		ListInputs: func() ([]string, error) { return tc.listInputs(pkg, test) },
+		Outputs:    outputs,
+		Command:    command,
+		Env:        tc.Env,
+	}
+}
+
+/* Kinds of tasks, distinguishing the hashes of tasks with the same identifying string. */
+const (
+	hashBaseBuild byte = iota
+	hashBaseTest
+	hashBaseGenerate
+)
+
+func hashString(base byte, s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte{base})
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func absolute(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+/* Builds a package with go build. Tasks with the same output are the same task. */
+type BuildTask struct {
+	Package string
+	/* The absolute path of the built executable or archive. */
+	Output string
+	/* Tasks that must be complete before building, such as generate tasks. */
+	Requires  []nbt.Task
+	toolchain *Toolchain
+}
+
+/* Returns a task building the package to the output, which is relative to the working directory of the process. */
+func (tc *Toolchain) Build(pkg, output string, requires ...nbt.Task) *BuildTask {
+	return &BuildTask{pkg, absolute(output), requires, tc}
+}
+
+func (t *BuildTask) Hash() uint64 { return hashString(hashBaseBuild, t.Output) }
+func (t *BuildTask) Matches(other nbt.Task) bool {
+	converted, ok := other.(*BuildTask)
+	return ok && converted.Output == t.Output
+}
+func (t *BuildTask) String() string { return "go build " + t.Package }
+
+func (t *BuildTask) command() []string {
+	args := append([]string{"build", "-o", t.Output}, t.toolchain.BuildFlags...)
+	return t.toolchain.command(append(args, t.Package)...)
+}
+
+func (t *BuildTask) Action() nbt.ActionSpec {
+	return t.toolchain.action(t.Package, false, t.command(), []string{t.Output}, t.Requires)
+}
+
+func (t *BuildTask) Perform(h nbt.Handler) error {
+	if len(t.Requires) > 0 {
+		h.RequireAndWait(t.Requires...)
+	}
+	if err := os.MkdirAll(filepath.Dir(t.Output), 0o755); err != nil {
+		return err
+	}
+	return t.toolchain.run(t.command(), os.Stdout)
+}
+
+/* Runs go generate for a package. Tasks for the same package are the same task. */
+type GenerateTask struct {
+	Package string
+	/* The absolute paths of the generated files. Without outputs, the task is never skipped. */
+	Outputs   []string
+	toolchain *Toolchain
+}
+
+/* Returns a task generating the given outputs, which are relative to the working directory of the process. */
+func (tc *Toolchain) Generate(pkg string, outputs ...string) *GenerateTask {
+	absolutes := make([]string, len(outputs))
+	for i, output := range outputs {
+		absolutes[i] = absolute(output)
+	}
+	return &GenerateTask{pkg, absolutes, tc}
+}
+
+func (t *GenerateTask) Hash() uint64 { return hashString(hashBaseGenerate, t.Package) }
+func (t *GenerateTask) Matches(other nbt.Task) bool {
+	converted, ok := other.(*GenerateTask)
+	return ok && converted.Package == t.Package
+}
+func (t *GenerateTask) String() string { return "go generate " + t.Package }
+
+func (t *GenerateTask) Action() nbt.ActionSpec {
+	action := t.toolchain.action(t.Package, false, t.toolchain.command("generate", t.Package), t.Outputs, nil)
+	action.ListInputs = func() ([]string, error) {
+		listed, err := t.toolchain.listInputs(t.Package, false)
+		if err != nil {
+			return nil, err
+		}
+		/* Generated files are listed as files of the package once they exist, but they are not inputs. */
+		generated := make(map[string]bool, len(t.Outputs))
+		for _, output := range t.Outputs {
+			generated[output] = true
+		}
+		inputs := listed[:0]
+		for _, input := range listed {
+			if !generated[input] {
+				inputs = append(inputs, input)
+			}
+		}
+		return inputs, nil
+	}
+	return action
+}
+
+func (t *GenerateTask) Perform(nbt.Handler) error {
+	return t.toolchain.run(t.toolchain.command("generate", t.Package), os.Stdout)
+}
@@ -0,0 +1,277 @@
+package gotool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* A module with a package, for the stub go command to list. */
+type stubModule struct {
+	dir, stub, log string
+}
+
+/* Puts a stand-in for the go command first in the PATH. It logs its arguments, lists the package described by
+list.json, writes "built" to the output of go build, prints test.json for go test and exits with the status in
+test.exit, and writes gen.go for go generate. It fails to list packages if list.fail exists. */
+func newStubModule(t *testing.T) *stubModule {
+	t.Helper()
+	m := &stubModule{dir: t.TempDir(), stub: t.TempDir()}
+	m.log = filepath.Join(m.stub, `log`)
+	script := `#!/bin/sh
+stub='` + m.stub + `'
+echo "go $*" >> "$stub/log"
+case "$1" in
+list)
+	if [ -e "$stub/list.fail" ]; then echo "cannot find package" >&2; exit 1; fi
+	cat "$stub/list.json" ;;
+build)
+	echo built > "$3" ;;
+test)
+	cat "$stub/test.json"
+	exit "$(cat "$stub/test.exit")" ;;
+generate)
+	echo generated > '` + m.dir + `/gen.go' ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(m.stub, `go`), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(`PATH`, m.stub+string(os.PathListSeparator)+os.Getenv(`PATH`))
+	for name, contents := range map[string]string{`a.go`: `package a`, `a_test.go`: `package a`, `go.mod`: `module a`, `gen.go`: `package a`} {
+		m.write(t, filepath.Join(m.dir, name), contents)
+	}
+	m.write(t, filepath.Join(m.stub, `list.json`), `{"Dir": "/usr/lib/go/src/fmt", "Standard": true, "GoFiles": ["print.go"]}
+{"Dir": "`+m.dir+`", "GoFiles": ["a.go", "gen.go"], "TestGoFiles": ["a_test.go"], "Module": {"GoMod": "`+m.dir+`/go.mod"}}
+`)
+	m.write(t, filepath.Join(m.stub, `test.json`), passingTests)
+	m.write(t, filepath.Join(m.stub, `test.exit`), `0`)
+	return m
+}
+
+func (m *stubModule) write(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/* Returns the commands run since the last call, other than listing packages. */
+func (m *stubModule) commands(t *testing.T) []string {
+	t.Helper()
+	var commands []string
+	for _, command := range m.allCommands(t) {
+		if !strings.HasPrefix(command, `go list`) {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+/* Returns the commands run since the last call, including listing packages. */
+func (m *stubModule) allCommands(t *testing.T) []string {
+	t.Helper()
+	data, _ := os.ReadFile(m.log)
+	os.Remove(m.log)
+	var commands []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line != `` {
+			commands = append(commands, line)
+		}
+	}
+	return commands
+}
+
+/* Returns the inputs listed for the action. */
+func listInputs(t *testing.T, action nbt.ActionSpec) []string {
+	t.Helper()
+	inputs, err := action.ListInputs()
+	if err != nil {
+		t.Fatal(`listing inputs: `, err)
+	}
+	return append(action.Inputs, inputs...)
+}
+
+const passingTests = `{"Action":"run","Package":"a","Test":"TestA"}
+{"Action":"output","Package":"a","Test":"TestA","Output":"=== RUN   TestA\n"}
+{"Action":"pass","Package":"a","Test":"TestA","Elapsed":0.5}
+{"Action":"run","Package":"a","Test":"TestSkipped"}
+{"Action":"skip","Package":"a","Test":"TestSkipped","Elapsed":0}
+{"Action":"output","Package":"a","Output":"ok  \ta\t0.6s\n"}
+{"Action":"pass","Package":"a","Elapsed":0.6}
+`
+
+const failingTests = `{"Action":"run","Package":"a","Test":"TestA"}
+{"Action":"output","Package":"a","Test":"TestA","Output":"a_test.go:5: wrong\n"}
+{"Action":"fail","Package":"a","Test":"TestA","Elapsed":0.1}
+{"Action":"fail","Package":"a","Elapsed":0.2}
+`
+
+func TestBuild(t *testing.T) {
+	m := newStubModule(t)
+	toolchain := &Toolchain{Dir: m.dir}
+	output := filepath.Join(m.dir, `bin`, `a`)
+	/* File times may be too coarse to tell the changes made by the test from the outputs of the builds. */
+	options := nbt.Options{MaxParallelTasks: 1, Staleness: nbt.StalenessHash, StateFile: filepath.Join(m.stub, `state.json`)}
+
+	expected := []string{filepath.Join(m.dir, `a.go`), filepath.Join(m.dir, `gen.go`), filepath.Join(m.dir, `go.mod`)}
+	if inputs := listInputs(t, toolchain.Build(`./a`, output).Action()); !reflect.DeepEqual(inputs, expected) {
+		t.Errorf(`inputs %q, expected %q`, inputs, expected)
+	}
+	for i, step := range []struct {
+		change   func()
+		commands []string
+	}{
+		{nil, []string{`go build -o ` + output + ` ./a`}},
+		{nil, nil},
+		{func() { m.write(t, filepath.Join(m.dir, `a.go`), `package a // changed`) }, []string{`go build -o ` + output + ` ./a`}},
+		/* Test files are not inputs of builds. */
+		{func() { m.write(t, filepath.Join(m.dir, `a_test.go`), `package a // changed`) }, nil},
+	} {
+		if step.change != nil {
+			step.change()
+		}
+		if result := nbt.StartWithOptions(toolchain.Build(`./a`, output), options); !result.Succeeded() {
+			t.Fatalf(`build %d failed: %v`, i, result.Failed)
+		}
+		if commands := m.commands(t); !reflect.DeepEqual(commands, step.commands) {
+			t.Errorf(`build %d ran %q, expected %q`, i, commands, step.commands)
+		}
+	}
+}
+
+func TestListFailure(t *testing.T) {
+	m := newStubModule(t)
+	m.write(t, filepath.Join(m.stub, `list.fail`), ``)
+	toolchain := &Toolchain{Dir: m.dir}
+	result := nbt.StartWithOptions(toolchain.Build(`./missing`, filepath.Join(m.dir, `out`)), nbt.Options{
+		MaxParallelTasks: 1, Staleness: nbt.StalenessModTime,
+	})
+	var failed *ErrCommandFailed
+	if result.Succeeded() || !errors.As(result.Failed[0].Err, &failed) || !strings.Contains(failed.Stderr, `cannot find package`) {
+		t.Fatalf(`expected listing to fail the build, got %v`, result.Failed)
+	}
+	if commands := m.commands(t); len(commands) != 0 {
+		t.Errorf(`expected nothing to be built, ran %q`, commands)
+	}
+}
+
+func TestTest(t *testing.T) {
+	m := newStubModule(t)
+	toolchain := &Toolchain{Dir: m.dir, BuildFlags: []string{`-trimpath`}}
+	report := filepath.Join(m.dir, `reports`, `a.json`)
+	/* File times may be too coarse to tell the changes made by the test from the outputs of the builds. */
+	options := nbt.Options{MaxParallelTasks: 1, Staleness: nbt.StalenessHash, StateFile: filepath.Join(m.stub, `state.json`)}
+	command := `go test -json -trimpath -race ./a`
+
+	task := toolchain.Test(`./a`, report, `-race`)
+	if inputs := listInputs(t, task.Action()); len(inputs) != 4 || inputs[1] != filepath.Join(m.dir, `a_test.go`) {
+		t.Errorf(`unexpected inputs %q`, inputs)
+	}
+	if result := nbt.StartWithOptions(task, options); !result.Succeeded() {
+		t.Fatal(`tests failed: `, result.Failed)
+	}
+	if commands := m.commands(t); !reflect.DeepEqual(commands, []string{command}) {
+		t.Errorf(`ran %q`, commands)
+	}
+	results, err := task.Results()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TestResult{
+		{`a`, `TestA`, `pass`, 500 * time.Millisecond, "=== RUN   TestA\n"},
+		{`a`, `TestSkipped`, `skip`, 0, ``},
+		{`a`, ``, `pass`, 600 * time.Millisecond, "ok  \ta\t0.6s\n"},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf(`results %+v, expected %+v`, results, expected)
+	}
+
+	/* The tests passed, so they are skipped until their inputs change. */
+	if result := nbt.StartWithOptions(toolchain.Test(`./a`, report, `-race`), options); !result.Succeeded() {
+		t.Fatal(`tests failed: `, result.Failed)
+	}
+	if commands := m.commands(t); len(commands) != 0 {
+		t.Errorf(`expected the tests to be skipped, ran %q`, commands)
+	}
+
+	m.write(t, filepath.Join(m.stub, `test.json`), failingTests)
+	m.write(t, filepath.Join(m.stub, `test.exit`), `1`)
+	m.write(t, filepath.Join(m.dir, `a_test.go`), `package a // changed`)
+	result := nbt.StartWithOptions(toolchain.Test(`./a`, report, `-race`), options)
+	var failed *ErrTestsFailed
+	if result.Succeeded() || !errors.As(result.Failed[0].Err, &failed) {
+		t.Fatalf(`expected the tests to fail, got %v`, result.Failed)
+	}
+	if len(failed.Failed) != 2 || failed.Failed[0].Test != `TestA` || failed.Failed[0].Output != "a_test.go:5: wrong\n" {
+		t.Errorf(`unexpected failures %+v`, failed.Failed)
+	}
+	if message := failed.Error(); message != `tests of ./a failed: TestA` {
+		t.Errorf(`unexpected message %q`, message)
+	}
+	if _, err := os.Stat(report); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf(`expected the report to be removed, got %v`, err)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	m := newStubModule(t)
+	toolchain := &Toolchain{Dir: m.dir}
+	generated := filepath.Join(m.dir, `gen.go`)
+	os.Remove(generated)
+	task := toolchain.Generate(`./a`, generated)
+	/* The generated file is listed as a file of the package, but it is not an input of generating it. */
+	inputs := listInputs(t, task.Action())
+	for _, input := range inputs {
+		if input == generated {
+			t.Errorf(`the generated file is an input: %q`, inputs)
+		}
+	}
+	build := toolchain.Build(`./a`, filepath.Join(m.dir, `out`), task)
+	if result := nbt.StartWithOptions(build, nbt.Options{MaxParallelTasks: 2}); !result.Succeeded() {
+		t.Fatal(`build failed: `, result.Failed)
+	}
+	expected := []string{`go generate ./a`, `go build -o ` + filepath.Join(m.dir, `out`) + ` ./a`}
+	if commands := m.commands(t); !reflect.DeepEqual(commands, expected) {
+		t.Errorf(`ran %q, expected %q`, commands, expected)
+	}
+}
+
+func TestListing(t *testing.T) {
+	m := newStubModule(t)
+	toolchain := &Toolchain{Dir: m.dir}
+	output := filepath.Join(m.dir, `out`)
+	os.Remove(filepath.Join(m.dir, `gen.go`))
+	session := nbt.NewSession(false)
+	build := func() {
+		t.Helper()
+		task := toolchain.Build(`./a`, output, toolchain.Generate(`./a`, filepath.Join(m.dir, `gen.go`)))
+		if result := session.Build(task, nbt.Options{MaxParallelTasks: 1}); !result.Succeeded() {
+			t.Fatal(`build failed: `, result.Failed)
+		}
+	}
+
+	/* The package is listed for the build once it has been generated. */
+	build()
+	expected := []string{`go list -deps -json ./a`, `go generate ./a`, `go list -deps -json ./a`, `go build -o ` + output + ` ./a`}
+	if commands := m.allCommands(t); !reflect.DeepEqual(commands, expected) {
+		t.Errorf(`ran %q, expected %q`, commands, expected)
+	}
+	/* Later builds of the session use the inputs listed by the first. */
+	build()
+	if commands := m.allCommands(t); len(commands) != 0 {
+		t.Errorf(`expected nothing to run, ran %q`, commands)
+	}
+	m.write(t, filepath.Join(m.dir, `a.go`), `package a // changed`)
+	build()
+	expected = []string{`go list -deps -json ./a`, `go generate ./a`, `go list -deps -json ./a`, `go build -o ` + output + ` ./a`}
+	if commands := m.allCommands(t); !reflect.DeepEqual(commands, expected) {
+		t.Errorf(`ran %q, expected %q`, commands, expected)
+	}
+}
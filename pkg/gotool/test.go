@@ -0,0 +1,165 @@
+package gotool
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gitlab.com/kyle_anderson/nbt/internal/atomicfile"
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* The outcome of a test, or of a whole package when Test is empty, as reported by go test -json. */
+type TestResult struct {
+	Package string
+	Test    string
+	/* "pass", "fail" or "skip", or empty if the test never finished, such as when the test binary crashed. */
+	Action  string
+	Elapsed time.Duration
+	/* Everything printed by the test, or for a package, everything printed outside of its tests. */
+	Output string
+}
+
+/* An event in the output of go test -json, as described by go doc test2json. */
+type testEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+/* Parses the output of go test -json, returning the results of the packages and tests in the order that
+they first appear. */
+func ParseTestOutput(r io.Reader) ([]TestResult, error) {
+	var results []TestResult
+	index := make(map[[2]string]int)
+	decoder := json.NewDecoder(r)
+	for {
+		var event testEvent
+		if err := decoder.Decode(&event); errors.Is(err, io.EOF) {
+			return results, nil
+		} else if err != nil {
+			return results, fmt.Errorf("parsing test output: %w", err)
+		}
+		key := [2]string{event.Package, event.Test}
+		i, ok := index[key]
+		if !ok {
+			i = len(results)
+			index[key] = i
+			results = append(results, TestResult{Package: event.Package, Test: event.Test})
+		}
+		result := &results[i]
+		switch event.Action {
+		case "output":
+			result.Output += event.Output
+		case "pass", "fail", "skip":
+			result.Action = event.Action
+			result.Elapsed = time.Duration(event.Elapsed * float64(time.Second))
+		}
+	}
+}
+
+/* Error given when tests of a package fail. */
+type ErrTestsFailed struct {
+	Package string
+	/* The results of the failed tests, followed by the result of the package. */
+	Failed []TestResult
+}
+
+func (err *ErrTestsFailed) Error() string {
+	var names []string
+	for _, result := range err.Failed {
+		if result.Test != "" {
+			names = append(names, result.Test)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("tests of %s failed", err.Package)
+	}
+	return fmt.Sprintf("tests of %s failed: %s", err.Package, strings.Join(names, ", "))
+}
+
+/* Tests a package with go test, saving the results to a report. Tasks with the same report are the same task. */
+type TestTask struct {
+	Package string
+	/* The absolute path of the file the output of go test -json is saved to when the tests pass.
+	It is the output of the task, so passing tests are skipped until their inputs change. */
+	Report string
+	/* Flags for go test, such as "-race" or "-run=Integration". */
+	Flags []string
+	/* Tasks that must be complete before testing, such as generate tasks. */
+	Requires  []nbt.Task
+	toolchain *Toolchain
+}
+
+/* Returns a task testing the package and saving the results to the report, which is relative to the working
+directory of the process. */
+func (tc *Toolchain) Test(pkg, report string, flags ...string) *TestTask {
+	return &TestTask{Package: pkg, Report: absolute(report), Flags: flags, toolchain: tc}
+}
+
+func (t *TestTask) Hash() uint64 { return hashString(hashBaseTest, t.Report) }
+func (t *TestTask) Matches(other nbt.Task) bool {
+	converted, ok := other.(*TestTask)
+	return ok && converted.Report == t.Report
+}
+func (t *TestTask) String() string { return "go test " + t.Package }
+
+func (t *TestTask) command() []string {
+	args := append([]string{"test", "-json"}, t.toolchain.BuildFlags...)
+	args = append(args, t.Flags...)
+	return t.toolchain.command(append(args, t.Package)...)
+}
+
+func (t *TestTask) Action() nbt.ActionSpec {
+	return t.toolchain.action(t.Package, true, t.command(), []string{t.Report}, t.Requires)
+}
+
+/* Runs the tests. When tests fail, the error is an ErrTestsFailed holding their results, and the report is removed
+so that the tests run again in the next build. */
+func (t *TestTask) Perform(h nbt.Handler) error {
+	if len(t.Requires) > 0 {
+		h.RequireAndWait(t.Requires...)
+	}
+	if err := os.Remove(t.Report); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var out bytes.Buffer
+	runErr := t.toolchain.run(t.command(), &out)
+	results, parseErr := ParseTestOutput(bytes.NewReader(out.Bytes()))
+	if runErr != nil {
+		failed := &ErrTestsFailed{Package: t.Package}
+		for _, result := range results {
+			if result.Action == "fail" {
+				failed.Failed = append(failed.Failed, result)
+			}
+		}
+		if len(failed.Failed) > 0 {
+			return failed
+		}
+		/* The tests could not be run at all, such as when the package does not compile. */
+		return runErr
+	}
+	if parseErr != nil {
+		return parseErr
+	}
+	/* An interrupted build never leaves a partial report that would make the tests look up to date. */
+	return atomicfile.WriteFile(t.Report, out.Bytes(), 0o644)
+}
+
+/* Returns the results saved by the last run of the tests in which they passed. */
+func (t *TestTask) Results() ([]TestResult, error) {
+	f, err := os.Open(t.Report)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseTestOutput(f)
+}
+
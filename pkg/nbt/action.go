@@ -0,0 +1,267 @@
+package nbt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/depfile"
+)
+
+/* A description of the work done by a task in terms of the files it reads and writes,
+from which the task's outputs can be identified without performing it. */
+type ActionSpec struct {
+	/* Tasks that must be complete before the inputs are read, such as the tasks generating them. */
+	Requires []Task
+	/* Paths of the files read by the task. */
+	Inputs []string
+	/* If not nil, lists further inputs of the action, such as by asking a compiler which files a package is made of.
+	It is called once the Requires are complete, so that it sees the files they generate, and only when the task
+	is run: between the builds of a session, the inputs listed when the task last ran are used instead, so that
+	files added without changing any of those inputs are not noticed. The listed inputs are appended to Inputs,
+	and failing to list them fails the task. */
+	ListInputs func() ([]string, error)
+	/* Paths of the files written by the task. */
+	Outputs []string
+	/* The command line run by the task. */
+	Command []string
+	/* Environment variables affecting the task, in the form "KEY=value". */
+	Env []string
+	/* Path of a Make-format depfile written by the command, such as by the -MD and -MF options of compilers,
+	whose prerequisites are inputs of the action in addition to Inputs. The prerequisites are read whenever the
+	inputs of the action are needed, so those found by one build are checked by the next, as ninja does for
+	deps = gcc. The depfile should usually also be one of the Outputs, so that it is restored from caches.
+	Caches also hold the depfile under a key of the Inputs alone, from which it is restored before the key of
+	the action is found, so that machines which never ran the action find the same key. */
+	Depfile string
+	/* Set if the work of the task consists only of running Command, which reads nothing but Inputs
+	and writes nothing but Outputs. Such tasks are run by the RemoteExecutor of the build, if there is one,
+	instead of being performed. */
+	Remotable bool
+}
+
+/* Implemented by tasks whose outputs may be restored from a cache, or which may be run remotely, instead of
+performing the task. When a cache, an executor or a staleness check is in use, the Requires of the action are
+required and waited for before the task is performed, and the task is only performed if its outputs are not up to date
+and the cache does not hold outputs for the action. */
+type CacheableTask interface {
+	Task
+	Action() ActionSpec
+}
+
+/* Runs the commands of remotable actions elsewhere, such as on other machines. */
+type RemoteExecutor interface {
+	/* Runs the command of the action, making its outputs available at their paths once it returns.
+	Errors wrapped in ErrExecutorUnavailable mean that the command could not be run at all,
+	in which case the task is performed locally instead. Other errors are failures of the task. */
+	Execute(action ActionSpec) error
+}
+
+/* Storage for the outputs of actions, identified by the keys of the actions. */
+type Cache interface {
+	/* Restores the outputs of the action with the given key to their paths.
+	Returns false if the cache does not hold outputs for the action. */
+	Restore(key string, outputs []string) (bool, error)
+	/* Stores the outputs of the action with the given key. */
+	Store(key string, outputs []string) error
+}
+
+/* Returns a key identifying the action, derived from its command line, environment, output paths and
+the contents of its inputs. Actions with equal keys are expected to produce the same outputs. */
+func (a *ActionSpec) Key() (string, error) {
+	inputs, err := a.AllInputs()
+	if err != nil {
+		return "", err
+	}
+	return a.hash("nbt action v1", inputs)
+}
+
+/* Returns the key under which the depfile of the action is cached. The prerequisites listed in the depfile are
+only known once it has been read, so this key is derived from the Inputs alone. Restoring the depfile with this key
+lets a machine which never ran the action find the same key as the machine which stored its outputs. */
+func (a *ActionSpec) depfileKey() (string, error) {
+	return a.hash("nbt depfile v1", a.Inputs)
+}
+
+func (a *ActionSpec) hash(header string, inputs []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\ncommand %q\n", header, a.Command)
+	env := append([]string(nil), a.Env...)
+	sort.Strings(env)
+	fmt.Fprintf(h, "env %q\noutputs %q\n", env, a.Outputs)
+	if a.Depfile != "" {
+		fmt.Fprintf(h, "depfile %q\n", a.Depfile)
+	}
+	for _, input := range inputs {
+		digest, err := fileDigest(input)
+		if err != nil {
+			return "", fmt.Errorf("hashing input %q: %w", input, err)
+		}
+		fmt.Fprintf(h, "input %q %s\n", input, digest)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/* Returns a copy of the action with the listed inputs appended to its Inputs, which does not list them again. */
+func (a *ActionSpec) withListed(listed []string) ActionSpec {
+	result := *a
+	result.Inputs = append(append([]string(nil), a.Inputs...), listed...)
+	result.ListInputs = nil
+	return result
+}
+
+/* Returns the Inputs of the action followed by the prerequisites listed in its depfile that are not among them.
+A missing depfile lists nothing, since the action has not been run yet. */
+func (a *ActionSpec) AllInputs() ([]string, error) {
+	if a.Depfile == "" {
+		return a.Inputs, nil
+	}
+	rules, err := depfile.ReadFile(a.Depfile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return a.Inputs, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading depfile %q: %w", a.Depfile, err)
+	}
+	/* The depfile usually lists the source again, so the Inputs go first to keep the order of the key stable. */
+	return depfile.Prerequisites(append([]depfile.Rule{{Prerequisites: a.Inputs}}, rules...)), nil
+}
+
+/* Returns the hex encoded SHA-256 digest of the contents of the file. */
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/* Performs a task with an action, skipping it if its outputs are up to date, or otherwise restoring its outputs from
+the cache or running it on the executor if possible. Problems with the cache or the executor are logged,
+and the task is performed as if they were not there. */
+func (p *workerPool) performAction(h *chanHandler[*taskEntry], task CacheableTask) error {
+	action := task.Action()
+	if len(action.Requires) > 0 {
+		h.RequireAndWait(action.Requires...)
+	}
+	if action.ListInputs != nil {
+		listed, err := action.ListInputs()
+		if err != nil {
+			return fmt.Errorf("listing the inputs of %v: %w", task, err)
+		}
+		h.subject.listedInputs = listed
+		action = action.withListed(listed)
+	}
+	if p.staleness == StalenessModTime && newerOutputs(&action) {
+		return nil
+	}
+	if p.cache == nil && p.state == nil && !p.recordKeys {
+		return runAction(task, h, action, p.executor)
+	}
+	if p.cache != nil && action.Depfile != "" {
+		p.restoreDepfile(task, &action)
+	}
+	key, keyErr := action.Key()
+	switch {
+	case keyErr == nil && p.state != nil && p.state.upToDate(key, action.Outputs):
+		p.recordKey(h, key)
+		return nil
+	case keyErr == nil && p.restore(task, key, action.Outputs):
+	default:
+		if err := runAction(task, h, action, p.executor); err != nil {
+			return err
+		}
+		if action.Depfile != "" {
+			/* The inputs listed in the depfile have just been written, and are part of the key. */
+			key, keyErr = action.Key()
+		}
+		if keyErr != nil {
+			if p.cache != nil || p.state != nil {
+				log.Printf("nbt: not recording the outputs of %v: %v\n", task, keyErr)
+			}
+		} else if p.cache != nil {
+			if err := p.cache.Store(key, action.Outputs); err != nil {
+				log.Printf("nbt: failed to store the outputs of %v in the cache: %v\n", task, err)
+			}
+			if action.Depfile != "" {
+				p.storeDepfile(task, &action)
+			}
+		}
+	}
+	if keyErr != nil {
+		key = ""
+	} else if p.state != nil {
+		if err := p.state.record(key, action.Outputs); err != nil {
+			log.Printf("nbt: failed to record the outputs of %v: %v\n", task, err)
+		}
+	}
+	p.recordKey(h, key)
+	return nil
+}
+
+/* Restores the outputs of the action with the given key from the cache, returning true if they were restored. */
+func (p *workerPool) restore(task CacheableTask, key string, outputs []string) bool {
+	if p.cache == nil {
+		return false
+	}
+	hit, err := p.cache.Restore(key, outputs)
+	if err != nil {
+		log.Printf("nbt: failed to restore %v from the cache: %v\n", task, err)
+	}
+	return err == nil && hit
+}
+
+/* Restores the depfile of the action from the cache if it has not been written here, so that the key of the action
+includes the prerequisites listed in it, as the key of a build which ran the action does. */
+func (p *workerPool) restoreDepfile(task CacheableTask, action *ActionSpec) {
+	if _, err := os.Stat(action.Depfile); !errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	/* If the inputs cannot be read, finding the key of the action fails too, and reports it. */
+	if key, err := action.depfileKey(); err == nil {
+		p.restore(task, key, []string{action.Depfile})
+	}
+}
+
+/* Stores the depfile written by running the action, to be restored by restoreDepfile. */
+func (p *workerPool) storeDepfile(task CacheableTask, action *ActionSpec) {
+	key, err := action.depfileKey()
+	if err == nil {
+		err = p.cache.Store(key, []string{action.Depfile})
+	}
+	if err != nil {
+		log.Printf("nbt: failed to store the depfile of %v in the cache: %v\n", task, err)
+	}
+}
+
+/* Records the key of the action of the task in its entry, if keys are being recorded. An empty key is recorded
+when the key could not be found, which never matches the key of a later build. */
+func (p *workerPool) recordKey(h *chanHandler[*taskEntry], key string) {
+	if p.recordKeys {
+		h.subject.actionKey = key
+	}
+}
+
+/* Runs the action of the task on the executor if it is remotable, and performs the task otherwise. */
+func runAction(task CacheableTask, h Handler, action ActionSpec, executor RemoteExecutor) error {
+	if executor == nil || !action.Remotable {
+		return task.Perform(h)
+	}
+	err := executor.Execute(action)
+	var unavailable *ErrExecutorUnavailable
+	if errors.As(err, &unavailable) {
+		log.Printf("nbt: performing %v locally: %v\n", task, err)
+		return task.Perform(h)
+	}
+	return err
+}
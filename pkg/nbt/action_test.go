@@ -0,0 +1,252 @@
+package nbt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/* A cache holding the contents of outputs in memory. */
+type memoryCache struct {
+	entries map[string]map[string][]byte
+	err     error
+}
+
+func (c *memoryCache) Restore(key string, outputs []string) (bool, error) {
+	if c.err != nil {
+		return false, c.err
+	}
+	entry, ok := c.entries[key]
+	if !ok {
+		return false, nil
+	}
+	for _, output := range outputs {
+		if err := os.WriteFile(output, entry[output], 0o644); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (c *memoryCache) Store(key string, outputs []string) error {
+	if c.err != nil {
+		return c.err
+	}
+	entry := make(map[string][]byte)
+	for _, output := range outputs {
+		data, err := os.ReadFile(output)
+		if err != nil {
+			return err
+		}
+		entry[output] = data
+	}
+	c.entries[key] = entry
+	return nil
+}
+
+/* A task which copies its input to its output. */
+type copyTask struct {
+	*funcTask
+	action ActionSpec
+}
+
+func (t *copyTask) Matches(other Task) bool {
+	converted, ok := other.(*copyTask)
+	return ok && converted.name == t.name
+}
+func (t *copyTask) Action() ActionSpec { return t.action }
+
+func newCopyTask(input, output string, requires ...Task) *copyTask {
+	task := &copyTask{action: ActionSpec{
+		Requires: requires, Inputs: []string{input}, Outputs: []string{output}, Command: []string{`cp`, input, output},
+	}}
+	task.funcTask = newFuncTask(output, func(Handler) error {
+		data, err := os.ReadFile(input)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(output, data, 0o644)
+	})
+	return task
+}
+
+func TestActionKey(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, `input`)
+	os.WriteFile(input, []byte(`one`), 0o644)
+	base := ActionSpec{Inputs: []string{input}, Outputs: []string{`out`}, Command: []string{`cc`, `-c`}, Env: []string{`A=1`, `B=2`}}
+	key := func(a ActionSpec) string {
+		k, err := a.Key()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	original := key(base)
+
+	reordered := base
+	reordered.Env = []string{`B=2`, `A=1`}
+	if key(reordered) != original {
+		t.Error(`key depends on the order of the environment`)
+	}
+	for i, changed := range []ActionSpec{
+		{Inputs: base.Inputs, Outputs: []string{`other`}, Command: base.Command, Env: base.Env},
+		{Inputs: base.Inputs, Outputs: base.Outputs, Command: []string{`cc`, `-c -O2`}, Env: base.Env},
+		{Inputs: base.Inputs, Outputs: base.Outputs, Command: []string{`cc -c`}, Env: base.Env},
+		{Inputs: base.Inputs, Outputs: base.Outputs, Command: base.Command, Env: []string{`A=1`}},
+	} {
+		if key(changed) == original {
+			t.Errorf(`change %d did not change the key`, i)
+		}
+	}
+	os.WriteFile(input, []byte(`two`), 0o644)
+	if key(base) == original {
+		t.Error(`changing the contents of an input did not change the key`)
+	}
+	os.Remove(input)
+	if _, err := base.Key(); err == nil {
+		t.Error(`expected an error for a missing input`)
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, `source`)
+	generated, output := filepath.Join(dir, `generated`), filepath.Join(dir, `output`)
+	build := func(cache Cache) (*copyTask, *copyTask, *Result) {
+		generate := newCopyTask(source, generated)
+		copy := newCopyTask(generated, output, generate)
+		return generate, copy, StartWithOptions(copy, Options{MaxParallelTasks: 2, Cache: cache})
+	}
+	cache := &memoryCache{entries: make(map[string]map[string][]byte)}
+
+	os.WriteFile(source, []byte(`first`), 0o644)
+	if _, copy, result := build(cache); !result.Succeeded() || copy.runs.Load() != 1 {
+		t.Fatalf(`first build: succeeded=%v, runs=%d`, result.Succeeded(), copy.runs.Load())
+	}
+
+	os.Remove(generated)
+	os.Remove(output)
+	generate, copy, result := build(cache)
+	if !result.Succeeded() {
+		t.Fatal(`second build failed: `, result.Failed)
+	}
+	if generate.runs.Load() != 0 || copy.runs.Load() != 0 {
+		t.Errorf(`tasks were performed despite cache hits: %d and %d runs`, generate.runs.Load(), copy.runs.Load())
+	}
+	if data, _ := os.ReadFile(output); string(data) != `first` {
+		t.Errorf(`unexpected restored output %q`, data)
+	}
+
+	os.WriteFile(source, []byte(`second`), 0o644)
+	if _, copy, _ := build(cache); copy.runs.Load() != 1 {
+		t.Error(`task was not performed after its input changed`)
+	}
+	if data, _ := os.ReadFile(output); string(data) != `second` {
+		t.Errorf(`unexpected output %q after the input changed`, data)
+	}
+
+	t.Run(`failures of the cache are not failures of the build`, func(t *testing.T) {
+		logged := captureLog(t)
+		broken := &memoryCache{err: errors.New(`broken cache`)}
+		if _, copy, result := build(broken); !result.Succeeded() || copy.runs.Load() != 1 {
+			t.Errorf(`succeeded=%v, runs=%d`, result.Succeeded(), copy.runs.Load())
+		}
+		if !strings.Contains(logged.String(), `broken cache`) {
+			t.Error(`the failure of the cache was not logged`)
+		}
+	})
+}
+
+func TestDepfileCache(t *testing.T) {
+	dir := t.TempDir()
+	source, header := filepath.Join(dir, `hello.c`), filepath.Join(dir, `hello.h`)
+	object, deps := filepath.Join(dir, `hello.o`), filepath.Join(dir, `hello.d`)
+	os.WriteFile(source, []byte(`#include "hello.h"`), 0o644)
+	os.WriteFile(header, []byte(`first`), 0o644)
+	/* Compiles the source like a compiler given -MD -MF, only listing the header in the depfile. */
+	build := func(cache Cache) (*copyTask, *Result) {
+		task := newCopyTask(header, object)
+		task.action = ActionSpec{Inputs: []string{source}, Outputs: []string{object, deps}, Depfile: deps}
+		perform := task.perform
+		task.perform = func(h Handler) error {
+			if err := perform(h); err != nil {
+				return err
+			}
+			return os.WriteFile(deps, []byte(object+": "+source+" \\\n "+header+"\n"), 0o644)
+		}
+		return task, StartWithOptions(task, Options{MaxParallelTasks: 1, Cache: cache})
+	}
+	cache := &memoryCache{entries: make(map[string]map[string][]byte)}
+	if task, result := build(cache); !result.Succeeded() || task.runs.Load() != 1 {
+		t.Fatalf(`first build: succeeded=%v, runs=%d`, result.Succeeded(), task.runs.Load())
+	}
+
+	/* Another machine sharing the cache has neither the object nor the depfile. */
+	os.Remove(object)
+	os.Remove(deps)
+	if task, result := build(cache); !result.Succeeded() || task.runs.Load() != 0 {
+		t.Errorf(`build on a fresh machine: succeeded=%v, runs=%d, expected a cache hit`, result.Succeeded(), task.runs.Load())
+	}
+	if data, _ := os.ReadFile(object); string(data) != `first` {
+		t.Errorf(`unexpected restored output %q`, data)
+	}
+
+	/* A change to the header changes the key found with the restored depfile. */
+	os.Remove(object)
+	os.Remove(deps)
+	os.WriteFile(header, []byte(`second`), 0o644)
+	if task, _ := build(cache); task.runs.Load() != 1 {
+		t.Error(`task was not performed after the header changed`)
+	}
+	if data, _ := os.ReadFile(object); string(data) != `second` {
+		t.Errorf(`unexpected output %q after the header changed`, data)
+	}
+}
+
+func TestListInputs(t *testing.T) {
+	dir := t.TempDir()
+	source, generated := filepath.Join(dir, `source`), filepath.Join(dir, `generated`)
+	output := filepath.Join(dir, `output`)
+	os.WriteFile(source, []byte(`contents`), 0o644)
+	generate := newCopyTask(source, generated)
+	var listings int
+	task := newCopyTask(generated, output, generate)
+	task.action.Inputs = nil
+	task.action.ListInputs = func() ([]string, error) {
+		listings++
+		/* The inputs are listed once the required task has written them. */
+		if _, err := os.Stat(generated); err != nil {
+			return nil, err
+		}
+		return []string{generated}, nil
+	}
+	session := NewSession(false)
+	options := Options{MaxParallelTasks: 1}
+	if result := session.Build(task, options); !result.Succeeded() {
+		t.Fatal(`build failed: `, result.Failed)
+	}
+	if inputs := session.Inputs(); len(inputs) != 1 || inputs[0] != source {
+		t.Errorf(`unexpected inputs %q of the session`, inputs)
+	}
+	/* The listed input is checked between builds without listing it again. */
+	os.WriteFile(generated, []byte(`changed`), 0o644)
+	if result := session.Build(task, options); !result.Succeeded() || task.runs.Load() != 2 {
+		t.Errorf(`succeeded=%v, runs=%d, expected the task to run again`, result.Succeeded(), task.runs.Load())
+	}
+	if listings != 2 {
+		t.Errorf(`inputs listed %d times, expected once per run`, listings)
+	}
+
+	t.Run(`failures to list inputs fail the task`, func(t *testing.T) {
+		errList := errors.New(`cannot list`)
+		failing := newCopyTask(source, filepath.Join(dir, `never`))
+		failing.action.ListInputs = func() ([]string, error) { return nil, errList }
+		if result := StartWithOptions(failing, Options{MaxParallelTasks: 1, Staleness: StalenessModTime}); result.Succeeded() ||
+			!errors.Is(result.Failed[0].Err, errList) || failing.runs.Load() != 0 {
+			t.Errorf(`unexpected result %v with %d runs`, result.Failed, failing.runs.Load())
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package nbt
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/* Shapes of graphs used for benchmarking, each of a few tens of thousands of tasks. */
+var benchmarkShapes = []struct {
+	name     string
+	generate func() *synthGraph
+}{
+	{`chain`, func() *synthGraph { return chainGraph(10000) }},
+	{`fan-out`, func() *synthGraph { return fanOutGraph(20000) }},
+	{`diamond`, func() *synthGraph { return diamondGraph(100, 20) }},
+	{`random`, func() *synthGraph { return randomDAG(rand.New(rand.NewSource(1)), 20000, 3) }},
+	{`wait-heavy`, func() *synthGraph { return waitHeavyGraph(3, 27) }},
+}
+
+var benchmarkJobs = []uint{1, 8, 64}
+
+/* Measures the scheduling overhead per task of the manager for graphs of various shapes. */
+func BenchmarkScheduling(b *testing.B) {
+	for _, shape := range benchmarkShapes {
+		for _, jobs := range benchmarkJobs {
+			shape, jobs := shape, jobs // Capture
+			b.Run(fmt.Sprintf(`%s/j%d`, shape.name, jobs), func(b *testing.B) {
+				var tasks int
+				var elapsed time.Duration
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					g := shape.generate()
+					tasks += len(g.tasks)
+					b.StartTimer()
+					start := time.Now()
+					newTaskManager(false).execute(g.root(), Options{MaxParallelTasks: jobs})
+					elapsed += time.Since(start)
+				}
+				b.ReportMetric(float64(elapsed.Nanoseconds())/float64(tasks), "ns/task")
+			})
+		}
+	}
+}
+
+/* Samples the number of goroutines until the returned function is called, which returns the largest sample. */
+func samplePeakGoroutines() (stop func() int) {
+	var peak atomic.Int64
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if current := int64(runtime.NumGoroutine()); current > peak.Load() {
+				peak.Store(current)
+			}
+			runtime.Gosched()
+		}
+	}()
+	return func() int {
+		close(done)
+		<-stopped
+		return int(peak.Load())
+	}
+}
+
+/* Measures the peak number of goroutines and the memory allocated per task for graphs of about 100 000 tasks.
+Every task that is waiting keeps the goroutine it runs on, so the peak number of goroutines grows with the number
+of tasks waiting at once: the wide tree has a few hundred waiting tasks, while every task of the chain waits for
+the next one, so the whole chain is waiting at once. The stacks of those goroutines are not counted in B/task. */
+func BenchmarkLargeGraph(b *testing.B) {
+	for _, shape := range []struct {
+		name     string
+		generate func() *synthGraph
+	}{
+		{`tree`, func() *synthGraph { return treeGraph(2, 316) }},
+		{`chain`, func() *synthGraph { return chainGraph(100000) }},
+	} {
+		for _, jobs := range benchmarkJobs {
+			shape, jobs := shape, jobs // Capture
+			b.Run(fmt.Sprintf(`%s/j%d`, shape.name, jobs), func(b *testing.B) {
+				stop := samplePeakGoroutines()
+				var before, after runtime.MemStats
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					g := shape.generate()
+					runtime.ReadMemStats(&before)
+					b.StartTimer()
+					newTaskManager(false).execute(g.root(), Options{MaxParallelTasks: jobs})
+					b.StopTimer()
+					runtime.ReadMemStats(&after)
+					b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/float64(len(g.tasks)), "B/task")
+				}
+				b.ReportMetric(float64(stop()), "peak-goroutines")
+			})
+		}
+	}
+}
+
+/* Compares requiring the tasks of a wide fan-out one at a time with requiring them in a single batch. */
+func BenchmarkRequire(b *testing.B) {
+	const width = 1000
+	for _, variant := range []struct {
+		name    string
+		require func(h Handler, tasks []Task)
+	}{
+		{`Require`, func(h Handler, tasks []Task) {
+			for _, task := range tasks {
+				h.Require(task)
+			}
+			h.Wait()
+		}},
+		{`RequireAll`, func(h Handler, tasks []Task) {
+			h.RequireAll(tasks...)
+			h.Wait()
+		}},
+		{`RequireAndWait`, func(h Handler, tasks []Task) { h.RequireAndWait(tasks...) }},
+	} {
+		for _, jobs := range benchmarkJobs {
+			variant, jobs := variant, jobs // Capture
+			b.Run(fmt.Sprintf(`%s/j%d`, variant.name, jobs), func(b *testing.B) {
+				var elapsed time.Duration
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					var done atomic.Int32
+					leaves := newCountingTasks(width, &done)
+					main := newFuncTask(`main`, func(h Handler) error {
+						variant.require(h, leaves)
+						return nil
+					})
+					b.StartTimer()
+					start := time.Now()
+					newTaskManager(false).execute(main, Options{MaxParallelTasks: jobs})
+					elapsed += time.Since(start)
+				}
+				b.ReportMetric(float64(elapsed.Nanoseconds())/float64(b.N*width), "ns/task")
+			})
+		}
+	}
+}
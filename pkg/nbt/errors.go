@@ -2,12 +2,14 @@ package nbt
 
 import "fmt"
 
-type errUnexpectedStatus struct {
-	task *taskEntry
+/* Error used when the manager attempts to move a task to a status that it cannot reach from its current one. */
+type errInvalidTransition struct {
+	task     *taskEntry
+	from, to taskStatus
 }
 
-func (err *errUnexpectedStatus) Error() string {
-	return fmt.Sprintf(`unexpected state %q for task`, err.task.status.String())
+func (err *errInvalidTransition) Error() string {
+	return fmt.Sprintf(`invalid transition of task %v from status %q to %q`, err.task.Task, err.from.String(), err.to.String())
 }
 
 /* Error used when a task panics during execution. */
@@ -19,3 +21,47 @@ type errPanicked struct {
 func (err *errPanicked) Error() string {
 	return fmt.Sprintf("task %#v panicked: %v", err.task, err.panicErr)
 }
+
+/* Error given to a task that failed because one of the tasks it required failed. */
+type ErrDependencyFailed struct {
+	Dependency Task
+	/* The error with which the dependency failed. */
+	Err error
+}
+
+func (err *ErrDependencyFailed) Error() string {
+	return fmt.Sprintf("dependency %v failed: %v", err.Dependency, err.Err)
+}
+func (err *ErrDependencyFailed) Unwrap() error { return err.Err }
+
+/* Error given to tasks that were not started because the build was cancelled. */
+type ErrCancelled struct {
+	/* The error of the build's context. */
+	Err error
+}
+
+func (err *ErrCancelled) Error() string { return fmt.Sprintf("build cancelled: %v", err.Err) }
+func (err *ErrCancelled) Unwrap() error { return err.Err }
+
+/* Error given to tasks that can never continue, because they are waiting for each other. */
+type ErrDeadlock struct {
+	/* The name of the lock the task was waiting for, or empty if it was waiting for its dependencies. */
+	Lock string
+	/* The task that was holding the lock, if waiting for a lock. */
+	Holder Task
+}
+
+func (err *ErrDeadlock) Error() string {
+	if err.Lock != "" {
+		return fmt.Sprintf("deadlock: waiting for lock %q, which is held by waiting task %v", err.Lock, err.Holder)
+	}
+	return "deadlock: waiting for dependencies that can never complete"
+}
+
+/* Error returned by a RemoteExecutor which could not run an action, for example because no workers were reachable. */
+type ErrExecutorUnavailable struct {
+	Err error
+}
+
+func (err *ErrExecutorUnavailable) Error() string { return fmt.Sprintf("executor unavailable: %v", err.Err) }
+func (err *ErrExecutorUnavailable) Unwrap() error { return err.Err }
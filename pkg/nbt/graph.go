@@ -0,0 +1,68 @@
+package nbt
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+/* Writes the dependency graph of all tasks in the registry to `w` in Graphviz DOT format.
+Edges point from dependents to their dependencies, and each kind of edge is drawn with its own style. */
+func writeGraph(w io.Writer, r *registry) error {
+	type node struct {
+		entry *taskEntry
+		label string
+	}
+	nodes := make([]node, 0, r.size)
+	r.forEach(func(entry *taskEntry) {
+		nodes = append(nodes, node{entry, fmt.Sprint(entry.Task)})
+	})
+	/* Sort the nodes so that the output is stable between builds of the same graph. */
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].label < nodes[j].label })
+	ids := make(map[*taskEntry]int, len(nodes))
+	for i, n := range nodes {
+		ids[n.entry] = i
+	}
+
+	if _, err := fmt.Fprintln(w, "digraph nbt {"); err != nil {
+		return err
+	}
+	for i, n := range nodes {
+		if _, err := fmt.Fprintf(w, "\tn%d [label=%q, color=%s];\n", i, n.label, statusColour(n.entry.status)); err != nil {
+			return err
+		}
+	}
+	for _, n := range nodes {
+		for _, edge := range n.entry.dependents {
+			if _, err := fmt.Fprintf(w, "\tn%d -> n%d [style=%s];\n", ids[edge.task], ids[n.entry], edgeStyle(edge.kind)); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+func edgeStyle(kind EdgeKind) (style string) {
+	switch kind {
+	case EdgeOrderOnly:
+		style = "dashed"
+	case EdgeWeak:
+		style = "dotted"
+	default:
+		style = "solid"
+	}
+	return
+}
+
+func statusColour(status taskStatus) (colour string) {
+	switch status {
+	case statusComplete:
+		colour = "green"
+	case statusErrored:
+		colour = "red"
+	default:
+		colour = "black"
+	}
+	return
+}
@@ -0,0 +1,207 @@
+package nbt
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+/* Generator of synthetic task graphs, used by benchmarks and by correctness tests of the manager. */
+
+var errSynthetic = errors.New(`synthetic failure`)
+
+/* A task within a synthetic graph. */
+type synthTask struct {
+	id    int
+	graph *synthGraph
+	/* Dependencies of the task. They are required one group at a time, and the task waits after each group. */
+	groups [][]*synthTask
+	/* When set, the task returns an error once it has waited for all of its dependencies. */
+	fails bool
+	runs  atomic.Int32
+	done  atomic.Bool
+}
+
+func (t *synthTask) Hash() uint64 { return uint64(t.id) }
+func (t *synthTask) Matches(other Task) bool {
+	if converted, ok := other.(*synthTask); ok {
+		return converted.id == t.id && converted.graph == t.graph
+	}
+	return false
+}
+func (t *synthTask) String() string { return fmt.Sprint(`synth `, t.id) }
+
+func (t *synthTask) Perform(h Handler) error {
+	t.runs.Add(1)
+	for _, group := range t.groups {
+		tasks := make([]Task, len(group))
+		for i, dependency := range group {
+			tasks[i] = dependency
+		}
+		h.RequireAndWait(tasks...)
+		if t.graph.track {
+			for _, dependency := range group {
+				if !dependency.done.Load() {
+					t.graph.violation(`%v resumed before its dependency %v was done`, t, dependency)
+				}
+			}
+		}
+	}
+	if t.fails {
+		return errSynthetic
+	}
+	t.done.Store(true)
+	return nil
+}
+
+/* Returns all of the dependencies of the task. */
+func (t *synthTask) dependencies() (dependencies []*synthTask) {
+	for _, group := range t.groups {
+		dependencies = append(dependencies, group...)
+	}
+	return
+}
+
+type synthGraph struct {
+	/* All of the tasks in the graph, the first of which is the root. */
+	tasks []*synthTask
+	/* When set, tasks check that their dependencies are done whenever they resume. */
+	track bool
+
+	mu         sync.Mutex
+	violations []string
+}
+
+func (g *synthGraph) root() *synthTask { return g.tasks[0] }
+
+func (g *synthGraph) newTask() *synthTask {
+	task := &synthTask{id: len(g.tasks), graph: g}
+	g.tasks = append(g.tasks, task)
+	return task
+}
+
+func (g *synthGraph) violation(format string, args ...interface{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.violations = append(g.violations, fmt.Sprintf(format, args...))
+}
+
+/* A chain of tasks, each of which requires the next. */
+func chainGraph(length int) *synthGraph {
+	g := &synthGraph{}
+	previous := g.newTask()
+	for i := 1; i < length; i++ {
+		next := g.newTask()
+		previous.groups = [][]*synthTask{{next}}
+		previous = next
+	}
+	return g
+}
+
+/* A tree of the given depth in which every interior task requires `width` children at once. */
+func treeGraph(depth, width int) *synthGraph {
+	g := &synthGraph{}
+	var build func(level int) *synthTask
+	build = func(level int) *synthTask {
+		task := g.newTask()
+		if level < depth {
+			children := make([]*synthTask, width)
+			for i := range children {
+				children[i] = build(level + 1)
+			}
+			task.groups = [][]*synthTask{children}
+		}
+		return task
+	}
+	build(0)
+	return g
+}
+
+/* A root requiring `width` leaves at once. */
+func fanOutGraph(width int) *synthGraph {
+	return treeGraph(1, width)
+}
+
+/* Layers of `width` tasks, where every task in a layer requires every task in the next layer,
+so that each task is shared by many dependents. */
+func diamondGraph(layers, width int) *synthGraph {
+	g := &synthGraph{}
+	root := g.newTask()
+	previous := []*synthTask{root}
+	for i := 0; i < layers; i++ {
+		layer := make([]*synthTask, width)
+		for j := range layer {
+			layer[j] = g.newTask()
+		}
+		for _, task := range previous {
+			task.groups = [][]*synthTask{layer}
+		}
+		previous = layer
+	}
+	return g
+}
+
+/* A random directed acyclic graph in which every task other than the root is required by at least one task
+created before it, and every task requires up to `maxExtra` further random tasks created after it. */
+func randomDAG(r *rand.Rand, size, maxExtra int) *synthGraph {
+	g := &synthGraph{}
+	for i := 0; i < size; i++ {
+		g.newTask()
+	}
+	dependencies := make([][]*synthTask, size)
+	for i := 1; i < size; i++ {
+		/* Required by a random earlier task, so that every task is reachable from the root. */
+		parent := r.Intn(i)
+		dependencies[parent] = append(dependencies[parent], g.tasks[i])
+	}
+	for i := 0; i < size-1; i++ {
+		for j := r.Intn(maxExtra + 1); j > 0; j-- {
+			dependencies[i] = append(dependencies[i], g.tasks[i+1+r.Intn(size-i-1)])
+		}
+	}
+	for i, task := range g.tasks {
+		if len(dependencies[i]) > 0 {
+			task.groups = [][]*synthTask{dependencies[i]}
+		}
+	}
+	return g
+}
+
+/* A tree in which every interior task requires and waits for its `width` children one at a time. */
+func waitHeavyGraph(depth, width int) *synthGraph {
+	g := treeGraph(depth, width)
+	for _, task := range g.tasks {
+		if len(task.groups) > 0 {
+			task.groups = splitGroups(task.groups[0], 1)
+		}
+	}
+	return g
+}
+
+func splitGroups(dependencies []*synthTask, size int) (groups [][]*synthTask) {
+	for len(dependencies) > size {
+		groups = append(groups, dependencies[:size])
+		dependencies = dependencies[size:]
+	}
+	return append(groups, dependencies)
+}
+
+/* Splits the dependencies of every task into a random number of groups, so tasks wait at random points. */
+func (g *synthGraph) randomizeWaits(r *rand.Rand) *synthGraph {
+	for _, task := range g.tasks {
+		if dependencies := task.dependencies(); len(dependencies) > 0 {
+			task.groups = splitGroups(dependencies, 1+r.Intn(len(dependencies)))
+		}
+	}
+	return g
+}
+
+/* Makes each task fail with the given probability. */
+func (g *synthGraph) injectFailures(r *rand.Rand, probability float64) *synthGraph {
+	for _, task := range g.tasks {
+		task.fails = r.Float64() < probability
+	}
+	return g
+}
@@ -1,34 +1,92 @@
 package nbt
 
-/* Handlers make requests on behalf of workers, and relay received information. */
+import "runtime"
+
+/* Handlers make requests on behalf of tasks, and relay received information. */
 
 /* A handler that uses channels for all of its operations. */
 type chanHandler[T Task] struct {
-	messages     chan handlerMessenger
-	resolveQueue chan resolveRequester
-	/* A channel that is waited on when the task requests to wait.
-	This channel should be written to to signal that this task should resume execution. */
-	waiter chan struct{}
+	subject T
+	comms   managerCommunicator[T]
+	pool    interface{ spawn() }
+	/* A channel that is waited on when the task requests to wait. It is created the first time the task waits.
+	This channel should be written to to signal that this task should resume execution (true) or that it
+	will never be resumed (false). */
+	waiter chan bool
+	/* True once the goroutine performing the task has been given over to the task for good. */
+	donated bool
+	/* True once the task has been aborted while waiting. */
+	aborted bool
+	/* The rules of the build. Can be nil. */
+	rules *Rules
+}
+
+func (h *chanHandler[T]) send(message handlerMessenger) {
+	h.comms.SendMessage(h.subject, message)
 }
 
-func newChanHandler[T Task]() *chanHandler[T] {
-	messages := make(chan handlerMessenger, 4)
-	resolveQueue := make(chan resolveRequester)
-	waiter := make(chan struct{})
-	return &chanHandler[T]{messages, resolveQueue, waiter}
+/* Sends a message which puts the task into the waiting state, blocking until the task is resumed. */
+func (h *chanHandler[T]) sendAndWait(message handlerMessenger) {
+	if h.waiter == nil {
+		h.waiter = make(chan bool, 1)
+	}
+	if !h.donated {
+		h.donated = true
+		h.pool.spawn()
+	}
+	h.send(message)
+	if resume := <-h.waiter; !resume {
+		/* Unlike a panic, this cannot be stopped by a recover in the task. */
+		h.aborted = true
+		runtime.Goexit()
+	}
 }
 
+/* Resumes the waiting task. */
+func (h *chanHandler[T]) resume() { h.waiter <- true }
+
+/* Unwinds the waiting task, which will never be resumed. */
+func (h *chanHandler[T]) abort() { h.waiter <- false }
+
+func (h *chanHandler[T]) Rules() *Rules { return h.rules }
+
 func (h *chanHandler[T]) Require(task Task) {
-	h.messages <- &dependencyDeclaration{dependencies: []Task{task}}
+	h.RequireAll(task)
+}
+
+func (h *chanHandler[T]) RequireAll(tasks ...Task) {
+	h.RequireWith(EdgeRequired, tasks...)
+}
+
+func (h *chanHandler[T]) RequireWith(kind EdgeKind, tasks ...Task) {
+	if len(tasks) > 0 {
+		h.send(&dependencyDeclaration{dependencies: tasks, kind: kind})
+	}
 }
 
 func (h *chanHandler[T]) Wait() {
-	h.messages <- statusUpdate{newStatus: statusWaiting}
-	<-h.waiter
+	h.sendAndWait(statusUpdate{newStatus: statusWaiting})
+}
+
+func (h *chanHandler[T]) WaitFor(tasks ...Task) {
+	if len(tasks) == 0 {
+		return
+	}
+	h.sendAndWait(&waitForDeclaration{waitingDependencyDeclaration{dependencyDeclaration{dependencies: tasks}}})
+}
+
+func (h *chanHandler[T]) RequireAndWait(tasks ...Task) {
+	h.sendAndWait(&waitingDependencyDeclaration{dependencyDeclaration{dependencies: tasks}})
+}
+
+func (h *chanHandler[T]) Finally(tasks ...Task) {
+	if len(tasks) > 0 {
+		h.send(&finalizerDeclaration{finalizers: tasks})
+	}
 }
 
 func (h *chanHandler[T]) Resolve(task Task) Task {
 	request, resolution := newResolveRequest(task)
-	h.resolveQueue <- request
+	h.comms.RequestResolution(request)
 	return <-resolution
 }
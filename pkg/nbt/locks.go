@@ -0,0 +1,54 @@
+package nbt
+
+/* Keeps track of which tasks hold named locks, and which tasks are waiting to acquire them. */
+type lockTable struct {
+	holders map[string]*taskEntry
+	/* Tasks that could not be started because a lock they need is held, keyed by the name of that lock. */
+	waiters map[string][]*taskEntry
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{make(map[string]*taskEntry), make(map[string][]*taskEntry)}
+}
+
+/* Returns the locks declared by the given task, if any. */
+func locksOf(task *taskEntry) []Lock {
+	if locking, ok := task.Task.(LockingTask); ok {
+		return locking.Locks()
+	}
+	return nil
+}
+
+/* Attempts to acquire all of the task's locks at once. If any of the locks is held by another task,
+no locks are acquired, the task is recorded as waiting for the lock and false is returned. */
+func (lt *lockTable) tryAcquire(task *taskEntry) bool {
+	locks := locksOf(task)
+	for _, lock := range locks {
+		if holder, held := lt.holders[lock.Name]; held && holder != task {
+			task.blockedOn = lock.Name
+			lt.waiters[lock.Name] = append(lt.waiters[lock.Name], task)
+			return false
+		}
+	}
+	for _, lock := range locks {
+		lt.holders[lock.Name] = task
+	}
+	task.blockedOn = ""
+	return true
+}
+
+/* Releases the locks held by the given task, returning the tasks that were waiting for any of them.
+If `waiting` is set, locks which are to be held while the task waits are kept. */
+func (lt *lockTable) release(task *taskEntry, waiting bool) (woken []*taskEntry) {
+	for _, lock := range locksOf(task) {
+		if waiting && lock.HoldWhileWaiting {
+			continue
+		}
+		if lt.holders[lock.Name] == task {
+			delete(lt.holders, lock.Name)
+			woken = append(woken, lt.waiters[lock.Name]...)
+			delete(lt.waiters, lock.Name)
+		}
+	}
+	return
+}
@@ -5,50 +5,105 @@ import (
 	"log"
 
 	"gitlab.com/kyle_anderson/go-utils/pkg/queue"
+	"gitlab.com/kyle_anderson/go-utils/pkg/set"
 )
 
-func newTaskManager() *taskManager {
-	return &taskManager{make(map[uint64][]*taskEntry), 0, 0, queue.NewLinkedListQueue[*taskEntry]()}
+func newTaskManager(debug bool) *taskManager {
+	return newTaskManagerWithRegistry(newRegistry(debug))
+}
+
+/* Returns a manager for a build that carries on from the tasks already in the registry. */
+func newTaskManagerWithRegistry(registry *registry) *taskManager {
+	return &taskManager{registry: registry, taskQueue: queue.NewLinkedListQueue[*taskEntry](), locks: newLockTable()}
 }
 
 type taskManager struct {
-	/* TODO make the registry into a separate struct of its own that takes care of task resolution. */
-	registry                 map[uint64][]*taskEntry
-	numBlocked, numExecuting uint
-	taskQueue                queue.Queue[*taskEntry]
+	registry     *registry
+	numExecuting uint
+	taskQueue    queue.Queue[*taskEntry]
+	locks        *lockTable
+	pool         *workerPool
+	/* Set once the build has been cancelled, to the error given to tasks that are not started as a result. */
+	cancelled error
+	result    Result
+	/* Called whenever a task changes status. Can be nil. */
+	onEvent func(Event)
+	/* Set when the keys of the actions of tasks are recorded, so that a later build can tell whether they changed. */
+	recordKeys bool
+	/* Called after the manager has processed each message, for testing. Can be nil. */
+	onStep func()
+	/* Chooses the next task to run among those in the queue. Can be nil. */
+	chooseNext func(ready int) int
 }
 
 func (tm *taskManager) processCompleteTask(task *taskEntry) {
-	task.status = statusComplete
-	for _, dependent := range task.dependents {
-		dependent.dependencies.Remove(task)
-		switch dependent.status {
-		case statusWaiting, statusNew:
-			if dependent.IsReady() {
-				tm.enqueue(dependent)
-			}
+	tm.setStatus(task, statusComplete)
+	tm.wake(tm.locks.release(task, false))
+	if task.isFinalizer {
+		tm.result.Finalizers = append(tm.result.Finalizers, TaskResult{task.Task, nil})
+	}
+	tm.scheduleFinalizers(task.finalizers)
+	for _, edge := range task.dependents {
+		tm.releaseDependent(edge.task, task)
+	}
+}
+
+/* Schedules the given finalizers for execution. Finalizers are run even if the build has been cancelled.
+Tasks that have already been triggered as ordinary tasks are left as they are, so that their outcome is still
+reported among the failed tasks of the build rather than among the finalizers. */
+func (tm *taskManager) scheduleFinalizers(finalizers []Task) {
+	for _, finalizer := range finalizers {
+		entry := tm.resolve(finalizer)
+		if !entry.isFinalizer && entry.isTriggered() {
+			log.Printf("nbt: %v is already required by another task, so it is not run as a finalizer\n", entry.Task)
+			continue
+		}
+		entry.isFinalizer = true
+		if entry.status == statusNew {
+			tm.enqueue(entry)
 		}
 	}
 }
 
-func (tm *taskManager) processErroredTask(task *taskEntry) {
-	task.status = statusErrored
-	for _, dependent := range task.dependents {
+/* Lets a dependent know that it no longer needs to wait for the given dependency. */
+func (tm *taskManager) releaseDependent(dependent, dependency *taskEntry) {
+	dependent.removeDependency(dependency)
+	switch dependent.status {
+	case statusWaiting, statusNew:
+		if dependent.IsReady() {
+			tm.enqueue(dependent)
+		}
+	}
+}
+
+func (tm *taskManager) processErroredTask(task *taskEntry, err error) {
+	if task.status == statusWaiting {
+		/* The task will never be resumed, so its goroutine can be released. */
+		task.handler.abort()
+	}
+	task.err = err
+	tm.setStatus(task, statusErrored)
+	tm.wake(tm.locks.release(task, false))
+	if task.isFinalizer {
+		tm.result.Finalizers = append(tm.result.Finalizers, TaskResult{task.Task, err})
+	} else {
+		tm.result.Failed = append(tm.result.Failed, TaskResult{task.Task, err})
+	}
+	tm.scheduleFinalizers(task.finalizers)
+	for _, edge := range task.dependents {
+		dependent := edge.task
+		if edge.kind != EdgeRequired {
+			/* The dependent is only ordered after the task, so it may carry on as if the task completed. */
+			tm.releaseDependent(dependent, task)
+			continue
+		}
 		switch dependent.status {
-		case statusWaiting:
-			tm.numBlocked--
-			fallthrough
-		case statusNew:
-			dependent.status = statusErrored
+		case statusWaiting, statusNew:
+			tm.processErroredTask(dependent, &ErrDependencyFailed{task.Task, err})
 		case statusComplete, statusErrored:
 			// Do nothing
 		case statusRunning:
-			task.onWaiting(func(t *taskEntry) {
-				if t.status != statusWaiting {
-					panic(fmt.Sprint(`unexpected task status upon entering onWaiting: `, t.status))
-				}
-				tm.processErroredTask(t)
-			})
+			tm.failOnWaiting(dependent, task)
 		default:
 			/* Ideally handling all cases would be checked at compile time, but Go lacks this ability. */
 			panic(fmt.Sprint("(*taskManager).processErroredTask: unhandled state: ", dependent.status))
@@ -56,139 +111,268 @@ func (tm *taskManager) processErroredTask(task *taskEntry) {
 	}
 }
 
-func (tm *taskManager) processWaitingTask(task *taskEntry) {
-	task.status = statusWaiting
+/* Marks the given running task as errored once it next waits, since one of its required dependencies failed. */
+func (tm *taskManager) failOnWaiting(task, dependency *taskEntry) {
+	task.onWaiting(func(t *taskEntry) {
+		if t.status == statusErrored {
+			/* Another of the task's dependencies has already failed it. */
+			return
+		}
+		if t.status != statusWaiting {
+			panic(fmt.Sprint(`unexpected task status upon entering onWaiting: `, t.status))
+		}
+		tm.processErroredTask(t, &ErrDependencyFailed{dependency.Task, dependency.err})
+	})
+}
+
+/* Puts the given task into the waiting state. If `awaited` is nil, the task waits for all of its dependencies,
+otherwise it waits only for the given tasks, which must already have been required. */
+func (tm *taskManager) processWaitingTask(task *taskEntry, awaited []Task) {
+	tm.setStatus(task, statusWaiting)
+	tm.wake(tm.locks.release(task, true))
+	if awaited != nil {
+		task.awaited = set.NewComparable[*taskEntry]()
+		for _, t := range awaited {
+			if entry := tm.resolve(t); task.dependencies.Contains(entry) {
+				task.awaited.Add(entry)
+			}
+		}
+	}
 	task.fireCallbacks(&task.onWaitingHooks)
+	if task.status != statusWaiting {
+		/* One of the callbacks has already dealt with the task, for example by marking it as errored. */
+		return
+	}
 	if task.IsReady() {
 		tm.enqueue(task)
-	} else {
-		tm.numBlocked++
 	}
 }
 
-/* Enqueues a task for execution. */
-func (tm *taskManager) enqueue(task *taskEntry) {
-	tm.taskQueue.Enqueue(task)
+/* Puts tasks that were waiting for a lock back into the queue, so that they may try to take their locks again. */
+func (tm *taskManager) wake(tasks []*taskEntry) {
+	for _, task := range tasks {
+		if task.status != statusErrored {
+			tm.enqueue(task)
+		}
+	}
 }
 
-func (tm *taskManager) processRequirement(dependent *taskEntry, dependencies []Task) {
-	for _, dependency := range dependencies {
-		resolvedDependency := tm.resolve(dependency)
-		if resolvedDependency.status != statusComplete {
-			dependent.dependencies.Add(resolvedDependency)
+/* Fails every task that can never continue because it is waiting for dependencies or locks
+that will never become available. Should only be called when no tasks are executing or queued.
+Returns true if any tasks were failed. */
+func (tm *taskManager) failDeadlocked() bool {
+	/* Tasks waiting for locks are failed first, so that the errors of the tasks holding
+	the locks point towards the tasks that were waiting for them. */
+	var lockWaiters, dependencyWaiters []*taskEntry
+	lockErrs := make(map[*taskEntry]error)
+	tm.registry.forEach(func(task *taskEntry) {
+		switch {
+		case task.blockedOn != "" && (task.status == statusNew || task.status == statusWaiting):
+			lockWaiters = append(lockWaiters, task)
+			/* The error must be determined now, since the holder releases the lock when it fails. */
+			lockErrs[task] = &ErrDeadlock{Lock: task.blockedOn, Holder: tm.locks.holders[task.blockedOn].Task}
+		case task.status == statusWaiting:
+			dependencyWaiters = append(dependencyWaiters, task)
 		}
-		resolvedDependency.dependents = append(resolvedDependency.dependents, dependent)
-		if resolvedDependency.IsReady() && resolvedDependency.status == statusNew {
-			/* Need to check that the task status is new to prevent adding multiple queue entries for the same task. */
-			tm.enqueue(resolvedDependency)
-		} else {
-			tm.numBlocked++
+	})
+	for _, task := range append(lockWaiters, dependencyWaiters...) {
+		if task.status == statusErrored {
+			/* Already failed because of one of the other stuck tasks. */
+			continue
+		}
+		err, ok := lockErrs[task]
+		if !ok {
+			err = &ErrDeadlock{}
 		}
+		log.Printf("task %v errored: %v\n", task.Task, err)
+		tm.processErroredTask(task, err)
 	}
+	return len(lockWaiters) > 0 || len(dependencyWaiters) > 0
 }
 
-func (tm *taskManager) resolve(task Task) (currentInstance *taskEntry) {
-	key := task.Hash()
-	var taskChain []*taskEntry
-	if existingTasks, ok := tm.registry[key]; ok {
-		taskChain = existingTasks
+/* Enqueues a task for execution. Enqueuing a task that is already in the queue does nothing. */
+func (tm *taskManager) enqueue(task *taskEntry) {
+	if !task.queued {
+		task.queued = true
+		tm.taskQueue.Enqueue(task)
+	}
+}
+
+func (tm *taskManager) dequeue() *taskEntry {
+	var task *taskEntry
+	if tm.chooseNext == nil {
+		task = tm.taskQueue.Dequeue()
 	} else {
-		taskChain = make([]*taskEntry, 0, 1)
+		task = tm.dequeueChosen()
+	}
+	task.queued = false
+	return task
+}
+
+/* Removes the task picked by chooseNext from the queue, keeping the others in order. */
+func (tm *taskManager) dequeueChosen() *taskEntry {
+	var ready []*taskEntry
+	for !tm.taskQueue.IsEmpty() {
+		ready = append(ready, tm.taskQueue.Dequeue())
 	}
-	/* We may append to the taskChain, so in either case of the if statement, we should
-	update the registry entry at the end. */
-	defer func() { tm.registry[key] = taskChain }()
-	found := false
-	for _, entry := range taskChain {
-		if task.Matches(entry.Task) {
-			found = true
-			currentInstance = entry
-			break
+	chosen := tm.chooseNext(len(ready))
+	for i, task := range ready {
+		if i != chosen {
+			tm.taskQueue.Enqueue(task)
 		}
 	}
-	if !found {
-		currentInstance = newTaskEntry(task)
-		taskChain = append(taskChain, currentInstance)
+	return ready[chosen]
+}
+
+func (tm *taskManager) processRequirement(dependent *taskEntry, dependencies []Task, kind EdgeKind) {
+	for _, dependency := range dependencies {
+		var resolvedDependency *taskEntry
+		if kind == EdgeWeak {
+			/* Weak dependencies are never triggered, so only tasks that something else requires are considered. */
+			if existing, ok := tm.registry.lookup(dependency); ok && existing.isTriggered() {
+				resolvedDependency = existing
+			} else {
+				continue
+			}
+		} else {
+			resolvedDependency = tm.resolve(dependency)
+		}
+		if dependent.dependencies.Contains(resolvedDependency) {
+			/* Already required and incomplete, possibly within the same batch of requirements. */
+			continue
+		}
+		if !resolvedDependency.isFinished() {
+			dependent.dependencies.Add(resolvedDependency)
+		} else if resolvedDependency.status == statusErrored && kind == EdgeRequired {
+			tm.failOnWaiting(dependent, resolvedDependency)
+		}
+		resolvedDependency.dependents = append(resolvedDependency.dependents, dependentEdge{dependent, kind})
+		if resolvedDependency.IsReady() && resolvedDependency.status == statusNew {
+			/* Only new tasks need to be queued, enqueue takes care of tasks that are already in the queue. */
+			tm.enqueue(resolvedDependency)
+		}
 	}
-	return
+}
+
+func (tm *taskManager) resolve(task Task) *taskEntry {
+	return tm.registry.resolve(task)
 }
 
 /* Runs the given task. */
-func (tm *taskManager) run(task *taskEntry, comms *supervisorComms) {
-	switch task.status {
-	case statusNew:
-		task.handler = newChanHandler[*taskEntry]()
-		go func() {
-			// TODO might be nice for the supervisor to handle this business logic.
-			defer func() {
-				close(task.handler.messages)
-				if err := recover(); err != nil {
-					task.handler.messages <- &errorMessage{err: &errPanicked{panicErr: err, task: task}}
-				}
-			}()
-			if err := task.Perform(task.handler); err != nil {
-				task.handler.messages <- &errorMessage{err: err}
-			}
-		}()
-	case statusWaiting:
-		tm.numBlocked--
+func (tm *taskManager) run(task *taskEntry) {
+	from := task.status
+	tm.setStatus(task, statusRunning)
+	if from == statusNew {
+		tm.pool.submit(task)
+	} else {
+		task.awaited = nil
 		/* Unblock the worker. */
-		task.handler.waiter <- struct{}{}
-	default:
-		panic(&errUnexpectedStatus{task})
+		task.handler.resume()
 	}
-	task.status = statusRunning
-	go superviseTask[*taskEntry](task, task.handler, comms)
-	tm.numExecuting++
 }
 
 func dependencyQueueSize(maxParallelTasks uint) uint {
 	return 4 * maxParallelTasks
 }
 
-func (manager *taskManager) execute(mainTask Task, maxParallelTasks uint) {
+/* Starts as many queued tasks as the parallelism limit allows. */
+func (manager *taskManager) dispatch(maxParallelTasks uint) {
+	for manager.numExecuting < maxParallelTasks && !manager.taskQueue.IsEmpty() {
+		task := manager.dequeue()
+		switch {
+		case task.status == statusErrored:
+			/* Tasks may fail due to their dependencies while sitting in the queue. */
+		case manager.cancelled != nil && !task.isFinalizer:
+			manager.processErroredTask(task, manager.cancelled)
+		case !manager.locks.tryAcquire(task):
+			/* The task is put back in the queue once the lock it is waiting for is released. */
+		default:
+			manager.run(task)
+		}
+	}
+}
+
+func (manager *taskManager) execute(mainTask Task, options Options) *Result {
+	maxParallelTasks := options.MaxParallelTasks
 	if maxParallelTasks <= 0 {
 		panic("numJobs must be positive!")
 	}
 	/* No need to close these channels since it wouldn't signal anything anyway. */
-	comms := supervisorComms{
+	comms := managerComms{
 		messages:        make(chan messenger[*taskEntry], dependencyQueueSize(maxParallelTasks)),
 		resolutionQueue: make(chan resolveRequester, maxParallelTasks),
 	}
+	manager.onEvent = options.OnEvent
+	manager.chooseNext = options.ChooseNext
+	manager.pool = newWorkerPool(maxParallelTasks, &comms, options.Cache, options.Executor)
+	manager.pool.recordKeys = manager.recordKeys
+	manager.pool.rules = options.Rules
+	defer manager.pool.close()
+	defer manager.pool.useStaleness(&options)()
+	var done <-chan struct{}
+	if options.Context != nil {
+		done = options.Context.Done()
+	}
 
-	manager.run(manager.resolve(mainTask), &comms)
-
-	for manager.numExecuting > 0 {
+	if root := manager.resolve(mainTask); root.status == statusNew {
+		/* In a session, the main task may already be complete from an earlier build. */
+		manager.enqueue(root)
+	}
+	buildFinalizersScheduled := false
+	for {
+		manager.dispatch(maxParallelTasks)
+		if manager.numExecuting <= 0 {
+			if manager.failDeadlocked() {
+				continue
+			}
+			if buildFinalizersScheduled || len(options.Finalizers) <= 0 {
+				break
+			}
+			/* Build finalizers run once everything else is done. */
+			buildFinalizersScheduled = true
+			manager.scheduleFinalizers(options.Finalizers)
+			continue
+		}
 		select {
 		case message := <-comms.messages:
+			/* Dependencies must be processed first, since a status update in the same
+			message (such as waiting) may depend on them. */
+			if dependencies := message.Dependencies(); dependencies != nil {
+				manager.processRequirement(message.Subject(), dependencies, message.DependencyKind())
+			}
+			if finalizers := message.Finalizers(); finalizers != nil {
+				message.Subject().finalizers = append(message.Subject().finalizers, finalizers...)
+			}
 			if status := message.RequestedStatus(); status != nil {
 				switch *status {
 				case statusComplete:
-					manager.numExecuting--
 					manager.processCompleteTask(message.Subject())
 				case statusWaiting:
-					manager.numExecuting--
-					manager.processWaitingTask(message.Subject())
+					manager.processWaitingTask(message.Subject(), message.Awaited())
 				case statusErrored:
-					manager.numExecuting--
 					log.Printf("task %#v errored: %v\n", message.Subject(), message.Error())
-					manager.processErroredTask(message.Subject())
+					manager.processErroredTask(message.Subject(), message.Error())
 				default:
 					// Do nothing
 				}
 			}
-			if dependencies := message.Dependencies(); dependencies != nil {
-				manager.processRequirement(message.Subject(), dependencies)
-			}
 		case request := <-comms.resolutionQueue:
 			/* This will not block with the implementation of chanMessageCallbacks that we have, since
 			only one item will ever get placed on the callback channel, and it is a buffered channel. */
 			request.Callback() <- manager.resolve(request.ToResolve())
+		case <-done:
+			/* Running tasks are left to finish, but no new tasks other than finalizers are started. */
+			manager.cancelled = &ErrCancelled{options.Context.Err()}
+			manager.result.Cancelled = true
+			done = nil
 		}
-		for manager.numExecuting < maxParallelTasks && !manager.taskQueue.IsEmpty() {
-			manager.run(manager.taskQueue.Dequeue(), &comms)
+		if manager.onStep != nil {
+			manager.onStep()
 		}
 	}
 
-	// TODO handle deadlock, which should be indicated if manager.numExecuting <= 0 && manager.numBlocked > 0 && no tasks are in the task queue
+	if manager.registry.debug {
+		log.Printf("nbt: registry statistics: %v\n", manager.registry.stats())
+	}
+	return &manager.result
 }
@@ -0,0 +1,570 @@
+package nbt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/* A task identified by its name, which performs by calling `perform`. */
+type funcTask struct {
+	name    string
+	perform func(Handler) error
+	runs    atomic.Int32
+}
+
+func newFuncTask(name string, perform func(Handler) error) *funcTask {
+	return &funcTask{name: name, perform: perform}
+}
+
+func (t *funcTask) Hash() uint64 {
+	var h uint64
+	for _, b := range []byte(t.name) {
+		h = 31*h + uint64(b)
+	}
+	return h
+}
+func (t *funcTask) Matches(other Task) bool {
+	if converted, ok := other.(*funcTask); ok {
+		return converted.name == t.name
+	}
+	return false
+}
+func (t *funcTask) Perform(h Handler) error {
+	t.runs.Add(1)
+	if t.perform == nil {
+		return nil
+	}
+	return t.perform(h)
+}
+func (t *funcTask) String() string { return t.name }
+
+/* Returns `count` tasks which count how many of them have run. */
+func newCountingTasks(count int, done *atomic.Int32) []Task {
+	tasks := make([]Task, count)
+	for i := range tasks {
+		tasks[i] = newFuncTask(fmt.Sprint(`leaf `, i), func(Handler) error {
+			done.Add(1)
+			return nil
+		})
+	}
+	return tasks
+}
+
+func TestRequireBatches(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		require func(h Handler, tasks []Task)
+	}{
+		{`Require`, func(h Handler, tasks []Task) {
+			for _, task := range tasks {
+				h.Require(task)
+			}
+			h.Wait()
+		}},
+		{`RequireAll`, func(h Handler, tasks []Task) {
+			h.RequireAll(tasks...)
+			h.Wait()
+		}},
+		{`RequireAndWait`, func(h Handler, tasks []Task) { h.RequireAndWait(tasks...) }},
+	} {
+		test := test // Capture
+		t.Run(test.name, func(t *testing.T) {
+			var done atomic.Int32
+			leaves := newCountingTasks(10, &done)
+			var doneWhenResumed int32
+			main := newFuncTask(`main`, func(h Handler) error {
+				/* Tasks named more than once in a batch are only required once. */
+				test.require(h, append(leaves, leaves[0], leaves[3]))
+				doneWhenResumed = done.Load()
+				return nil
+			})
+			if result := Start(main, 4); !result.Succeeded() {
+				t.Fatalf(`build failed: %+v`, result.Failed)
+			}
+			if doneWhenResumed != int32(len(leaves)) {
+				t.Errorf(`resumed once %d of %d requirements were done`, doneWhenResumed, len(leaves))
+			}
+			for _, leaf := range leaves {
+				if runs := leaf.(*funcTask).runs.Load(); runs != 1 {
+					t.Errorf(`%v ran %d times`, leaf, runs)
+				}
+			}
+		})
+	}
+
+	t.Run(`empty batches`, func(t *testing.T) {
+		main := newFuncTask(`main`, func(h Handler) error {
+			h.RequireAll()
+			h.RequireAndWait()
+			return nil
+		})
+		if result := Start(main, 1); !result.Succeeded() || main.runs.Load() != 1 {
+			t.Errorf(`succeeded=%v, runs=%d`, result.Succeeded(), main.runs.Load())
+		}
+	})
+
+	t.Run(`failures in a batch fail the dependent`, func(t *testing.T) {
+		errFailed := errors.New(`failed`)
+		failing := newFuncTask(`failing`, func(Handler) error { return errFailed })
+		var done atomic.Int32
+		var resumed bool
+		main := newFuncTask(`main`, func(h Handler) error {
+			h.RequireAndWait(append(newCountingTasks(3, &done), failing)...)
+			resumed = true
+			return nil
+		})
+		result := Start(main, 2)
+		var dependencyFailed *ErrDependencyFailed
+		if resumed || result.Succeeded() {
+			t.Error(`the dependent resumed despite a failed requirement`)
+		}
+		for _, failed := range result.Failed {
+			if failed.Task == main && (!errors.As(failed.Err, &dependencyFailed) || dependencyFailed.Dependency != failing) {
+				t.Errorf(`unexpected error for the dependent: %v`, failed.Err)
+			}
+		}
+	})
+}
+
+func TestWaitFor(t *testing.T) {
+	release := make(chan struct{})
+	var slowDone, fastDone atomic.Bool
+	slow := newFuncTask(`slow`, func(Handler) error {
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+			return errors.New(`never released`)
+		}
+		slowDone.Store(true)
+		return nil
+	})
+	fast := newFuncTask(`fast`, func(Handler) error {
+		fastDone.Store(true)
+		return nil
+	})
+	var fastDoneWhenResumed, slowDoneWhenResumed bool
+	main := newFuncTask(`main`, func(h Handler) error {
+		h.Require(slow)
+		/* Not yet required, so WaitFor requires it. */
+		h.WaitFor(fast)
+		fastDoneWhenResumed, slowDoneWhenResumed = fastDone.Load(), slowDone.Load()
+		close(release)
+		h.Wait()
+		return nil
+	})
+	if result := Start(main, 2); !result.Succeeded() {
+		t.Fatalf(`build failed: %+v`, result.Failed)
+	}
+	if !fastDoneWhenResumed {
+		t.Error(`resumed before the awaited task was done`)
+	}
+	if slowDoneWhenResumed {
+		t.Error(`waited for a requirement that was not awaited`)
+	}
+	if fast.runs.Load() != 1 || slow.runs.Load() != 1 {
+		t.Errorf(`unexpected runs: fast %d, slow %d`, fast.runs.Load(), slow.runs.Load())
+	}
+}
+
+func TestEdgeKinds(t *testing.T) {
+	errFailed := errors.New(`failed`)
+
+	t.Run(`order-only edges ignore failures`, func(t *testing.T) {
+		failing := newFuncTask(`failing`, func(Handler) error { return errFailed })
+		var resumed bool
+		main := newFuncTask(`main`, func(h Handler) error {
+			h.RequireWith(EdgeOrderOnly, failing)
+			h.Wait()
+			resumed = true
+			return nil
+		})
+		Start(main, 2)
+		if !resumed {
+			t.Error(`dependent did not resume after its order-only dependency failed`)
+		}
+	})
+
+	t.Run(`required edges propagate failures`, func(t *testing.T) {
+		failing := newFuncTask(`failing`, func(Handler) error { return errFailed })
+		var resumed bool
+		intermediate := newFuncTask(`intermediate`, func(h Handler) error {
+			h.RequireAndWait(failing)
+			resumed = true
+			return nil
+		})
+		main := newFuncTask(`main`, func(h Handler) error {
+			h.RequireAndWait(intermediate)
+			resumed = true
+			return nil
+		})
+		Start(main, 2)
+		if resumed {
+			t.Error(`a dependent resumed after its required dependency failed`)
+		}
+	})
+
+	t.Run(`weak edges order after tasks required by others`, func(t *testing.T) {
+		release := make(chan struct{})
+		var triggeredDone atomic.Bool
+		triggered := newFuncTask(`triggered`, func(Handler) error {
+			<-release
+			triggeredDone.Store(true)
+			return nil
+		})
+		requirer := newFuncTask(`requirer`, func(h Handler) error {
+			h.Require(triggered)
+			return nil
+		})
+		var orderedAfter bool
+		main := newFuncTask(`main`, func(h Handler) error {
+			h.RequireAndWait(requirer)
+			/* The triggered task cannot finish before the weak edge to it is declared. */
+			h.RequireWith(EdgeWeak, triggered)
+			close(release)
+			h.Wait()
+			orderedAfter = triggeredDone.Load()
+			return nil
+		})
+		if result := Start(main, 2); !result.Succeeded() {
+			t.Fatalf(`build failed: %+v`, result.Failed)
+		}
+		if !orderedAfter {
+			t.Error(`dependent was not ordered after its weak dependency`)
+		}
+	})
+
+	t.Run(`weak edges do not trigger tasks`, func(t *testing.T) {
+		untriggered := newFuncTask(`untriggered`, nil)
+		var resumed bool
+		main := newFuncTask(`main`, func(h Handler) error {
+			h.RequireWith(EdgeWeak, untriggered)
+			h.Wait()
+			resumed = true
+			return nil
+		})
+		if result := Start(main, 2); !result.Succeeded() || !resumed {
+			t.Fatalf(`succeeded=%v, resumed=%v, failed: %+v`, result.Succeeded(), resumed, result.Failed)
+		}
+		if untriggered.runs.Load() != 0 {
+			t.Error(`a weak dependency was triggered`)
+		}
+	})
+}
+
+func TestGraphExport(t *testing.T) {
+	leaf := newFuncTask(`leaf`, nil)
+	other := newFuncTask(`other`, nil)
+	main := newFuncTask(`main`, func(h Handler) error {
+		h.Require(leaf)
+		h.RequireWith(EdgeOrderOnly, other)
+		h.Wait()
+		return nil
+	})
+	var graph bytes.Buffer
+	StartWithOptions(main, Options{MaxParallelTasks: 1, Graph: &graph})
+	/* Nodes are sorted by label: leaf is n0, main is n1 and other is n2. */
+	for _, expected := range []string{
+		`n0 [label="leaf", color=green];`,
+		`n1 -> n0 [style=solid];`,
+		`n1 -> n2 [style=dashed];`,
+	} {
+		if !strings.Contains(graph.String(), expected) {
+			t.Errorf("graph does not contain %q:\n%s", expected, graph.String())
+		}
+	}
+}
+
+func TestFinalizers(t *testing.T) {
+	errFailed := errors.New(`failed`)
+
+	t.Run(`task finalizers`, func(t *testing.T) {
+		for _, fail := range []bool{false, true} {
+			fail := fail // Capture
+			t.Run(fmt.Sprint(`failing: `, fail), func(t *testing.T) {
+				var targetDone atomic.Bool
+				var orderedAfter bool
+				finalizer := newFuncTask(`finalizer`, func(Handler) error {
+					orderedAfter = targetDone.Load()
+					return errFailed
+				})
+				target := newFuncTask(`target`, func(h Handler) error {
+					h.Finally(finalizer)
+					targetDone.Store(true)
+					if fail {
+						return errFailed
+					}
+					return nil
+				})
+				main := newFuncTask(`main`, func(h Handler) error {
+					h.RequireAndWait(target)
+					return nil
+				})
+				result := Start(main, 2)
+				if !orderedAfter {
+					t.Error(`finalizer did not run after its target`)
+				}
+				if len(result.Finalizers) != 1 || result.Finalizers[0].Task != finalizer || !errors.Is(result.Finalizers[0].Err, errFailed) {
+					t.Errorf(`unexpected finalizer results: %+v`, result.Finalizers)
+				}
+				if result.Succeeded() == fail {
+					t.Errorf(`unexpected build success %v, failed tasks: %+v`, result.Succeeded(), result.Failed)
+				}
+			})
+		}
+	})
+
+	t.Run(`build finalizers run after cancellation`, func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		manager := newTaskManager(false)
+		noticed := make(chan struct{})
+		var once sync.Once
+		manager.onStep = func() {
+			if manager.cancelled != nil {
+				once.Do(func() { close(noticed) })
+			}
+		}
+		notStarted := newFuncTask(`not started`, nil)
+		finalizer := newFuncTask(`finalizer`, nil)
+		main := newFuncTask(`main`, func(h Handler) error {
+			cancel()
+			/* The requirement must reach the manager after the cancellation. */
+			<-noticed
+			h.RequireAndWait(notStarted)
+			return nil
+		})
+		result := build(manager, main, Options{MaxParallelTasks: 1, Finalizers: []Task{finalizer}, Context: ctx})
+		if !result.Cancelled || result.Succeeded() {
+			t.Error(`build was not reported as cancelled`)
+		}
+		if notStarted.runs.Load() != 0 {
+			t.Error(`a task was started after the build was cancelled`)
+		}
+		if finalizer.runs.Load() != 1 || len(result.Finalizers) != 1 {
+			t.Errorf(`build finalizer did not run exactly once, results: %+v`, result.Finalizers)
+		}
+		var cancelledErr *ErrCancelled
+		found := false
+		for _, failed := range result.Failed {
+			if failed.Task == notStarted {
+				found = true
+				if !errors.As(failed.Err, &cancelledErr) {
+					t.Errorf(`unexpected error for the cancelled task: %v`, failed.Err)
+				}
+			}
+		}
+		if !found {
+			t.Errorf(`the cancelled task is not among the failed tasks: %+v`, result.Failed)
+		}
+	})
+
+	t.Run(`required tasks are not taken over as finalizers`, func(t *testing.T) {
+		shared := newFuncTask(`shared`, func(Handler) error { return errFailed })
+		target := newFuncTask(`target`, func(h Handler) error {
+			h.Finally(shared)
+			return nil
+		})
+		main := newFuncTask(`main`, func(h Handler) error {
+			/* With one job, the target finishes while the shared task is still queued. */
+			h.RequireAndWait(target, shared)
+			return nil
+		})
+		result := Start(main, 1)
+		if shared.runs.Load() != 1 {
+			t.Errorf(`shared task ran %d times`, shared.runs.Load())
+		}
+		if len(result.Finalizers) != 0 {
+			t.Errorf(`the failure of a required task was reported as a finalizer: %+v`, result.Finalizers)
+		}
+		if len(result.Failed) == 0 || result.Failed[0].Task != shared {
+			t.Errorf(`the failure of the shared task was not reported: %+v`, result.Failed)
+		}
+	})
+}
+
+/* A funcTask that declares locks. */
+type lockingTask struct {
+	*funcTask
+	locks []Lock
+}
+
+func (t *lockingTask) Locks() []Lock { return t.locks }
+func (t *lockingTask) Matches(other Task) bool {
+	if converted, ok := other.(*lockingTask); ok {
+		return t.funcTask.Matches(converted.funcTask)
+	}
+	return false
+}
+
+func TestLocks(t *testing.T) {
+	t.Run(`exclusion`, func(t *testing.T) {
+		var holders, maxHolders atomic.Int32
+		tasks := make([]Task, 8)
+		for i := range tasks {
+			tasks[i] = &lockingTask{newFuncTask(fmt.Sprint(`locking `, i), func(h Handler) error {
+				current := holders.Add(1)
+				defer holders.Add(-1)
+				for {
+					previous := maxHolders.Load()
+					if current <= previous || maxHolders.CompareAndSwap(previous, current) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				return nil
+			}), []Lock{{Name: `shared`}}}
+		}
+		main := newFuncTask(`main`, func(h Handler) error {
+			h.RequireAndWait(tasks...)
+			return nil
+		})
+		if result := Start(main, 4); !result.Succeeded() {
+			t.Fatalf(`build failed: %+v`, result.Failed)
+		}
+		if maxHolders.Load() != 1 {
+			t.Errorf(`%d tasks held the same lock at once`, maxHolders.Load())
+		}
+	})
+
+	t.Run(`released while waiting`, func(t *testing.T) {
+		inner := &lockingTask{newFuncTask(`inner`, nil), []Lock{{Name: `shared`}}}
+		outer := &lockingTask{newFuncTask(`outer`, func(h Handler) error {
+			h.RequireAndWait(inner)
+			return nil
+		}), []Lock{{Name: `shared`}}}
+		if result := Start(outer, 2); !result.Succeeded() {
+			t.Errorf(`build failed: %+v`, result.Failed)
+		}
+	})
+
+	t.Run(`deadlock while holding`, func(t *testing.T) {
+		inner := &lockingTask{newFuncTask(`inner`, nil), []Lock{{Name: `shared`}}}
+		outer := &lockingTask{newFuncTask(`outer`, func(h Handler) error {
+			h.RequireAndWait(inner)
+			return nil
+		}), []Lock{{Name: `shared`, HoldWhileWaiting: true}}}
+		result := Start(outer, 2)
+		if inner.runs.Load() != 0 {
+			t.Error(`task ran while another task held its lock`)
+		}
+		var deadlock *ErrDeadlock
+		if len(result.Failed) <= 0 || result.Failed[0].Task != inner || !errors.As(result.Failed[0].Err, &deadlock) {
+			t.Fatalf(`expected the inner task to fail with a deadlock, got: %+v`, result.Failed)
+		}
+		if deadlock.Lock != `shared` || deadlock.Holder != outer {
+			t.Errorf(`unexpected deadlock error: %v`, deadlock)
+		}
+	})
+}
+
+func TestAbortedTasks(t *testing.T) {
+	errFailed := errors.New(`failed`)
+
+	t.Run(`a recover in the task does not stop the abort`, func(t *testing.T) {
+		failing := newFuncTask(`failing`, func(Handler) error { return errFailed })
+		recovered := make(chan interface{}, 1)
+		var resumed bool
+		main := newFuncTask(`main`, func(h Handler) (err error) {
+			defer func() {
+				value := recover()
+				recovered <- value
+				if value != nil {
+					err = fmt.Errorf(`recovered: %v`, value)
+				}
+			}()
+			h.RequireAndWait(failing)
+			resumed = true
+			return nil
+		})
+		result := Start(main, 1)
+		if resumed {
+			t.Error(`the task resumed after its dependency failed`)
+		}
+		var dependencyFailed *ErrDependencyFailed
+		if len(result.Failed) != 2 || result.Failed[1].Task != main || !errors.As(result.Failed[1].Err, &dependencyFailed) {
+			t.Errorf(`unexpected failures: %+v`, result.Failed)
+		}
+		select {
+		case value := <-recovered:
+			if value != nil {
+				t.Errorf(`the task recovered %v from the abort, and would report its outcome again`, value)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error(`the aborted task was not unwound`)
+		}
+	})
+
+	t.Run(`tasks exiting their goroutine fail`, func(t *testing.T) {
+		exiting := newFuncTask(`exiting`, func(Handler) error {
+			runtime.Goexit()
+			return nil
+		})
+		after := newFuncTask(`after`, nil)
+		main := newFuncTask(`main`, func(h Handler) error {
+			h.RequireWith(EdgeOrderOnly, exiting)
+			h.Wait()
+			h.RequireAndWait(after)
+			return nil
+		})
+		result := Start(main, 1)
+		if len(result.Failed) != 1 || result.Failed[0].Task != exiting {
+			t.Errorf(`unexpected failures: %+v`, result.Failed)
+		}
+		if after.runs.Load() != 1 {
+			t.Error(`the worker of the exiting task was not replaced`)
+		}
+	})
+}
+
+func TestDependencyCycle(t *testing.T) {
+	var a, b *funcTask
+	a = newFuncTask(`a`, func(h Handler) error {
+		h.RequireAndWait(b)
+		return nil
+	})
+	b = newFuncTask(`b`, func(h Handler) error {
+		h.RequireAndWait(a)
+		return nil
+	})
+	result := Start(a, 2)
+	var deadlock *ErrDeadlock
+	if result.Succeeded() || !errors.As(result.Failed[0].Err, &deadlock) {
+		t.Errorf(`expected the cycle to be reported as a deadlock, got: %+v`, result.Failed)
+	}
+}
+
+func TestSyntheticGraphs(t *testing.T) {
+	for _, shape := range []struct {
+		name  string
+		graph *synthGraph
+	}{
+		{`chain`, chainGraph(50)},
+		{`fan-out`, fanOutGraph(50)},
+		{`diamond`, diamondGraph(5, 5)},
+		{`random`, randomDAG(rand.New(rand.NewSource(1)), 100, 3)},
+		{`wait-heavy`, waitHeavyGraph(3, 4)},
+	} {
+		shape := shape // Capture
+		t.Run(shape.name, func(t *testing.T) {
+			shape.graph.track = true
+			if result := Start(shape.graph.root(), 4); !result.Succeeded() {
+				t.Fatalf(`build failed: %+v`, result.Failed)
+			}
+			for _, violation := range shape.graph.violations {
+				t.Error(violation)
+			}
+			if runs := shape.graph.root().runs.Load(); runs != 1 {
+				t.Errorf(`root ran %d times`, runs)
+			}
+		})
+	}
+}
@@ -6,9 +6,15 @@ as the handler holds that data. */
 type handlerMessenger interface {
 	/* New dependency declarations. Can be nil or empty. */
 	Dependencies() []Task
+	/* The kind of edge to create to the declared dependencies. */
+	DependencyKind() EdgeKind
 	/* Status being requested by the task. Nil to indicate that no status update is being requested.
 	Request may be denied. */
 	RequestedStatus() *taskStatus
+	/* Finalizers to attach to the task. Can be nil or empty. */
+	Finalizers() []Task
+	/* Tasks that a waiting task is waiting for. Nil to indicate that the task waits for all of its dependencies. */
+	Awaited() []Task
 	/* Any sort of error that has occurred. Having an error alone does not mark the task as
 	having failed, for that, the status must also be updated to statusErrored. */
 	Error() error
@@ -39,7 +45,10 @@ func addSubject[T Task](subject T, message handlerMessenger) messenger[T] {
 type blankMessage struct{}
 
 func (blankMessage) Dependencies() []Task         { return nil }
+func (blankMessage) DependencyKind() EdgeKind     { return EdgeRequired }
 func (blankMessage) RequestedStatus() *taskStatus { return nil }
+func (blankMessage) Finalizers() []Task           { return nil }
+func (blankMessage) Awaited() []Task              { return nil }
 func (blankMessage) Error() error                 { return nil }
 
 type statusUpdate struct {
@@ -55,10 +64,37 @@ func (su statusUpdate) RequestedStatus() *taskStatus {
 
 type dependencyDeclaration struct {
 	dependencies []Task
+	kind         EdgeKind
 	blankMessage
 }
 
-func (r *dependencyDeclaration) Dependencies() []Task { return r.dependencies }
+func (r *dependencyDeclaration) Dependencies() []Task     { return r.dependencies }
+func (r *dependencyDeclaration) DependencyKind() EdgeKind { return r.kind }
+
+/* Declaration of dependencies that also puts the task into the waiting state.
+The dependencies are processed before the status update. */
+type waitingDependencyDeclaration struct {
+	dependencyDeclaration
+}
+
+func (*waitingDependencyDeclaration) RequestedStatus() *taskStatus {
+	status := statusWaiting
+	return &status
+}
+
+/* Declaration of dependencies which the task then waits for, ignoring its other dependencies. */
+type waitForDeclaration struct {
+	waitingDependencyDeclaration
+}
+
+func (w *waitForDeclaration) Awaited() []Task { return w.dependencies }
+
+type finalizerDeclaration struct {
+	finalizers []Task
+	blankMessage
+}
+
+func (f *finalizerDeclaration) Finalizers() []Task { return f.finalizers }
 
 type errorMessage struct {
 	err error
@@ -1,5 +1,11 @@
 package nbt
 
+import (
+	"context"
+	"io"
+	"log"
+)
+
 type Task interface {
 	/* Returns a hash for this task that can be used to use it in a map. */
 	Hash() uint64
@@ -8,14 +14,197 @@ type Task interface {
 	Perform(h Handler) error
 }
 
+/* A named lock. Tasks holding the same lock never run at the same time. */
+type Lock struct {
+	Name string
+	/* When set, the lock remains held while the task is waiting, so no other task may take the lock
+	until the task has finished. Otherwise, the lock is released while the task waits and is
+	reacquired before the task resumes. */
+	HoldWhileWaiting bool
+}
+
+/* Implemented by tasks which must not run at the same time as other tasks holding any of the same locks,
+even when the tasks are unrelated in the dependency graph. */
+type LockingTask interface {
+	Task
+	/* Returns the locks the task needs in order to run. Should return the same locks every time it is called. */
+	Locks() []Lock
+}
+
 type Handler interface {
 	Require(Task)
+	/* Requires all of the given tasks. This is equivalent to calling Require for each of the tasks,
+	but the requirements are sent to the manager together, which is much cheaper for large numbers of tasks. */
+	RequireAll(tasks ...Task)
+	/* Declares dependencies on the given tasks using the given kind of edge.
+	RequireAll is equivalent to RequireWith(EdgeRequired, ...). */
+	RequireWith(kind EdgeKind, tasks ...Task)
 	Wait()
+	/* Requires all of the given tasks and then waits, as a single request to the manager. */
+	RequireAndWait(tasks ...Task)
+	/* Waits only until the given tasks are complete, rather than all requirements declared so far.
+	Any of the tasks that have not yet been required are required. Like Wait, the task does not
+	occupy one of the parallel task slots while it is waiting. */
+	WaitFor(tasks ...Task)
+	/* Attaches finalizers to the task. The finalizers are run once the task has finished,
+	whether it succeeded or failed, and even if the build has been cancelled. */
+	Finally(tasks ...Task)
 	/* Gets the instance of t that has or will actually execute.
 	This operation is semi-expensive since the main goroutine must perform the resolution. */
 	Resolve(t Task) Task
 }
 
-func Start(mainTask Task, maxParallelTasks uint) {
-	newTaskManager().execute(mainTask, maxParallelTasks)
+/* The kind of a dependency edge, determining how a dependent relates to its dependency. */
+type EdgeKind uint
+
+const (
+	/* The dependency is executed, and the dependent waits for it and fails if the dependency fails. */
+	EdgeRequired EdgeKind = iota
+	/* The dependency is executed and the dependent waits for it, but the dependent does not fail
+	if the dependency fails. */
+	EdgeOrderOnly
+	/* The dependency is not executed on account of this edge. If some other task has already
+	required the dependency, the dependent waits for it as it would with EdgeOrderOnly,
+	otherwise the edge is ignored. */
+	EdgeWeak
+)
+
+func (k EdgeKind) String() (name string) {
+	switch k {
+	case EdgeRequired:
+		name = "Required"
+	case EdgeOrderOnly:
+		name = "OrderOnly"
+	case EdgeWeak:
+		name = "Weak"
+	default:
+		name = "ERROR - UNKNOWN EDGE KIND"
+	}
+	return
+}
+
+/* The kind of a change in the status of a task. */
+type EventKind uint
+
+const (
+	/* The task was started for the first time. */
+	EventStarted EventKind = iota
+	/* The task is waiting for its dependencies. */
+	EventWaiting
+	/* The task was resumed after waiting. */
+	EventResumed
+	EventCompleted
+	/* The task failed, either by itself or because of one of its dependencies. */
+	EventFailed
+	/* The task finished in an earlier build of a session, but must be run again. */
+	EventInvalidated
+)
+
+func (k EventKind) String() (name string) {
+	switch k {
+	case EventStarted:
+		name = "Started"
+	case EventWaiting:
+		name = "Waiting"
+	case EventResumed:
+		name = "Resumed"
+	case EventCompleted:
+		name = "Completed"
+	case EventFailed:
+		name = "Failed"
+	case EventInvalidated:
+		name = "Invalidated"
+	default:
+		name = "ERROR - UNKNOWN EVENT KIND"
+	}
+	return
+}
+
+/* A change in the status of a task during a build. */
+type Event struct {
+	Task Task
+	Kind EventKind
+	/* The error the task failed with, for EventFailed. */
+	Err error
+}
+
+/* Options for controlling the execution of a build. */
+type Options struct {
+	/* Maximum number of tasks that may be running at the same time. Must be positive. */
+	MaxParallelTasks uint
+	/* When set, the identity methods (Hash and Matches) of tasks are checked during the build,
+	and warnings are logged when hashes collide often or when Matches is not symmetric.
+	Statistics about task hashes are logged at the end of the build. */
+	DebugIdentity bool
+	/* If not nil, the dependency graph is written here in Graphviz DOT format once the build is over. */
+	Graph io.Writer
+	/* Finalizers for the whole build, run once all other tasks have finished,
+	regardless of whether the build succeeded, failed or was cancelled. */
+	Finalizers []Task
+	/* Context for cancelling the build. Once the context is done, tasks that are already running
+	are allowed to finish, but no new tasks are started other than finalizers. Can be nil. */
+	Context context.Context
+	/* Called by the manager whenever a task changes status, in the order that the changes happen. It is called
+	from the goroutine running the build, so it must not block, and must not call back into the build. Can be nil. */
+	OnEvent func(Event)
+	/* If not nil, the outputs of tasks implementing CacheableTask are restored from here when possible,
+	instead of performing the tasks. */
+	Cache Cache
+	/* If not nil, remotable tasks are run here instead of being performed. Running a task on the executor
+	occupies one of the parallel task slots, like performing it would. */
+	Executor RemoteExecutor
+	/* Rules making the files required with File. Can be nil, in which case every file is taken to be a source file. */
+	Rules *Rules
+	/* How tasks implementing CacheableTask are found to be up to date, so that they can be skipped.
+	By default, they are always performed. */
+	Staleness Staleness
+	/* The file recording the actions of tasks for StalenessHash. Defaults to DefaultStateFile. */
+	StateFile string
+	/* If not nil, called whenever the manager starts or resumes a task, with the number of tasks ready to run,
+	to choose which of them runs. It returns the index of the chosen task, the tasks being in the order in which
+	they became ready. By default, tasks run in the order in which they became ready. With MaxParallelTasks set
+	to 1, the order in which tasks run depends only on these choices, so a seeded random choice gives a varied but
+	reproducible order, as used by nbttest.Run. */
+	ChooseNext func(ready int) int
+}
+
+/* The outcome of a single task. */
+type TaskResult struct {
+	Task Task
+	/* Nil if the task succeeded. */
+	Err error
+}
+
+/* The outcome of a build. */
+type Result struct {
+	/* Tasks that failed, including those which failed because one of their dependencies failed,
+	in the order that they failed. Finalizers are not included. */
+	Failed []TaskResult
+	/* The outcomes of all finalizers that were run, in the order that they finished. */
+	Finalizers []TaskResult
+	/* True if the build was cancelled. */
+	Cancelled bool
+}
+
+/* Returns true if the build was not cancelled and no tasks failed. Failed finalizers are not considered. */
+func (r *Result) Succeeded() bool {
+	return !r.Cancelled && len(r.Failed) <= 0
+}
+
+func Start(mainTask Task, maxParallelTasks uint) *Result {
+	return StartWithOptions(mainTask, Options{MaxParallelTasks: maxParallelTasks})
+}
+
+func StartWithOptions(mainTask Task, options Options) *Result {
+	return build(newTaskManager(options.DebugIdentity), mainTask, options)
+}
+
+func build(manager *taskManager, mainTask Task, options Options) *Result {
+	result := manager.execute(mainTask, options)
+	if options.Graph != nil {
+		if err := writeGraph(options.Graph, manager.registry); err != nil {
+			log.Printf("nbt: failed to write the dependency graph: %v\n", err)
+		}
+	}
+	return result
 }
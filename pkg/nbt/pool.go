@@ -0,0 +1,113 @@
+package nbt
+
+/* Tasks are performed by a pool of workers. A worker performs one task at a time, sending the requests
+made through the task's handler straight to the manager.
+When a task waits, it keeps the goroutine it is running on, since the goroutine's stack holds the state of the task.
+The worker therefore donates itself to the task, and a replacement worker is added to the pool. The pool only bounds
+the number of tasks running at once: there is still a goroutine for every waiting task, so a graph in which many
+tasks wait at once, such as a long chain of tasks each waiting for the next, needs as many goroutines.
+BenchmarkLargeGraph shows both cases. */
+
+/* Interface to be implemented in order for workers to communicate with the manager. */
+type managerCommunicator[T Task] interface {
+	SendMessage(T, handlerMessenger)
+	RequestResolution(resolveRequester)
+}
+
+type managerComms struct {
+	messages        chan messenger[*taskEntry]
+	resolutionQueue chan resolveRequester
+}
+
+func (c *managerComms) SendMessage(task *taskEntry, message handlerMessenger) {
+	c.messages <- addSubject(task, message)
+}
+
+func (c *managerComms) RequestResolution(r resolveRequester) {
+	c.resolutionQueue <- r
+}
+
+type workerPool struct {
+	/* New tasks to be performed. Buffered to the size of the pool so that the manager never blocks,
+	since it never starts more tasks than there are workers. */
+	work  chan *taskEntry
+	comms managerCommunicator[*taskEntry]
+	/* Cache for the outputs of cacheable tasks. Can be nil. */
+	cache Cache
+	/* Executor for remotable tasks. Can be nil. */
+	executor RemoteExecutor
+	/* When set, the key of the action of each task is recorded in the task's entry. */
+	recordKeys bool
+	/* Rules for file tasks. Can be nil. */
+	rules *Rules
+	/* How tasks with actions are found to be up to date. */
+	staleness Staleness
+	/* The recorded actions, when staleness is StalenessHash. */
+	state *buildState
+}
+
+func newWorkerPool(size uint, comms managerCommunicator[*taskEntry], cache Cache, executor RemoteExecutor) *workerPool {
+	pool := &workerPool{work: make(chan *taskEntry, size), comms: comms, cache: cache, executor: executor}
+	for i := uint(0); i < size; i++ {
+		pool.spawn()
+	}
+	return pool
+}
+
+/* Adds a worker to the pool. */
+func (p *workerPool) spawn() {
+	go p.runWorker()
+}
+
+func (p *workerPool) runWorker() {
+	for task := range p.work {
+		if p.perform(task) {
+			/* A replacement was added to the pool when the task started waiting. */
+			return
+		}
+	}
+}
+
+/* Submits a new task to be performed by the pool. */
+func (p *workerPool) submit(task *taskEntry) {
+	task.handler = &chanHandler[*taskEntry]{subject: task, comms: p.comms, pool: p, rules: p.rules}
+	p.work <- task
+}
+
+/* Stops the pool once all submitted tasks have been performed. Workers donated to waiting tasks are unaffected. */
+func (p *workerPool) close() {
+	close(p.work)
+}
+
+/* Performs the task, returning true if the worker was donated to it. The task must not be touched
+once its final message has been sent, since a session may reset it for its next build. */
+func (p *workerPool) perform(task *taskEntry) (donated bool) {
+	h := task.handler
+	returned := false
+	defer func() {
+		if err := recover(); err != nil {
+			donated = h.donated
+			p.comms.SendMessage(task, &errorMessage{err: &errPanicked{panicErr: err, task: task}})
+		} else if !returned && !h.aborted {
+			/* The task called runtime.Goexit itself. The goroutine cannot be kept, so it is replaced. */
+			if !h.donated {
+				p.spawn()
+			}
+			p.comms.SendMessage(task, &errorMessage{err: &errPanicked{panicErr: "runtime.Goexit called", task: task}})
+		}
+	}()
+	var err error
+	if cacheable, ok := task.Task.(CacheableTask); ok && (p.cache != nil || p.executor != nil || p.recordKeys || p.staleness != StalenessNone) {
+		err = p.performAction(h, cacheable)
+	} else {
+		err = task.Perform(h)
+	}
+	returned = true
+	donated = h.donated
+	if err != nil {
+		p.comms.SendMessage(task, &errorMessage{err: err})
+	} else {
+		p.comms.SendMessage(task, statusUpdate{newStatus: statusComplete})
+	}
+	return
+}
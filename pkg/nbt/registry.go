@@ -0,0 +1,130 @@
+package nbt
+
+import (
+	"fmt"
+	"log"
+)
+
+/* Length of a hash chain at which the registry, in debug mode, warns about hash collisions. */
+const collisionWarningLength = 4
+
+/* The registry keeps track of every task known to the manager, mapping each task to the
+single entry that represents it. Two tasks are considered to be the same if they have the same hash
+and they match one another. */
+type registry struct {
+	chains map[uint64][]*taskEntry
+	/* Every entry, in the order in which they were registered. */
+	entries []*taskEntry
+	size    uint
+	/* When set, the registry checks the identity methods of the tasks it resolves and
+	logs warnings about suspicious behaviour. */
+	debug bool
+	/* Hashes for which a collision warning has already been logged, to avoid flooding the log. */
+	warnedHashes map[uint64]struct{}
+}
+
+func newRegistry(debug bool) *registry {
+	return &registry{
+		chains:       make(map[uint64][]*taskEntry),
+		debug:        debug,
+		warnedHashes: make(map[uint64]struct{}),
+	}
+}
+
+/* Finds the entry for the given task within the hash chain for `key`, returning nil if there isn't one. */
+func (r *registry) find(key uint64, task Task) *taskEntry {
+	for _, entry := range r.chains[key] {
+		matches := task.Matches(entry.Task)
+		if r.debug && matches != entry.Task.Matches(task) {
+			log.Printf("nbt: Matches is not symmetric for tasks %#v (%T) and %#v (%T)\n", task, task, entry.Task, entry.Task)
+		}
+		if matches {
+			return entry
+		}
+	}
+	return nil
+}
+
+/* Gets the entry for the given task, if the task is already known to the registry. */
+func (r *registry) lookup(task Task) (entry *taskEntry, ok bool) {
+	entry = r.find(task.Hash(), task)
+	return entry, entry != nil
+}
+
+/* Gets the entry for the given task, creating and registering a new entry if the task is not yet known. */
+func (r *registry) resolve(task Task) *taskEntry {
+	key := task.Hash()
+	if entry := r.find(key, task); entry != nil {
+		return entry
+	}
+	entry := newTaskEntry(task)
+	r.chains[key] = append(r.chains[key], entry)
+	r.entries = append(r.entries, entry)
+	r.size++
+	if r.debug {
+		r.checkCollisions(key)
+	}
+	return entry
+}
+
+func (r *registry) checkCollisions(key uint64) {
+	chain := r.chains[key]
+	if len(chain) < collisionWarningLength {
+		return
+	}
+	if _, warned := r.warnedHashes[key]; warned {
+		return
+	}
+	r.warnedHashes[key] = struct{}{}
+	types := make([]string, len(chain))
+	for i, entry := range chain {
+		types[i] = fmt.Sprintf("%T", entry.Task)
+	}
+	log.Printf("nbt: %d distinct tasks share the hash %#x, consider improving their Hash methods; task types: %v\n", len(chain), key, types)
+}
+
+/* Calls `visit` with every entry in the registry, in the order in which they were registered, so that builds
+are reproducible. The registry must not be modified during iteration. */
+func (r *registry) forEach(visit func(*taskEntry)) {
+	for _, entry := range r.entries {
+		visit(entry)
+	}
+}
+
+/* Statistics on the hash chains of a registry, useful for diagnosing poor Hash implementations. */
+type registryStats struct {
+	/* Number of registered tasks. */
+	tasks uint
+	/* Number of distinct hashes among the registered tasks. */
+	hashes uint
+	/* Number of tasks which share their hash with at least one other task. */
+	collidingTasks uint
+	longestChain   uint
+}
+
+func (r *registry) stats() (stats registryStats) {
+	stats.tasks = r.size
+	stats.hashes = uint(len(r.chains))
+	for _, chain := range r.chains {
+		length := uint(len(chain))
+		if length > 1 {
+			stats.collidingTasks += length
+		}
+		if length > stats.longestChain {
+			stats.longestChain = length
+		}
+	}
+	return
+}
+
+func (s registryStats) meanChainLength() float64 {
+	if s.hashes == 0 {
+		return 0
+	}
+	return float64(s.tasks) / float64(s.hashes)
+}
+
+func (s registryStats) String() string {
+	return fmt.Sprintf("%d tasks, %d distinct hashes, %d colliding tasks, mean chain length %.2f, longest chain %d",
+		s.tasks, s.hashes, s.collidingTasks, s.meanChainLength(), s.longestChain)
+}
@@ -0,0 +1,122 @@
+package nbt
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+/* A task with a configurable hash, identified by its id. */
+type identityTask struct {
+	id   int
+	hash uint64
+}
+
+func (t *identityTask) Hash() uint64 { return t.hash }
+func (t *identityTask) Matches(other Task) bool {
+	if converted, ok := other.(*identityTask); ok {
+		return converted.id == t.id
+	}
+	return false
+}
+func (*identityTask) Perform(Handler) error { return nil }
+
+/* A task whose Matches method is not symmetric: it claims to match any identityTask. */
+type greedyTask struct{ identityTask }
+
+func (*greedyTask) Matches(other Task) bool {
+	_, ok := other.(*identityTask)
+	return ok
+}
+
+/* Redirects the log output for the duration of the test, returning the buffer it is written to. */
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestRegistry(t *testing.T) {
+	t.Run(`resolution`, func(t *testing.T) {
+		r := newRegistry(false)
+		first := r.resolve(&identityTask{1, 0})
+		if second := r.resolve(&identityTask{1, 0}); second != first {
+			t.Error(`resolving a matching task returned a different entry`)
+		}
+		if other := r.resolve(&identityTask{2, 0}); other == first {
+			t.Error(`resolving a different task with the same hash returned the same entry`)
+		}
+		if r.size != 2 {
+			t.Errorf(`expected registry size 2, got %d`, r.size)
+		}
+	})
+
+	t.Run(`lookup`, func(t *testing.T) {
+		r := newRegistry(false)
+		if _, ok := r.lookup(&identityTask{1, 7}); ok {
+			t.Error(`lookup found an entry in an empty registry`)
+		}
+		if r.size != 0 {
+			t.Error(`lookup registered a task`)
+		}
+		entry := r.resolve(&identityTask{1, 7})
+		if found, ok := r.lookup(&identityTask{1, 7}); !ok || found != entry {
+			t.Error(`lookup did not find the resolved entry`)
+		}
+	})
+
+	t.Run(`iteration and statistics`, func(t *testing.T) {
+		r := newRegistry(false)
+		for i := 0; i < 6; i++ {
+			r.resolve(&identityTask{i, uint64(i % 3)})
+		}
+		r.resolve(&identityTask{6, 100})
+		visited := make(map[int]bool)
+		r.forEach(func(e *taskEntry) { visited[e.Task.(*identityTask).id] = true })
+		if len(visited) != 7 {
+			t.Errorf(`expected to visit 7 tasks, visited %d`, len(visited))
+		}
+		stats := r.stats()
+		if expected := (registryStats{tasks: 7, hashes: 4, collidingTasks: 6, longestChain: 2}); stats != expected {
+			t.Errorf(`unexpected statistics %+v, expected %+v`, stats, expected)
+		}
+	})
+
+	t.Run(`debug warnings`, func(t *testing.T) {
+		t.Run(`collisions`, func(t *testing.T) {
+			output := captureLog(t)
+			r := newRegistry(true)
+			for i := 0; i < 2*collisionWarningLength; i++ {
+				r.resolve(&identityTask{i, 0})
+			}
+			if count := strings.Count(output.String(), `share the hash`); count != 1 {
+				t.Errorf(`expected exactly one collision warning, got %d in log: %s`, count, output)
+			}
+		})
+
+		t.Run(`asymmetric matches`, func(t *testing.T) {
+			output := captureLog(t)
+			r := newRegistry(true)
+			r.resolve(&identityTask{1, 0})
+			r.resolve(&greedyTask{identityTask{2, 0}})
+			if !strings.Contains(output.String(), `not symmetric`) {
+				t.Errorf(`expected a warning about asymmetric Matches, log: %s`, output)
+			}
+		})
+
+		t.Run(`disabled`, func(t *testing.T) {
+			output := captureLog(t)
+			r := newRegistry(false)
+			for i := 0; i < 2*collisionWarningLength; i++ {
+				r.resolve(&identityTask{i, 0})
+			}
+			r.resolve(&greedyTask{identityTask{100, 0}})
+			if output.Len() > 0 {
+				t.Error(`unexpected log output with debugging disabled: `, output)
+			}
+		})
+	})
+}
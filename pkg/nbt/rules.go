@@ -0,0 +1,189 @@
+package nbt
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/* A task standing for a file, which is made by the task that a rule gives for the file's path. */
+type fileTask struct {
+	path string
+}
+
+/* Returns a task standing for the file at the given path. Performing it requires and waits for the task made
+for the path by the best matching rule in Options.Rules. If no rule matches, the file is taken to be a source
+file, and the task fails if the file does not exist. */
+func File(path string) Task {
+	return &fileTask{filepath.Clean(path)}
+}
+
+func (f *fileTask) Hash() uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(f.path))
+	return h.Sum64()
+}
+func (f *fileTask) Matches(other Task) bool {
+	converted, ok := other.(*fileTask)
+	return ok && converted.path == f.path
+}
+func (f *fileTask) String() string { return "file " + f.path }
+
+/* Handlers which give the rules of the build, as the handlers given to tasks by the manager do. */
+type RulesHandler interface {
+	Handler
+	/* Returns the rules of the build, which may be nil if there are none. */
+	Rules() *Rules
+}
+
+/* Requires and waits for the task made by the rule for the file's path. The rules are taken from the handler
+if it is a RulesHandler, and otherwise there are no rules. */
+func (f *fileTask) Perform(h Handler) error {
+	var rules *Rules
+	if rulesHandler, ok := h.(RulesHandler); ok {
+		rules = rulesHandler.Rules()
+	}
+	target, err := rules.Lookup(f.path)
+	var noRule *ErrNoRule
+	if errors.As(err, &noRule) {
+		if _, statErr := os.Stat(f.path); statErr == nil {
+			return nil
+		} else if !errors.Is(statErr, fs.ErrNotExist) {
+			return statErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	h.RequireAndWait(target)
+	return nil
+}
+
+/* The match of a path against the pattern of a rule. */
+type Match struct {
+	/* The path that matched, cleaned. */
+	Path string
+	/* The pattern of the rule, such as "%.o". */
+	Pattern string
+	/* The part of the path matched by the "%" of the pattern, like $* in make. */
+	Stem string
+}
+
+/* Substitutes the stem for the "%" in the given pattern, such as to find the source of the file being made. */
+func (m Match) Expand(pattern string) string {
+	return strings.Replace(pattern, "%", m.Stem, 1)
+}
+
+type rule struct {
+	pattern        string
+	prefix, suffix string
+	factory        func(Match) Task
+}
+
+/* Rules for making files whose paths match patterns, like the pattern rules of make.
+The zero value has no rules. Rules must not be added while a build using them is running. */
+type Rules struct {
+	rules []rule
+}
+
+/* Error given for patterns without exactly one "%". */
+type ErrInvalidPattern struct {
+	Pattern string
+}
+
+func (err *ErrInvalidPattern) Error() string {
+	return fmt.Sprintf("invalid pattern %q: patterns must contain exactly one %%", err.Pattern)
+}
+
+/* Adds a rule making the files matching the pattern with the tasks returned by factory. Patterns contain
+exactly one "%", which matches a non-empty stem, and are matched against whole cleaned paths. */
+func (r *Rules) Add(pattern string, factory func(Match) Task) error {
+	if strings.Count(pattern, "%") != 1 {
+		return &ErrInvalidPattern{pattern}
+	}
+	prefix, suffix, _ := strings.Cut(filepath.Clean(pattern), "%")
+	r.rules = append(r.rules, rule{pattern, prefix, suffix, factory})
+	return nil
+}
+
+/* Error given when no rule matches the path of a file that does not exist. */
+type ErrNoRule struct {
+	Path string
+	/* The patterns of all of the rules, none of which matched. */
+	Patterns []string
+}
+
+func (err *ErrNoRule) Error() string {
+	if len(err.Patterns) == 0 {
+		return fmt.Sprintf("no rule to make %q, and there are no rules", err.Path)
+	}
+	return fmt.Sprintf("no rule to make %q, none of these patterns match: %s", err.Path, strings.Join(err.Patterns, ", "))
+}
+
+/* Error given when several rules match a path equally well. */
+type ErrAmbiguousRule struct {
+	Path string
+	/* The patterns of the rules that matched with the shortest stem. */
+	Patterns []string
+}
+
+func (err *ErrAmbiguousRule) Error() string {
+	return fmt.Sprintf("several rules match %q equally well: %s", err.Path, strings.Join(err.Patterns, ", "))
+}
+
+/* Returns the task making the file at the given path. When several rules match, the rule matching with the
+shortest stem is used, as in make, and it is an error for several rules to match with the shortest stem. */
+func (r *Rules) Lookup(path string) (Task, error) {
+	path = filepath.Clean(path)
+	var best []rule
+	var bestStem string
+	if r != nil {
+		for _, candidate := range r.rules {
+			stem, ok := candidate.match(path)
+			switch {
+			case !ok:
+			case len(best) == 0 || len(stem) < len(bestStem):
+				best, bestStem = []rule{candidate}, stem
+			case len(stem) == len(bestStem):
+				best = append(best, candidate)
+			}
+		}
+	}
+	switch len(best) {
+	case 0:
+		return nil, &ErrNoRule{path, patterns(r.all())}
+	case 1:
+		return best[0].factory(Match{path, best[0].pattern, bestStem}), nil
+	default:
+		return nil, &ErrAmbiguousRule{path, patterns(best)}
+	}
+}
+
+func (rl rule) match(path string) (stem string, ok bool) {
+	if len(path) <= len(rl.prefix)+len(rl.suffix) || !strings.HasPrefix(path, rl.prefix) || !strings.HasSuffix(path, rl.suffix) {
+		return "", false
+	}
+	return path[len(rl.prefix) : len(path)-len(rl.suffix)], true
+}
+
+func (r *Rules) all() []rule {
+	if r == nil {
+		return nil
+	}
+	return r.rules
+}
+
+/* Returns the sorted patterns of the rules. */
+func patterns(rules []rule) []string {
+	patterns := make([]string, len(rules))
+	for i, rl := range rules {
+		patterns[i] = rl.pattern
+	}
+	sort.Strings(patterns)
+	return patterns
+}
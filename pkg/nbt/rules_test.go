@@ -0,0 +1,176 @@
+package nbt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRulesLookup(t *testing.T) {
+	var rules Rules
+	for _, pattern := range []string{`%.o`, `build/%.o`, `lib%.a`, `%.a`, `gen/%`, `ab%`, `%yz`} {
+		pattern := pattern
+		if err := rules.Add(pattern, func(m Match) Task { return newFuncTask(m.Pattern+` `+m.Stem, nil) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path string
+		/* The name of the task made, or the patterns listed in the error. */
+		task     string
+		patterns []string
+		err      interface{}
+	}{
+		{path: `hello.o`, task: `%.o hello`},
+		{path: `./src/../hello.o`, task: `%.o hello`},
+		{path: `build/hello.o`, task: `build/%.o hello`},
+		{path: `libfoo.a`, task: `lib%.a foo`},
+		{path: `foo.a`, task: `%.a foo`},
+		{path: `.o`, patterns: []string{`%.a`, `%.o`, `%yz`, `ab%`, `build/%.o`, `gen/%`, `lib%.a`}, err: &ErrNoRule{}},
+		{path: `hello.c`, patterns: []string{`%.a`, `%.o`, `%yz`, `ab%`, `build/%.o`, `gen/%`, `lib%.a`}, err: &ErrNoRule{}},
+		/* The shortest stem wins. */
+		{path: `gen/x.o`, task: `gen/% x.o`},
+		/* Both stems are three bytes long, so neither rule is more specific. */
+		{path: `abcyz`, patterns: []string{`%yz`, `ab%`}, err: &ErrAmbiguousRule{}},
+	}
+	for i, test := range tests {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			task, err := rules.Lookup(test.path)
+			if test.err == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if name := task.(*funcTask).name; name != test.task {
+					t.Errorf(`made %q, expected %q`, name, test.task)
+				}
+				return
+			}
+			var patterns []string
+			switch expected := test.err.(type) {
+			case *ErrNoRule:
+				if !errors.As(err, &expected) {
+					t.Fatalf(`expected no rule, got %v`, err)
+				}
+				patterns = expected.Patterns
+			case *ErrAmbiguousRule:
+				if !errors.As(err, &expected) {
+					t.Fatalf(`expected ambiguous rules, got %v`, err)
+				}
+				patterns = expected.Patterns
+			}
+			if !reflect.DeepEqual(patterns, test.patterns) {
+				t.Errorf(`candidates %q, expected %q`, patterns, test.patterns)
+			}
+		})
+	}
+}
+
+func TestRulesInvalidPattern(t *testing.T) {
+	var rules Rules
+	for _, pattern := range []string{`hello.o`, `%/%.o`} {
+		var invalid *ErrInvalidPattern
+		if err := rules.Add(pattern, nil); !errors.As(err, &invalid) {
+			t.Errorf(`added %q: %v`, pattern, err)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, `hello.c`), []byte(`source`), 0o644)
+	var rules Rules
+	rules.Add(filepath.Join(dir, `%.o`), func(m Match) Task {
+		source := m.Expand(filepath.Join(dir, `%.c`))
+		return newFuncTask(m.Path, func(h Handler) error {
+			h.RequireAndWait(File(source))
+			data, err := os.ReadFile(source)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(m.Path, data, 0o644)
+		})
+	})
+	tests := []struct {
+		path    string
+		success bool
+	}{
+		{`hello.o`, true},
+		{`hello.c`, true},
+		{`missing.o`, false},
+		{`missing.c`, false},
+	}
+	for i, test := range tests {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			path := filepath.Join(dir, test.path)
+			result := StartWithOptions(File(path), Options{MaxParallelTasks: 2, Rules: &rules})
+			if result.Succeeded() != test.success {
+				t.Fatal(`unexpected failures: `, result.Failed)
+			}
+			if !test.success {
+				/* The missing source fails first, taking the tasks depending on it with it. */
+				var noRule *ErrNoRule
+				if first := result.Failed[0]; !errors.As(first.Err, &noRule) || noRule.Path != filepath.Join(dir, `missing.c`) {
+					t.Errorf(`expected no rule for the source, got %v`, first.Err)
+				}
+				return
+			}
+			if data, err := os.ReadFile(path); err != nil || string(data) != `source` {
+				t.Errorf(`read %q, %v`, data, err)
+			}
+		})
+	}
+}
+
+/* A handler which is not a RulesHandler, recording the tasks it waits for. */
+type plainHandler struct {
+	Handler
+	waited []Task
+}
+
+func (h *plainHandler) RequireAndWait(tasks ...Task) { h.waited = append(h.waited, tasks...) }
+
+func TestFilePerform(t *testing.T) {
+	dir := t.TempDir()
+	source, object := filepath.Join(dir, `hello.c`), filepath.Join(dir, `hello.o`)
+	os.WriteFile(source, []byte(`source`), 0o644)
+	var rules Rules
+	rules.Add(filepath.Join(dir, `%.o`), func(m Match) Task {
+		return newFuncTask(m.Path, func(Handler) error { return os.WriteFile(m.Path, []byte(`object`), 0o644) })
+	})
+
+	t.Run(`takes the rules from the handler`, func(t *testing.T) {
+		/* A task delegating to a file task, as wrappers of tasks do. */
+		wrapper := newFuncTask(`wrapper`, func(h Handler) error { return File(object).Perform(h) })
+		if result := StartWithOptions(wrapper, Options{MaxParallelTasks: 1, Rules: &rules}); !result.Succeeded() {
+			t.Fatal(`unexpected failures: `, result.Failed)
+		}
+		if data, err := os.ReadFile(object); err != nil || string(data) != `object` {
+			t.Errorf(`read %q, %v`, data, err)
+		}
+	})
+
+	t.Run(`has no rules with other handlers`, func(t *testing.T) {
+		var h plainHandler
+		if err := File(source).Perform(&h); err != nil || len(h.waited) != 0 {
+			t.Errorf(`source file: error %v, waited for %v`, err, h.waited)
+		}
+		var noRule *ErrNoRule
+		if err := File(filepath.Join(dir, `missing.o`)).Perform(&h); !errors.As(err, &noRule) {
+			t.Errorf(`expected ErrNoRule, got %v`, err)
+		}
+	})
+}
+
+func TestFileIdentity(t *testing.T) {
+	if a, b := File(`dir/../hello.o`), File(`hello.o`); a.Hash() != b.Hash() || !a.Matches(b) {
+		t.Error(`equivalent paths should be the same file`)
+	}
+	if File(`hello.o`).Matches(File(`hello.c`)) {
+		t.Error(`different paths should be different files`)
+	}
+}
@@ -0,0 +1,134 @@
+package nbt
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/* A series of builds sharing the state of their tasks, so that the graph of tasks does not have to be
+discovered again by each build. A build only runs the tasks that are new to the session, the tasks that failed
+in an earlier build and the tasks whose actions changed since they last ran, along with the tasks depending on
+any of those. The action of a task has changed if its key has, such as when the contents of one of its inputs
+change, or if any of its outputs are missing. Tasks without actions are only run again when one of their
+dependencies is. Build finalizers are run by every build.
+Builds of a session must not run at the same time. */
+type Session struct {
+	registry *registry
+}
+
+/* Returns a new session. See Options.DebugIdentity for the meaning of debugIdentity. */
+func NewSession(debugIdentity bool) *Session {
+	return &Session{newRegistry(debugIdentity)}
+}
+
+/* Builds the main task, carrying on from the earlier builds of the session.
+Options.DebugIdentity is ignored, in favour of the value given to NewSession. */
+func (s *Session) Build(mainTask Task, options Options) *Result {
+	manager := newTaskManagerWithRegistry(s.registry)
+	manager.recordKeys = true
+	manager.onEvent = options.OnEvent
+	s.invalidate(manager, options.Finalizers)
+	return build(manager, mainTask, options)
+}
+
+/* Returns true if the task has an action which changed since the task last ran. */
+func actionChanged(task *taskEntry) bool {
+	action, ok := task.lastAction()
+	if !ok {
+		return false
+	}
+	if key, err := action.Key(); err != nil || key != task.actionKey {
+		return true
+	}
+	for _, output := range action.Outputs {
+		if _, err := os.Stat(output); err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+/* Puts every task that must run again back into the new state. */
+func (s *Session) invalidate(manager *taskManager, buildFinalizers []Task) {
+	stale := make(map[*taskEntry]bool)
+	var pending []*taskEntry
+	mark := func(task *taskEntry) {
+		if !stale[task] {
+			stale[task] = true
+			pending = append(pending, task)
+		}
+	}
+	markTasks := func(tasks []Task) {
+		for _, task := range tasks {
+			if entry, ok := s.registry.lookup(task); ok {
+				mark(entry)
+			}
+		}
+	}
+	s.registry.forEach(func(task *taskEntry) {
+		if task.status == statusErrored || (task.status == statusComplete && actionChanged(task)) {
+			mark(task)
+		}
+	})
+	markTasks(buildFinalizers)
+	for len(pending) > 0 {
+		task := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for _, edge := range task.dependents {
+			mark(edge.task)
+		}
+		/* Finalizers only run again if they are new, so they must be reset along with their task. */
+		markTasks(task.finalizers)
+	}
+
+	s.registry.forEach(func(task *taskEntry) {
+		/* Stale tasks declare their dependencies again when they run. */
+		dependents := task.dependents[:0]
+		for _, edge := range task.dependents {
+			if !stale[edge.task] {
+				dependents = append(dependents, edge)
+			}
+		}
+		task.dependents = dependents
+	})
+	for task := range stale {
+		if task.status != statusNew {
+			/* Tasks that never ran, such as the finalizers of a cancelled build, are already new. */
+			manager.setStatus(task, statusNew)
+		}
+		task.reset()
+	}
+}
+
+/* Returns the inputs of the actions of the tasks that have run in the session, other than files which are
+outputs of those actions. These are the files that may be changed to cause the next build to run tasks again.
+Paths are cleaned and sorted. */
+func (s *Session) Inputs() []string {
+	inputs, outputs := make(map[string]bool), make(map[string]bool)
+	s.registry.forEach(func(task *taskEntry) {
+		action, ok := task.lastAction()
+		if !ok || task.status == statusNew {
+			return
+		}
+		all, err := action.AllInputs()
+		if err != nil {
+			/* The depfile is unreadable, so the task will run again anyway, and its own inputs will do until then. */
+			all = action.Inputs
+		}
+		for _, input := range all {
+			inputs[filepath.Clean(input)] = true
+		}
+		for _, output := range action.Outputs {
+			outputs[filepath.Clean(output)] = true
+		}
+	})
+	sources := make([]string, 0, len(inputs))
+	for input := range inputs {
+		if !outputs[input] {
+			sources = append(sources, input)
+		}
+	}
+	sort.Strings(sources)
+	return sources
+}
@@ -0,0 +1,101 @@
+package nbt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, `source`)
+	generated, output := filepath.Join(dir, `generated`), filepath.Join(dir, `output`)
+	os.WriteFile(source, []byte(`first`), 0o644)
+	generate := newCopyTask(source, generated)
+	copy := newCopyTask(generated, output, generate)
+	unrelated := newFuncTask(`unrelated`, nil)
+	flaky := newFuncTask(`flaky`, func(Handler) error {
+		if _, err := os.Stat(filepath.Join(dir, `fixed`)); err != nil {
+			return errors.New(`not fixed yet`)
+		}
+		return nil
+	})
+	root := newFuncTask(`root`, func(h Handler) error {
+		h.RequireAll(copy, unrelated)
+		h.RequireWith(EdgeOrderOnly, flaky)
+		return nil
+	})
+	finalizer := newFuncTask(`finalizer`, nil)
+
+	session := NewSession(false)
+	/* Builds the root, checking that the build fails only if the flaky task has not been fixed. */
+	build := func(t *testing.T) (invalidated []Task) {
+		t.Helper()
+		result := session.Build(root, Options{MaxParallelTasks: 4, Finalizers: []Task{finalizer}, OnEvent: func(e Event) {
+			if e.Kind == EventInvalidated {
+				invalidated = append(invalidated, e.Task)
+			}
+		}})
+		_, err := os.Stat(filepath.Join(dir, `fixed`))
+		if fixed := err == nil; fixed != result.Succeeded() || (!fixed && (len(result.Failed) != 1 || result.Failed[0].Task != flaky)) {
+			t.Fatal(`unexpected failures: `, result.Failed)
+		}
+		return
+	}
+	expectRuns := func(t *testing.T, expected map[*funcTask]int32) {
+		t.Helper()
+		for task, runs := range expected {
+			if actual := task.runs.Load(); actual != runs {
+				t.Errorf(`%v ran %d times, expected %d`, task, actual, runs)
+			}
+		}
+	}
+
+	build(t)
+	expectRuns(t, map[*funcTask]int32{root: 1, generate.funcTask: 1, copy.funcTask: 1, unrelated: 1, flaky: 1, finalizer: 1})
+	/* The generated file is an input of the copy, but it is also an output, so only the source is given. */
+	if inputs := session.Inputs(); len(inputs) != 1 || inputs[0] != source {
+		t.Errorf(`unexpected inputs %q`, inputs)
+	}
+
+	t.Run(`nothing changed`, func(t *testing.T) {
+		build(t)
+		/* Only the failed task, its dependent and the build finalizer run again. */
+		expectRuns(t, map[*funcTask]int32{root: 2, generate.funcTask: 1, copy.funcTask: 1, unrelated: 1, flaky: 2, finalizer: 2})
+	})
+
+	t.Run(`changed input`, func(t *testing.T) {
+		os.WriteFile(source, []byte(`second`), 0o644)
+		os.WriteFile(filepath.Join(dir, `fixed`), nil, 0o644)
+		invalidated := build(t)
+		expectRuns(t, map[*funcTask]int32{root: 3, generate.funcTask: 2, copy.funcTask: 2, unrelated: 1, flaky: 3, finalizer: 3})
+		if data, _ := os.ReadFile(output); string(data) != `second` {
+			t.Errorf(`unexpected output %q`, data)
+		}
+		/* The changed task, its dependents, the failed task and the build finalizer. */
+		if len(invalidated) != 5 {
+			t.Errorf(`unexpected invalidated tasks %v`, invalidated)
+		}
+	})
+
+	t.Run(`missing output`, func(t *testing.T) {
+		os.Remove(output)
+		build(t)
+		expectRuns(t, map[*funcTask]int32{root: 4, generate.funcTask: 2, copy.funcTask: 3, unrelated: 1, flaky: 3, finalizer: 4})
+		if _, err := os.Stat(output); err != nil {
+			t.Error(`output was not rebuilt: `, err)
+		}
+	})
+
+	t.Run(`changed main task`, func(t *testing.T) {
+		other := newFuncTask(`other`, func(h Handler) error {
+			h.RequireAndWait(copy, unrelated)
+			return nil
+		})
+		if result := session.Build(other, Options{MaxParallelTasks: 4}); !result.Succeeded() {
+			t.Fatal(`build failed: `, result.Failed)
+		}
+		expectRuns(t, map[*funcTask]int32{other: 1, root: 4, copy.funcTask: 3, unrelated: 1})
+	})
+}
@@ -0,0 +1,182 @@
+package nbt
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gitlab.com/kyle_anderson/nbt/internal/atomicfile"
+)
+
+/* How a build decides that the outputs of the action of a task are up to date,
+in which case the task is skipped. Only tasks implementing CacheableTask are ever skipped. */
+type Staleness uint
+
+const (
+	/* Tasks are always performed. */
+	StalenessNone Staleness = iota
+	/* Like make, the outputs are up to date if they all exist and each of them is newer than every input.
+	Outputs with the same modification time as an input are taken to be out of date. */
+	StalenessModTime
+	/* The outputs are up to date if the key of the action and the contents of the outputs are the same as when
+	the build last wrote them, as recorded in Options.StateFile. Slower than StalenessModTime, since every input
+	and output is read, but reliable on filesystems with coarse modification times and when files are touched
+	without being changed. */
+	StalenessHash
+)
+
+func (s Staleness) String() (name string) {
+	switch s {
+	case StalenessNone:
+		name = "None"
+	case StalenessModTime:
+		name = "ModTime"
+	case StalenessHash:
+		name = "Hash"
+	default:
+		name = "ERROR - UNKNOWN STALENESS"
+	}
+	return
+}
+
+/* The state file used with StalenessHash when Options.StateFile is empty. */
+const DefaultStateFile = ".nbt/state.json"
+
+/* Returns true if every output of the action exists and is newer than every input. */
+func newerOutputs(action *ActionSpec) bool {
+	if len(action.Outputs) <= 0 {
+		return false
+	}
+	var oldestOutput os.FileInfo
+	for _, output := range action.Outputs {
+		info, err := os.Stat(output)
+		if err != nil {
+			return false
+		}
+		if oldestOutput == nil || info.ModTime().Before(oldestOutput.ModTime()) {
+			oldestOutput = info
+		}
+	}
+	inputs, err := action.AllInputs()
+	if err != nil {
+		return false
+	}
+	for _, input := range inputs {
+		info, err := os.Stat(input)
+		if err != nil || !oldestOutput.ModTime().After(info.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+/* What the build last recorded about an action. */
+type actionState struct {
+	Key string `json:"key"`
+	/* Digests of the outputs, by path. */
+	Outputs map[string]string `json:"outputs"`
+}
+
+/* The actions recorded by builds using StalenessHash, kept in a file between builds. */
+type buildState struct {
+	path string
+	mu   sync.Mutex
+	/* Indexed by the outputs of the actions, since those identify an action from one build to the next. */
+	actions map[string]actionState
+}
+
+/* Reads the state at the given path. A missing file gives an empty state. */
+func loadBuildState(path string) (*buildState, error) {
+	state := &buildState{path: path, actions: make(map[string]actionState)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(data, &state.actions)
+}
+
+func stateIndex(outputs []string) string {
+	cleaned := make([]string, len(outputs))
+	for i, output := range outputs {
+		cleaned[i] = filepath.Clean(output)
+	}
+	return strings.Join(cleaned, "\x00")
+}
+
+/* Returns true if the action was last recorded with the given key, and its outputs have not changed since. */
+func (s *buildState) upToDate(key string, outputs []string) bool {
+	if len(outputs) <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	recorded, ok := s.actions[stateIndex(outputs)]
+	s.mu.Unlock()
+	if !ok || recorded.Key != key {
+		return false
+	}
+	for _, output := range outputs {
+		if digest, err := fileDigest(output); err != nil || digest != recorded.Outputs[filepath.Clean(output)] {
+			return false
+		}
+	}
+	return true
+}
+
+/* Records that the outputs of the action with the given key were just written. */
+func (s *buildState) record(key string, outputs []string) error {
+	recorded := actionState{Key: key, Outputs: make(map[string]string, len(outputs))}
+	for _, output := range outputs {
+		digest, err := fileDigest(output)
+		if err != nil {
+			return err
+		}
+		recorded.Outputs[filepath.Clean(output)] = digest
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.actions[stateIndex(outputs)] = recorded
+	return nil
+}
+
+/* Writes the state back to its file. */
+func (s *buildState) save() error {
+	s.mu.Lock()
+	data, err := json.Marshal(s.actions)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.path, data, 0o644)
+}
+
+/* Sets up the state of the pool for the staleness mode of the build.
+Returns a function saving the state, to be called once the build is over. */
+func (p *workerPool) useStaleness(options *Options) (save func()) {
+	p.staleness = options.Staleness
+	if options.Staleness != StalenessHash {
+		return func() {}
+	}
+	path := options.StateFile
+	if path == "" {
+		path = DefaultStateFile
+	}
+	state, err := loadBuildState(path)
+	if err != nil {
+		/* Every task runs, and the state is rewritten from scratch. */
+		log.Printf("nbt: ignoring the unreadable state file %q: %v\n", path, err)
+		state.actions = make(map[string]actionState)
+	}
+	p.state = state
+	return func() {
+		if err := state.save(); err != nil {
+			log.Printf("nbt: failed to save the state file %q: %v\n", path, err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package nbt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaleness(t *testing.T) {
+	/* A change made to the files between builds. */
+	type change func(t *testing.T, input, output string)
+	/* Picks the input or the output by name. */
+	pick := func(name, input, output string) string {
+		if name == `input` {
+			return input
+		}
+		return output
+	}
+	touch := func(name string, offset time.Duration) change {
+		return func(t *testing.T, input, output string) {
+			path := pick(name, input, output)
+			stamp := time.Now().Add(offset)
+			if err := os.Chtimes(path, stamp, stamp); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write := func(name, data string) change {
+		return func(t *testing.T, input, output string) {
+			path := pick(name, input, output)
+			if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	remove := func(t *testing.T, input, output string) { os.Remove(output) }
+	sameTime := func(t *testing.T, input, output string) {
+		info, err := os.Stat(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(output, info.ModTime(), info.ModTime())
+	}
+	tests := []struct {
+		staleness Staleness
+		change    change
+		performed bool
+	}{
+		{StalenessNone, nil, true},
+		{StalenessModTime, nil, false},
+		{StalenessModTime, touch(`input`, time.Hour), true},
+		/* Equal times are out of date, since coarse times cannot tell which was written first. */
+		{StalenessModTime, sameTime, true},
+		{StalenessHash, sameTime, false},
+		{StalenessModTime, remove, true},
+		{StalenessHash, nil, false},
+		{StalenessHash, touch(`input`, time.Hour), false},
+		{StalenessHash, write(`input`, `changed`), true},
+		{StalenessHash, write(`output`, `tampered`), true},
+		{StalenessHash, remove, true},
+	}
+	for i, test := range tests {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			dir := t.TempDir()
+			input, output := filepath.Join(dir, `input`), filepath.Join(dir, `output`)
+			os.WriteFile(input, []byte(`first`), 0o644)
+			/* Sets the input well in the past, so that the output written by the first build is newer. */
+			touch(`input`, -2*time.Hour)(t, input, output)
+			options := Options{MaxParallelTasks: 1, Staleness: test.staleness, StateFile: filepath.Join(dir, `state`, `state.json`)}
+			if result := StartWithOptions(newCopyTask(input, output), options); !result.Succeeded() {
+				t.Fatal(`first build failed: `, result.Failed)
+			}
+			if test.change != nil {
+				test.change(t, input, output)
+			}
+			task := newCopyTask(input, output)
+			if result := StartWithOptions(task, options); !result.Succeeded() {
+				t.Fatal(`second build failed: `, result.Failed)
+			}
+			if performed := task.runs.Load() > 0; performed != test.performed {
+				t.Errorf(`performed: %v, expected %v`, performed, test.performed)
+			}
+			inputData, _ := os.ReadFile(input)
+			if outputData, err := os.ReadFile(output); err != nil || string(outputData) != string(inputData) {
+				t.Errorf(`output %q, %v, expected %q`, outputData, err, inputData)
+			}
+		})
+	}
+}
+
+func TestStateFileUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	input, output, stateFile := filepath.Join(dir, `input`), filepath.Join(dir, `output`), filepath.Join(dir, `state.json`)
+	os.WriteFile(input, []byte(`data`), 0o644)
+	os.WriteFile(stateFile, []byte(`not json`), 0o644)
+	logs := captureLog(t)
+	options := Options{MaxParallelTasks: 1, Staleness: StalenessHash, StateFile: stateFile}
+	task := newCopyTask(input, output)
+	if result := StartWithOptions(task, options); !result.Succeeded() || task.runs.Load() != 1 {
+		t.Fatal(`unexpected result: `, result.Failed)
+	}
+	if !strings.Contains(logs.String(), `ignoring the unreadable state file`) {
+		t.Errorf(`expected a warning, got %q`, logs)
+	}
+	/* The state is rewritten, so the next build is up to date. */
+	task = newCopyTask(input, output)
+	if result := StartWithOptions(task, options); !result.Succeeded() || task.runs.Load() != 0 {
+		t.Error(`expected the task to be skipped, result: `, result.Failed)
+	}
+}
+
+func TestDepfileInputs(t *testing.T) {
+	for _, staleness := range []Staleness{StalenessModTime, StalenessHash} {
+		staleness := staleness // Capture
+		t.Run(staleness.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			source, header := filepath.Join(dir, `hello.c`), filepath.Join(dir, `hello.h`)
+			object, deps := filepath.Join(dir, `hello.o`), filepath.Join(dir, `hello.d`)
+			os.WriteFile(source, []byte(`#include "hello.h"`), 0o644)
+			os.WriteFile(header, []byte(`first`), 0o644)
+			/* Sets the times of the files explicitly, since file times may be too coarse to order them. */
+			at := func(offset time.Duration, paths ...string) {
+				for _, path := range paths {
+					os.Chtimes(path, time.Now().Add(offset), time.Now().Add(offset))
+				}
+			}
+			at(-2*time.Hour, source, header)
+			/* Compiles the source like a compiler given -MD -MF, only listing the header in the depfile. */
+			compile := func() *copyTask {
+				task := newCopyTask(header, object)
+				task.action = ActionSpec{Inputs: []string{source}, Outputs: []string{object, deps}, Depfile: deps}
+				perform := task.perform
+				task.perform = func(h Handler) error {
+					if err := perform(h); err != nil {
+						return err
+					}
+					return os.WriteFile(deps, []byte(object+": "+source+" \\\n "+header+"\n"), 0o644)
+				}
+				return task
+			}
+			options := Options{MaxParallelTasks: 1, Staleness: staleness, StateFile: filepath.Join(dir, `state.json`)}
+			for i, step := range []struct {
+				change    func()
+				performed bool
+			}{
+				{nil, true},
+				{nil, false},
+				{func() {
+					os.WriteFile(header, []byte(`second`), 0o644)
+					at(-70*time.Minute, header)
+				}, true},
+				{nil, false},
+			} {
+				if step.change != nil {
+					step.change()
+				}
+				task := compile()
+				if result := StartWithOptions(task, options); !result.Succeeded() {
+					t.Fatalf(`build %d failed: %v`, i, result.Failed)
+				}
+				if performed := task.runs.Load() > 0; performed != step.performed {
+					t.Errorf(`build %d performed: %v, expected %v`, i, performed, step.performed)
+				}
+				if step.performed {
+					/* Outputs are newer than the inputs of their build, but older than any later change. */
+					at(-2*time.Hour+time.Duration(i+1)*30*time.Minute, object, deps)
+				}
+			}
+			action := compile().Action()
+			if inputs, err := action.AllInputs(); err != nil || !reflect.DeepEqual(inputs, []string{source, header}) {
+				t.Errorf(`inputs %q, %v`, inputs, err)
+			}
+		})
+	}
+}
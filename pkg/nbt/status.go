@@ -0,0 +1,59 @@
+package nbt
+
+/* The statuses that a task may move to from each status. Finished tasks only go back to being new
+when a session invalidates them between builds. */
+var statusTransitions = map[taskStatus][]taskStatus{
+	statusNew:      {statusRunning, statusErrored},
+	statusRunning:  {statusWaiting, statusComplete, statusErrored},
+	statusWaiting:  {statusRunning, statusErrored},
+	statusComplete: {statusNew},
+	statusErrored:  {statusNew},
+}
+
+func canTransition(from, to taskStatus) bool {
+	for _, allowed := range statusTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+/* Moves the task to the given status, keeping the count of executing tasks up to date and notifying the
+event listener. This is the only place the status of a task should be changed. Panics if the transition is not
+allowed, since that can only be caused by a bug in the manager. */
+func (tm *taskManager) setStatus(task *taskEntry, to taskStatus) {
+	from := task.status
+	if !canTransition(from, to) {
+		panic(&errInvalidTransition{task, from, to})
+	}
+	if from == statusRunning {
+		tm.numExecuting--
+	}
+	if to == statusRunning {
+		tm.numExecuting++
+	}
+	task.status = to
+	if tm.onEvent != nil {
+		tm.onEvent(Event{task.Task, eventKind(from, to), task.err})
+	}
+}
+
+/* Returns the kind of event for a valid transition. */
+func eventKind(from, to taskStatus) EventKind {
+	switch to {
+	case statusRunning:
+		if from == statusWaiting {
+			return EventResumed
+		}
+		return EventStarted
+	case statusWaiting:
+		return EventWaiting
+	case statusComplete:
+		return EventCompleted
+	case statusNew:
+		return EventInvalidated
+	default:
+		return EventFailed
+	}
+}
@@ -0,0 +1,104 @@
+package nbt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSetStatus(t *testing.T) {
+	for i, test := range []struct {
+		from, to taskStatus
+		valid    bool
+		/* Expected count of executing tasks after the transition, starting from the count implied by `from`. */
+		executing uint
+	}{
+		{statusNew, statusRunning, true, 1},
+		{statusNew, statusErrored, true, 0},
+		{statusRunning, statusWaiting, true, 0},
+		{statusRunning, statusComplete, true, 0},
+		{statusRunning, statusErrored, true, 0},
+		{statusWaiting, statusRunning, true, 1},
+		{statusWaiting, statusErrored, true, 0},
+		{statusNew, statusWaiting, false, 0},
+		{statusNew, statusComplete, false, 0},
+		{statusWaiting, statusComplete, false, 0},
+		{statusComplete, statusNew, true, 0},
+		{statusErrored, statusNew, true, 0},
+		{statusComplete, statusRunning, false, 0},
+		{statusErrored, statusRunning, false, 0},
+		{statusErrored, statusErrored, false, 0},
+	} {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			tm := newTaskManager(false)
+			task := newTaskEntry(&identityTask{})
+			task.status = test.from
+			if test.from == statusRunning {
+				tm.numExecuting = 1
+			}
+			var events []Event
+			tm.onEvent = func(e Event) { events = append(events, e) }
+
+			var recovered interface{}
+			func() {
+				defer func() { recovered = recover() }()
+				tm.setStatus(task, test.to)
+			}()
+			if test.valid {
+				if recovered != nil {
+					t.Fatal(`unexpected panic: `, recovered)
+				}
+				if task.status != test.to {
+					t.Errorf(`status is %v, expected %v`, task.status, test.to)
+				}
+				if len(events) != 1 {
+					t.Errorf(`expected one event, got %v`, events)
+				}
+			} else {
+				err, ok := recovered.(*errInvalidTransition)
+				if !ok {
+					t.Fatalf(`expected a panic with an invalid transition error, got %v`, recovered)
+				}
+				if message := err.Error(); !strings.Contains(message, test.from.String()) || !strings.Contains(message, test.to.String()) {
+					t.Errorf(`error %q does not name both statuses`, message)
+				}
+				if task.status != test.from {
+					t.Errorf(`status changed to %v by an invalid transition`, task.status)
+				}
+				if len(events) != 0 {
+					t.Errorf(`unexpected events for an invalid transition: %v`, events)
+				}
+			}
+			if tm.numExecuting != test.executing {
+				t.Errorf(`numExecuting is %d, expected %d`, tm.numExecuting, test.executing)
+			}
+		})
+	}
+}
+
+func TestEvents(t *testing.T) {
+	errFailed := errors.New(`failed`)
+	dependency := newFuncTask(`dependency`, nil)
+	failing := newFuncTask(`failing`, func(Handler) error { return errFailed })
+	main := newFuncTask(`main`, func(h Handler) error {
+		h.RequireAndWait(dependency)
+		h.RequireAndWait(failing)
+		return nil
+	})
+	var events []string
+	StartWithOptions(main, Options{MaxParallelTasks: 1, OnEvent: func(e Event) {
+		events = append(events, fmt.Sprint(e.Task, ` `, e.Kind))
+		if e.Kind == EventFailed && e.Err == nil {
+			t.Errorf(`failure event for %v has no error`, e.Task)
+		}
+	}})
+	expected := []string{
+		`main Started`, `main Waiting`, `dependency Started`, `dependency Completed`, `main Resumed`,
+		`main Waiting`, `failing Started`, `failing Failed`, `main Failed`,
+	}
+	if strings.Join(events, `, `) != strings.Join(expected, `, `) {
+		t.Errorf("unexpected events:\n%v\nexpected:\n%v", events, expected)
+	}
+}
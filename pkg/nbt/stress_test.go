@@ -0,0 +1,118 @@
+package nbt
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+/* Randomized tests of the manager's state machine. These are most useful when run with -race. */
+
+/* Computes which tasks of the graph are expected to run and which are expected to succeed.
+Since tasks only require a group of dependencies once they have successfully waited for the previous
+groups, both are determined by the graph alone, regardless of how the tasks are scheduled. */
+func expectedOutcomes(g *synthGraph) (ran, succeeded map[*synthTask]bool) {
+	ran, succeeded = make(map[*synthTask]bool), make(map[*synthTask]bool)
+	var visit func(*synthTask) bool
+	visit = func(task *synthTask) bool {
+		if ran[task] {
+			return succeeded[task]
+		}
+		ran[task] = true
+		success := true
+		for _, group := range task.groups {
+			for _, dependency := range group {
+				if !visit(dependency) {
+					success = false
+				}
+			}
+			if !success {
+				break
+			}
+		}
+		succeeded[task] = success && !task.fails
+		return succeeded[task]
+	}
+	visit(g.root())
+	return
+}
+
+/* Checks the manager's counters against the state of the tasks it knows about. */
+func checkCounters(tm *taskManager, maxParallelTasks uint) error {
+	var executing uint
+	tm.registry.forEach(func(task *taskEntry) {
+		if task.status == statusRunning {
+			executing++
+		}
+	})
+	switch {
+	case tm.numExecuting != executing:
+		return fmt.Errorf(`numExecuting is %d but %d tasks are running`, tm.numExecuting, executing)
+	case tm.numExecuting > maxParallelTasks:
+		return fmt.Errorf(`%d tasks executing with a limit of %d`, tm.numExecuting, maxParallelTasks)
+	}
+	return nil
+}
+
+func TestStress(t *testing.T) {
+	seeds := 40
+	if testing.Short() {
+		seeds = 5
+	}
+	for seed := 0; seed < seeds; seed++ {
+		for _, jobs := range []uint{1, 2, 3, 4, 8, 16} {
+			seed, jobs := seed, jobs // Capture
+			t.Run(fmt.Sprintf(`seed %d j%d`, seed, jobs), func(t *testing.T) {
+				t.Parallel()
+				r := rand.New(rand.NewSource(int64(seed)))
+				g := randomDAG(r, 60, 3).randomizeWaits(r).injectFailures(r, 0.2*r.Float64())
+				g.track = true
+
+				manager := newTaskManager(false)
+				var counterErr error
+				manager.onStep = func() {
+					if err := checkCounters(manager, jobs); err != nil && counterErr == nil {
+						counterErr = err
+					}
+				}
+				done := make(chan *Result)
+				go func() { done <- manager.execute(g.root(), Options{MaxParallelTasks: jobs}) }()
+				var result *Result
+				select {
+				case result = <-done:
+				case <-time.After(10 * time.Second):
+					t.Fatal(`the build did not terminate`)
+				}
+
+				if counterErr != nil {
+					t.Error(counterErr)
+				}
+				if manager.numExecuting != 0 {
+					t.Errorf(`%d tasks still executing at the end of the build`, manager.numExecuting)
+				}
+				for _, violation := range g.violations {
+					t.Error(violation)
+				}
+				ran, succeeded := expectedOutcomes(g)
+				failed := make(map[Task]bool, len(result.Failed))
+				for _, taskResult := range result.Failed {
+					if failed[taskResult.Task] {
+						t.Errorf(`%v reported as failed more than once`, taskResult.Task)
+					}
+					failed[taskResult.Task] = true
+				}
+				for _, task := range g.tasks {
+					if runs := task.runs.Load(); runs > 1 {
+						t.Errorf(`%v ran %d times`, task, runs)
+					} else if (runs == 1) != ran[task] {
+						t.Errorf(`%v ran %d times, expected to run: %v`, task, runs, ran[task])
+					}
+					if ran[task] && failed[task] == succeeded[task] {
+						t.Errorf(`%v failed: %v, expected to succeed: %v`, task, failed[task], succeeded[task])
+					}
+				}
+			})
+		}
+	}
+}
@@ -4,16 +4,36 @@ import (
 	"gitlab.com/kyle_anderson/go-utils/pkg/set"
 )
 
-/* TODO would like it if the taskEntry struct could have some real private members.
-Status should only be set through the setStatus method. */
+/* The status of a task must only be changed through (*taskManager).setStatus. */
 type taskEntry struct {
 	Task
-	/* Slice of tasks that are dependent and still waiting on this task. */
-	dependents []*taskEntry
+	/* Edges to the tasks that have declared a dependency on this task. */
+	dependents []dependentEdge
 	/* Tasks upon which this task depends. */
 	dependencies set.Set[*taskEntry]
-	status       taskStatus
-	handler      *chanHandler[*taskEntry]
+	/* Incomplete tasks which this task is waiting for, a subset of its dependencies.
+	Nil when the task is waiting for all of its dependencies. */
+	awaited set.Set[*taskEntry]
+	status  taskStatus
+	/* The handler of the current run of the task. A new handler is created for each run, since the goroutine
+	of an aborted run may still be unwinding when the task is run again by a later build. */
+	handler *chanHandler[*taskEntry]
+	/* True while the task is in the manager's task queue. */
+	queued bool
+	/* The reason the task failed, if it is in the errored state. */
+	err error
+	/* Tasks to run once this task has finished, whether or not it succeeded. */
+	finalizers []Task
+	/* True if the task is being run as a finalizer. */
+	isFinalizer bool
+	/* Name of the lock that is preventing the task from being started, if any. */
+	blockedOn string
+	/* Key of the task's action when it was last run, if recorded. Only written by the worker running the task. */
+	actionKey string
+	/* Inputs listed by the ListInputs of the task's action when it was last run. Kept when the task is reset,
+	for the session to find the inputs of the task without listing them again. Only written by the worker running
+	the task. */
+	listedInputs []string
 
 	onWaitingHooks []func(*taskEntry)
 }
@@ -21,17 +41,63 @@ type taskEntry struct {
 func newTaskEntry(t Task) *taskEntry {
 	return &taskEntry{
 		Task:         t,
-		dependents:   make([]*taskEntry, 0),
+		dependents:   make([]dependentEdge, 0),
 		dependencies: set.NewComparable[*taskEntry](),
 		status:       statusNew,
 	}
 }
 
+/* Forgets everything learnt about the task from running it, so that it can be run again. */
+func (te *taskEntry) reset() {
+	te.dependencies = set.NewComparable[*taskEntry]()
+	te.awaited = nil
+	te.handler = nil
+	te.err = nil
+	te.finalizers = nil
+	te.isFinalizer = false
+	te.actionKey = ""
+	te.onWaitingHooks = nil
+}
+
+/* Returns the action of the task with the inputs listed when it last ran, or false if the task has no action. */
+func (te *taskEntry) lastAction() (ActionSpec, bool) {
+	cacheable, ok := te.Task.(CacheableTask)
+	if !ok {
+		return ActionSpec{}, false
+	}
+	action := cacheable.Action()
+	if action.ListInputs != nil {
+		action = action.withListed(te.listedInputs)
+	}
+	return action, true
+}
+
 /* Returns true if this task is ready to execute, when all of its dependencies have been met, false otherwise. */
 func (te *taskEntry) IsReady() bool {
+	if te.awaited != nil {
+		return te.awaited.Size() <= 0
+	}
 	return te.dependencies.Size() <= 0
 }
 
+/* Returns true if the task has finished executing, whether it succeeded or not. */
+func (te *taskEntry) isFinished() bool {
+	return te.status == statusComplete || te.status == statusErrored
+}
+
+/* Returns true if the task has been scheduled for execution at some point. */
+func (te *taskEntry) isTriggered() bool {
+	return te.status != statusNew || te.queued || te.blockedOn != ""
+}
+
+/* Records that the given dependency is complete. */
+func (te *taskEntry) removeDependency(dependency *taskEntry) {
+	te.dependencies.Remove(dependency)
+	if te.awaited != nil {
+		te.awaited.Remove(dependency)
+	}
+}
+
 /* Adds a callback to be executed when this task next goes into the waiting state.
 If the task is currently in the waiting state, then the callback won't be executed until the task
 exits this state and re-enters it.
@@ -52,6 +118,12 @@ func (te *taskEntry) fireCallbacks(callbacks *[]func(*taskEntry)) {
 	}
 }
 
+/* An edge from a dependency to one of its dependents. */
+type dependentEdge struct {
+	task *taskEntry
+	kind EdgeKind
+}
+
 type taskStatus uint
 
 const (
@@ -0,0 +1,129 @@
+/*
+nbttest: Utilities for testing tasks and build logic without real concurrency.
+Provides a Recorder, a fake handler which records the requests made by a task,
+and Run, which builds a graph of tasks with the real manager one task at a time in a reproducible order.
+*/
+package nbttest
+
+import "gitlab.com/kyle_anderson/nbt/pkg/nbt"
+
+/* The kind of a request made through a handler. */
+type CallKind uint
+
+const (
+	CallRequire CallKind = iota
+	CallWait
+	CallWaitFor
+	CallResolve
+	CallFinally
+)
+
+func (k CallKind) String() (name string) {
+	switch k {
+	case CallRequire:
+		name = "Require"
+	case CallWait:
+		name = "Wait"
+	case CallWaitFor:
+		name = "WaitFor"
+	case CallResolve:
+		name = "Resolve"
+	case CallFinally:
+		name = "Finally"
+	default:
+		name = "ERROR - UNKNOWN CALL KIND"
+	}
+	return
+}
+
+/* A request made through a handler. */
+type Call struct {
+	Kind  CallKind
+	Tasks []nbt.Task
+	/* The kind of edge, for requirements. */
+	Edge nbt.EdgeKind
+}
+
+/* A fake handler which records every request made through it. Waiting returns immediately.
+The zero value is ready to use. */
+type Recorder struct {
+	Calls []Call
+	/* Called to resolve tasks. If nil, tasks resolve to themselves. */
+	OnResolve func(nbt.Task) nbt.Task
+}
+
+func (r *Recorder) record(kind CallKind, edge nbt.EdgeKind, tasks []nbt.Task) {
+	r.Calls = append(r.Calls, Call{kind, tasks, edge})
+}
+
+func (r *Recorder) Require(task nbt.Task)        { r.RequireAll(task) }
+func (r *Recorder) RequireAll(tasks ...nbt.Task) { r.RequireWith(nbt.EdgeRequired, tasks...) }
+func (r *Recorder) Wait()                        { r.record(CallWait, nbt.EdgeRequired, nil) }
+func (r *Recorder) Finally(tasks ...nbt.Task)    { r.record(CallFinally, nbt.EdgeRequired, tasks) }
+
+func (r *Recorder) RequireAndWait(tasks ...nbt.Task) {
+	r.RequireAll(tasks...)
+	r.Wait()
+}
+
+/* Records the requirement of the tasks which were not already required, as a real handler would make it,
+followed by the wait. */
+func (r *Recorder) WaitFor(tasks ...nbt.Task) {
+	var unrequired []nbt.Task
+	for _, task := range tasks {
+		if !r.required(task) {
+			unrequired = append(unrequired, task)
+		}
+	}
+	if len(unrequired) > 0 {
+		r.RequireAll(unrequired...)
+	}
+	r.record(CallWaitFor, nbt.EdgeRequired, tasks)
+}
+
+/* Returns true if the task has been required with any kind of edge. */
+func (r *Recorder) required(task nbt.Task) bool {
+	for _, call := range r.Calls {
+		if call.Kind != CallRequire {
+			continue
+		}
+		for _, t := range call.Tasks {
+			if t.Hash() == task.Hash() && t.Matches(task) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Recorder) RequireWith(edge nbt.EdgeKind, tasks ...nbt.Task) {
+	r.record(CallRequire, edge, tasks)
+}
+
+func (r *Recorder) Resolve(task nbt.Task) nbt.Task {
+	r.record(CallResolve, nbt.EdgeRequired, []nbt.Task{task})
+	if r.OnResolve != nil {
+		return r.OnResolve(task)
+	}
+	return task
+}
+
+/* Returns every task that was required with the given kind of edge, in the order that they were required. */
+func (r *Recorder) Required(edge nbt.EdgeKind) (tasks []nbt.Task) {
+	for _, call := range r.Calls {
+		if call.Kind == CallRequire && call.Edge == edge {
+			tasks = append(tasks, call.Tasks...)
+		}
+	}
+	return
+}
+
+/* Returns the number of times the task waited, with either Wait or WaitFor. */
+func (r *Recorder) Waits() (count int) {
+	for _, call := range r.Calls {
+		if call.Kind == CallWait || call.Kind == CallWaitFor {
+			count++
+		}
+	}
+	return
+}
@@ -0,0 +1,132 @@
+package nbttest
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* Record of everything that happened during a build started by Run. */
+type Trace struct {
+	/* The changes in the status of tasks, in the order that they happened. */
+	Events []nbt.Event
+	Result *nbt.Result
+}
+
+/* Builds the given task with the manager of the nbt package, one task at a time. Whenever more than one task
+could run, one of them is picked at random using the seed, so a given seed always produces the same order of tasks.
+Returns a trace of what happened. */
+func Run(root nbt.Task, seed int64) *Trace {
+	return RunWithOptions(root, seed, nbt.Options{})
+}
+
+/* Like Run, but builds with the given options, such as to use locks or finalizers.
+MaxParallelTasks and ChooseNext are overridden, and OnEvent is still called. */
+func RunWithOptions(root nbt.Task, seed int64, options nbt.Options) *Trace {
+	trace := &Trace{}
+	r := rand.New(rand.NewSource(seed))
+	onEvent := options.OnEvent
+	options.MaxParallelTasks = 1
+	options.ChooseNext = r.Intn
+	options.OnEvent = func(event nbt.Event) {
+		trace.Events = append(trace.Events, event)
+		if onEvent != nil {
+			onEvent(event)
+		}
+	}
+	trace.Result = nbt.StartWithOptions(root, options)
+	return trace
+}
+
+func sameTask(a, b nbt.Task) bool {
+	return a.Hash() == b.Hash() && a.Matches(b)
+}
+
+/* Returns the index of the first event of the given kind for the task, or -1 if there is none. */
+func (tr *Trace) index(task nbt.Task, kind nbt.EventKind) int {
+	for i, event := range tr.Events {
+		if event.Kind == kind && sameTask(event.Task, task) {
+			return i
+		}
+	}
+	return -1
+}
+
+/* Returns true if the task was started. */
+func (tr *Trace) Ran(task nbt.Task) bool {
+	return tr.index(task, nbt.EventStarted) >= 0
+}
+
+/* Returns the index of the event at which the task finished, successfully or not, or -1 if it never finished. */
+func (tr *Trace) finished(task nbt.Task) int {
+	if i := tr.index(task, nbt.EventCompleted); i >= 0 {
+		return i
+	}
+	return tr.index(task, nbt.EventFailed)
+}
+
+/* Returns true if both tasks finished, and `first` finished before `second`.
+Since tasks are started before the tasks they require, this compares when tasks finish rather than start. */
+func (tr *Trace) RanBefore(first, second nbt.Task) bool {
+	firstFinished, secondFinished := tr.finished(first), tr.finished(second)
+	return firstFinished >= 0 && secondFinished >= 0 && firstFinished < secondFinished
+}
+
+/* Returns the error the task failed with, or nil if it did not fail. */
+func (tr *Trace) Err(task nbt.Task) error {
+	if i := tr.index(task, nbt.EventFailed); i >= 0 {
+		return tr.Events[i].Err
+	}
+	return nil
+}
+
+/* Returns true if the build succeeded. */
+func (tr *Trace) Succeeded() bool {
+	return tr.Result.Succeeded()
+}
+
+func (tr *Trace) String() string {
+	var b strings.Builder
+	for _, event := range tr.Events {
+		fmt.Fprintf(&b, "%v %v\n", event.Kind, event.Task)
+	}
+	return b.String()
+}
+
+/* Fails the test unless the task was run. */
+func (tr *Trace) AssertRan(t testing.TB, task nbt.Task) {
+	t.Helper()
+	if !tr.Ran(task) {
+		t.Errorf("task %v never ran, trace:\n%v", task, tr)
+	}
+}
+
+/* Fails the test if the task was run. */
+func (tr *Trace) AssertNeverRan(t testing.TB, task nbt.Task) {
+	t.Helper()
+	if tr.Ran(task) {
+		t.Errorf("task %v ran, trace:\n%v", task, tr)
+	}
+}
+
+/* Fails the test unless `first` finished before `second`. */
+func (tr *Trace) AssertRanBefore(t testing.TB, first, second nbt.Task) {
+	t.Helper()
+	if !tr.RanBefore(first, second) {
+		t.Errorf("task %v did not run before %v, trace:\n%v", first, second, tr)
+	}
+}
+
+/* Fails the test if any task failed. */
+func (tr *Trace) AssertSucceeded(t testing.TB) {
+	t.Helper()
+	for _, failed := range tr.Result.Failed {
+		t.Errorf("task %v failed: %v", failed.Task, failed.Err)
+	}
+	if tr.Result.Cancelled {
+		t.Error("the build was cancelled")
+	}
+}
@@ -0,0 +1,154 @@
+package nbttest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* A task identified by its name, which performs by calling `perform`. */
+type namedTask struct {
+	name    string
+	perform func(nbt.Handler) error
+}
+
+func (t *namedTask) Hash() uint64 { return uint64(len(t.name)) }
+func (t *namedTask) Matches(other nbt.Task) bool {
+	if converted, ok := other.(*namedTask); ok {
+		return converted.name == t.name
+	}
+	return false
+}
+func (t *namedTask) Perform(h nbt.Handler) error {
+	if t.perform == nil {
+		return nil
+	}
+	return t.perform(h)
+}
+func (t *namedTask) String() string { return t.name }
+
+func TestRun(t *testing.T) {
+	t.Run(`ordering`, func(t *testing.T) {
+		leaves := []nbt.Task{&namedTask{name: `a`}, &namedTask{name: `b`}, &namedTask{name: `c`}}
+		middle := &namedTask{name: `middle`, perform: func(h nbt.Handler) error {
+			h.RequireAndWait(leaves...)
+			return nil
+		}}
+		unused := &namedTask{name: `unused`}
+		root := &namedTask{name: `root`, perform: func(h nbt.Handler) error {
+			h.Resolve(unused)
+			h.RequireAndWait(middle)
+			return nil
+		}}
+		trace := Run(root, 1)
+		trace.AssertSucceeded(t)
+		for _, leaf := range leaves {
+			trace.AssertRanBefore(t, leaf, middle)
+		}
+		trace.AssertNeverRan(t, unused)
+	})
+
+	t.Run(`reproducible`, func(t *testing.T) {
+		run := func(seed int64) string {
+			var tasks []nbt.Task
+			for i := 0; i < 20; i++ {
+				tasks = append(tasks, &namedTask{name: fmt.Sprint(`task `, i)})
+			}
+			root := &namedTask{name: `root`, perform: func(h nbt.Handler) error {
+				h.RequireAndWait(tasks...)
+				return nil
+			}}
+			return Run(root, seed).String()
+		}
+		if run(7) != run(7) {
+			t.Error(`runs with the same seed produced different traces`)
+		}
+		if run(7) == run(8) {
+			t.Error(`runs with different seeds produced the same trace`)
+		}
+	})
+
+	t.Run(`failures`, func(t *testing.T) {
+		errFailed := errors.New(`failed`)
+		failing := &namedTask{name: `failing`, perform: func(nbt.Handler) error { return errFailed }}
+		ordered := &namedTask{name: `ordered`, perform: func(h nbt.Handler) error {
+			h.RequireWith(nbt.EdgeOrderOnly, failing)
+			h.Wait()
+			return nil
+		}}
+		var resumed bool
+		root := &namedTask{name: `root`, perform: func(h nbt.Handler) error {
+			h.RequireAndWait(ordered, failing)
+			resumed = true
+			return nil
+		}}
+		trace := Run(root, 3)
+		if resumed {
+			t.Error(`task resumed after its dependency failed`)
+		}
+		if err := trace.Err(ordered); err != nil {
+			t.Error(`order-only dependent failed: `, err)
+		}
+		var dependencyErr *nbt.ErrDependencyFailed
+		if err := trace.Err(root); !errors.As(err, &dependencyErr) || !errors.Is(err, errFailed) {
+			t.Errorf(`unexpected error for the root task: %v`, err)
+		}
+	})
+
+	t.Run(`deadlock`, func(t *testing.T) {
+		var a, b *namedTask
+		a = &namedTask{name: `a`, perform: func(h nbt.Handler) error {
+			h.RequireAndWait(b)
+			return nil
+		}}
+		b = &namedTask{name: `b`, perform: func(h nbt.Handler) error {
+			h.RequireAndWait(a)
+			return nil
+		}}
+		var deadlock *nbt.ErrDeadlock
+		if err := Run(a, 0).Err(a); !errors.As(err, &deadlock) {
+			t.Errorf(`expected a deadlock, got %v`, err)
+		}
+	})
+}
+
+func TestRecorder(t *testing.T) {
+	a, b := &namedTask{name: `a`}, &namedTask{name: `b`}
+	var r Recorder
+	task := &namedTask{name: `task`, perform: func(h nbt.Handler) error {
+		h.Require(a)
+		h.RequireWith(nbt.EdgeOrderOnly, b)
+		h.Wait()
+		h.Resolve(a)
+		return nil
+	}}
+	if err := task.Perform(&r); err != nil {
+		t.Fatal(err)
+	}
+	if required := r.Required(nbt.EdgeRequired); len(required) != 1 || required[0] != a {
+		t.Errorf(`unexpected required tasks: %v`, required)
+	}
+	if required := r.Required(nbt.EdgeOrderOnly); len(required) != 1 || required[0] != b {
+		t.Errorf(`unexpected order-only tasks: %v`, required)
+	}
+	if r.Waits() != 1 {
+		t.Errorf(`expected one wait, got %d`, r.Waits())
+	}
+	if len(r.Calls) != 4 || r.Calls[3].Kind != CallResolve {
+		t.Errorf(`unexpected calls: %+v`, r.Calls)
+	}
+
+	t.Run(`WaitFor records the requirements it implies`, func(t *testing.T) {
+		var r Recorder
+		r.Require(a)
+		r.WaitFor(a, b)
+		if required := r.Required(nbt.EdgeRequired); len(required) != 2 || required[0] != a || required[1] != b {
+			t.Errorf(`unexpected required tasks: %v`, required)
+		}
+		if len(r.Calls) != 3 || r.Calls[2].Kind != CallWaitFor || len(r.Calls[2].Tasks) != 2 {
+			t.Errorf(`unexpected calls: %+v`, r.Calls)
+		}
+	})
+}
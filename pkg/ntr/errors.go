@@ -1,13 +1,86 @@
 package ntr
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 /* Error type returned when a task is named in the arguments but cannot be found among the registered tasks. */
 type ErrTaskNotFound struct {
 	taskName string
+	/* Registered names close to the name, probably meant instead of it. */
+	suggestions []string
 }
 
-func (tnf *ErrTaskNotFound) Error() string { return fmt.Sprintf("task %q not found", tnf.taskName) }
+func (tnf *ErrTaskNotFound) Error() string {
+	switch len(tnf.suggestions) {
+	case 0:
+		return fmt.Sprintf("task %q not found", tnf.taskName)
+	case 1:
+		return fmt.Sprintf("task %q not found, did you mean %q?", tnf.taskName, tnf.suggestions[0])
+	}
+	quoted := make([]string, len(tnf.suggestions))
+	for i, suggestion := range tnf.suggestions {
+		quoted[i] = strconv.Quote(suggestion)
+	}
+	return fmt.Sprintf("task %q not found, did you mean one of %s?", tnf.taskName, strings.Join(quoted, ", "))
+}
+
+/* Returns the registered task names closest to the name that was not found, sorted, if any are close enough. */
+func (tnf *ErrTaskNotFound) Suggestions() []string { return tnf.suggestions }
+
+/* Returns the candidates at the smallest edit distance from the name, if that distance is small enough for the name
+to likely be a misspelling of them. The candidates must be sorted. */
+func suggest(name string, candidates []string) []string {
+	/* Roughly one typo for every three characters, so that short names do not suggest unrelated ones. */
+	best := len([]rune(name))/3 + 1
+	var suggestions []string
+	for _, candidate := range candidates {
+		switch distance := editDistance(name, candidate); {
+		case distance < best:
+			best, suggestions = distance, []string{candidate}
+		case distance == best && suggestions != nil:
+			suggestions = append(suggestions, candidate)
+		}
+	}
+	return suggestions
+}
+
+/* Returns the number of insertions, deletions, substitutions and transpositions of adjacent characters needed to
+turn a into b, ignoring case. */
+func editDistance(a, b string) int {
+	s, t := []rune(strings.ToLower(a)), []rune(strings.ToLower(b))
+	/* Three rows of the table suffice, since transpositions only look back two rows. */
+	previous2, previous, current := make([]int, len(t)+1), make([]int, len(t)+1), make([]int, len(t)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		current[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			current[j] = minimum(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				current[j] = minimum(current[j], previous2[j-2]+1)
+			}
+		}
+		previous2, previous, current = previous, current, previous2
+	}
+	return previous[len(t)]
+}
+
+func minimum(first int, rest ...int) int {
+	for _, n := range rest {
+		if n < first {
+			first = n
+		}
+	}
+	return first
+}
 
 /* Error type returned if the task supplier for a registered task returns an error. */
 type ErrTaskConstruction struct {
@@ -19,3 +92,15 @@ func (etc *ErrTaskConstruction) Error() string {
 	return fmt.Sprintf("failed to construct task %q with arg %q: %v", etc.taskName, etc.arg, etc.returnedErr)
 }
 func (etc *ErrTaskConstruction) Unwrap() error { return etc.returnedErr }
+
+/* Error type returned when an invocation is malformed, such as "a(" or "foo bar". */
+type ErrInvalidInvocation struct {
+	Input string
+	/* Why the invocation is malformed, usually an *ErrSyntax pointing at the offending column. */
+	Reason error
+}
+
+func (eii *ErrInvalidInvocation) Error() string {
+	return fmt.Sprintf("invalid invocation %q: %v", eii.Input, eii.Reason)
+}
+func (eii *ErrInvalidInvocation) Unwrap() error { return eii.Reason }
@@ -6,13 +6,28 @@ Useful for parsing tasks from command-line arguments.
 package ntr
 
 import (
-	"regexp"
-
 	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
 )
 
+/* Makes a task from the text between the outermost parentheses of its invocation, exactly as given,
+or an empty string if there are no parentheses. The text is not parsed, so it need not follow the syntax
+of arguments. */
 type TaskSupplier func(string) (nbt.Task, error)
 
+/* Makes a task from the parsed arguments of its invocation. */
+type ArgsSupplier func(Args) (nbt.Task, error)
+
+/* Returns a TaskSupplier which parses the arguments of the invocation for the given supplier. */
+func WithArgs(supplier ArgsSupplier) TaskSupplier {
+	return func(raw string) (nbt.Task, error) {
+		args, err := ParseArgs(raw)
+		if err != nil {
+			return nil, err
+		}
+		return supplier(args)
+	}
+}
+
 type task struct {
 	toPerform []nbt.Task
 }
@@ -20,31 +35,21 @@ type task struct {
 func (t *task) Matches(other nbt.Task) bool { return false }
 func (t *task) Hash() uint64                { return 0 }
 func (t *task) Perform(h nbt.Handler) error {
-	for _, task := range t.toPerform {
-		h.Require(task)
-	}
+	h.RequireAll(t.toPerform...)
 	return nil
 }
 
-var taskNameRegex = regexp.MustCompile(`^(?P<name>\w+)(?:\((?P<arg>.+)\))?$`)
-
 /*
 Creates a new named task requirer, using the given initial registry of tasks.
+Names which are not valid task names, such as "deploy-prod", are skipped rather than rejected,
+since they could never be invoked.
+Malformed invocations give an *ErrInvalidInvocation. See (*Registry).New for the other arguments accepted.
 */
 func New(registeredTasks map[string]TaskSupplier, namedTasks []string) (nbt.Task, error) {
-	var t task
-	for _, namedTask := range namedTasks {
-		matches := taskNameRegex.FindStringSubmatch(namedTask)
-		taskName, arg := matches[taskNameRegex.SubexpIndex("name")], matches[taskNameRegex.SubexpIndex("arg")]
-		if supplier, ok := registeredTasks[taskName]; ok {
-			if task, err := supplier(arg); err == nil {
-				t.toPerform = append(t.toPerform, task)
-			} else {
-				return nil, &ErrTaskConstruction{taskName, arg, err}
-			}
-		} else {
-			return nil, &ErrTaskNotFound{taskName}
-		}
+	registry := NewRegistry()
+	for name, supplier := range registeredTasks {
+		/* The only other failure is a duplicate name, which a map cannot hold. */
+		registry.Register(name, supplier, Doc{})
 	}
-	return &t, nil
+	return registry.New(namedTasks)
 }
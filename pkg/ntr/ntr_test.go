@@ -7,6 +7,7 @@ import (
 
 	"gitlab.com/kyle_anderson/go-utils/pkg/set"
 	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+	"gitlab.com/kyle_anderson/nbt/pkg/nbttest"
 )
 
 type mockTask uint
@@ -20,14 +21,6 @@ func (m mockTask) Matches(other nbt.Task) bool {
 }
 func (mockTask) Perform(nbt.Handler) error { return nil }
 
-type monitoredHandler struct {
-	onRequire func(nbt.Task)
-}
-
-func (monitoredHandler) Wait()                     {}
-func (monitoredHandler) Resolve(nbt.Task) nbt.Task { return nil }
-func (m *monitoredHandler) Require(t nbt.Task)     { m.onRequire(t) }
-
 func TestNamedTaskRequirer(t *testing.T) {
 	t.Run(`basic checks`, func(t *testing.T) {
 		registeredTasks := map[string]TaskSupplier{
@@ -51,10 +44,10 @@ func TestNamedTaskRequirer(t *testing.T) {
 				if err != nil {
 					t.Error(`New: received unexpected error: `, err)
 				} else {
-					var requiredTasks []mockTask
-					handler := monitoredHandler{func(t nbt.Task) { requiredTasks = append(requiredTasks, t.(mockTask)) }}
+					var handler nbttest.Recorder
 					nt.Perform(&handler)
-					for _, task := range requiredTasks {
+					for _, task := range handler.Required(nbt.EdgeRequired) {
+						task := task.(mockTask)
 						if !test.expected.Contains(task) {
 							t.Errorf("unexpected task requirement: %v", task)
 						} else {
@@ -108,12 +101,43 @@ func TestNamedTaskRequirer(t *testing.T) {
 			var receivedErr *ErrTaskNotFound
 			if !errors.As(err, &receivedErr) {
 				t.Errorf(`unexpected error type: %#v`, err)
-			} else if *receivedErr != (ErrTaskNotFound{"nonexistent"}) {
+			} else if receivedErr.taskName != "nonexistent" || receivedErr.suggestions != nil {
 				t.Errorf(`unexpected error value: %#v`, receivedErr)
 			}
 		}
 	})
 
+	t.Run(`with names that cannot be invoked`, func(t *testing.T) {
+		requirer, err := New(map[string]TaskSupplier{
+			"deploy":      func(string) (nbt.Task, error) { return mockTask(1), nil },
+			"deploy-prod": func(string) (nbt.Task, error) { return mockTask(2), nil },
+		}, []string{"deploy"})
+		if err != nil {
+			t.Fatal(`unexpected error: `, err)
+		}
+		if performed := requirer.(*task).toPerform; len(performed) != 1 || performed[0] != mockTask(1) {
+			t.Errorf(`unexpected tasks %v`, performed)
+		}
+	})
+
+	t.Run(`with malformed invocations`, func(t *testing.T) {
+		registeredTasks := map[string]TaskSupplier{
+			"foo": func(string) (nbt.Task, error) { return mockTask(1), nil },
+			"a":   func(string) (nbt.Task, error) { return mockTask(2), nil },
+		}
+		for i, invocation := range []string{`foo bar`, `a(`, ``, `(a)`, `a("b`, `a(b`, `a)`, `a(b)c`} {
+			invocation := invocation // Capture
+			t.Run(fmt.Sprint(i), func(t *testing.T) {
+				_, err := New(registeredTasks, []string{`foo`, invocation})
+				var invalid *ErrInvalidInvocation
+				var syntax *ErrSyntax
+				if !errors.As(err, &invalid) || invalid.Input != invocation || !errors.As(err, &syntax) {
+					t.Errorf(`expected an invalid invocation error for %q, got %#v`, invocation, err)
+				}
+			})
+		}
+	})
+
 	t.Run(`with an argument set`, func(t *testing.T) {
 		/*
 			taskNames: Names of tasks to be used. Should not have duplicates.
@@ -161,6 +185,14 @@ func TestNamedTaskRequirer(t *testing.T) {
 				},
 				[]string{"one(0)", "two(and a quarter)", "three(3)"},
 			},
+			{
+				/* The arguments of raw suppliers are not parsed, so they need not follow the syntax of arguments. */
+				[]string{"f"},
+				map[string]map[string]uint{
+					"f": {"a=1, a=2": 1, `"x" y`: 1, "a(b": 1, "b)": 1, "": 1},
+				},
+				[]string{"f(a=1, a=2)", `f("x" y)`, "f(a(b)", "f(b))", "f()"},
+			},
 			{
 				[]string{"one", "two", "three"},
 				map[string]map[string]uint{
@@ -179,3 +211,38 @@ func TestNamedTaskRequirer(t *testing.T) {
 		}
 	})
 }
+
+func FuzzNew(f *testing.F) {
+	for _, seed := range []string{
+		`foo`, `foo bar`, `a(`, `a()`, `a(b, c)`, `a(k=v, "q\"uoted")`, `a(f(g(x)), ")")`, `a("\q")`, `é(ü)`, "a(\xff)",
+	} {
+		f.Add(seed)
+	}
+	registeredTasks := map[string]TaskSupplier{
+		"a":   func(string) (nbt.Task, error) { return mockTask(1), nil },
+		"foo": func(string) (nbt.Task, error) { return mockTask(2), nil },
+		"b":   WithArgs(func(Args) (nbt.Task, error) { return mockTask(3), nil }),
+	}
+	f.Fuzz(func(t *testing.T, invocation string) {
+		_, err := New(registeredTasks, []string{invocation})
+		var invalid *ErrInvalidInvocation
+		var notFound *ErrTaskNotFound
+		var construction *ErrTaskConstruction
+		switch {
+		case err == nil, errors.As(err, &notFound):
+		case errors.As(err, &invalid):
+			var syntax *ErrSyntax
+			if !errors.As(err, &syntax) || syntax.Column < 1 || syntax.Column > len([]rune(invocation))+1 {
+				t.Errorf(`invalid invocation %q with a bad reason: %#v`, invocation, invalid.Reason)
+			}
+		case errors.As(err, &construction):
+			/* Only WithArgs fails, when the arguments passed on by New do not follow the syntax. */
+			var syntax *ErrSyntax
+			if construction.taskName != `b` || !errors.As(err, &syntax) {
+				t.Errorf(`unexpected construction error for %q: %v`, invocation, err)
+			}
+		default:
+			t.Errorf(`unexpected error for %q: %#v`, invocation, err)
+		}
+	})
+}
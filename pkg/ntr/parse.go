@@ -0,0 +1,309 @@
+package ntr
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+/* Invocations name a task, optionally followed by arguments in parentheses:
+
+	name
+	name(positional, "quoted, with \"escapes\"", key=value, nested(a, b))
+
+Arguments are separated by commas. An argument starting with a name followed by "=" is named, and any other
+argument is positional. Values are either quoted strings, in which \", \\, \n, \t and \r are escapes, or bare text,
+which is trimmed of surrounding spaces and may contain balanced parentheses, within which commas do not separate
+arguments. */
+
+/* The parsed arguments of an invocation. */
+type Args struct {
+	Positional []string
+	/* Never nil. */
+	Named map[string]string
+}
+
+/* A parsed invocation of a task. */
+type Invocation struct {
+	Name string
+	/* The text between the parentheses, exactly as given. Empty if there are no parentheses. */
+	RawArgs string
+	Args    Args
+}
+
+/* Error given for invocations which do not follow the syntax. */
+type ErrSyntax struct {
+	Invocation string
+	/* The column of the offending character, counting from one, in characters rather than bytes. */
+	Column  int
+	Message string
+}
+
+func (err *ErrSyntax) Error() string {
+	return fmt.Sprintf("column %d: %s", err.Column, err.Message)
+}
+
+/* Returns the invocation followed by a line with a caret under the offending column, for showing to users. */
+func (err *ErrSyntax) Pointer() string {
+	return err.Invocation + "\n" + strings.Repeat(" ", err.Column-1) + "^"
+}
+
+/* Parses an invocation of a task. Errors are of type *ErrSyntax. */
+func ParseInvocation(s string) (*Invocation, error) {
+	p := parser{input: s}
+	name, err := p.taskName()
+	if err != nil {
+		return nil, err
+	}
+	invocation := &Invocation{Name: name, Args: Args{Named: make(map[string]string)}}
+	if p.done() {
+		return invocation, nil
+	}
+	open := p.pos
+	p.pos++
+	args, err := p.args(open)
+	if err != nil {
+		return nil, err
+	}
+	invocation.Args, invocation.RawArgs = args, s[open+1:p.pos-1]
+	if !p.done() {
+		return nil, p.errorf(p.pos, "unexpected %q after the arguments", p.peek())
+	}
+	return invocation, nil
+}
+
+/* Splits an invocation into the task name and the text between its outermost parentheses, exactly as given,
+without parsing the arguments. Errors are of type *ErrSyntax. */
+func splitInvocation(s string) (name, rawArgs string, err error) {
+	p := parser{input: s}
+	if name, err = p.taskName(); err != nil || p.done() {
+		return name, "", err
+	}
+	if len(s) == p.pos+1 || !strings.HasSuffix(s, ")") {
+		if end := strings.LastIndexByte(s, ')'); end > p.pos {
+			p.pos = end + 1
+			return "", "", p.errorf(p.pos, "unexpected %q after the arguments", p.peek())
+		}
+		return "", "", p.errorf(p.pos, "unclosed \"(\"")
+	}
+	return name, s[p.pos+1 : len(s)-1], nil
+}
+
+/* Parses the text between the parentheses of an invocation, such as the RawArgs of an Invocation.
+Columns of errors count from the start of s. */
+func ParseArgs(s string) (Args, error) {
+	p := parser{input: s}
+	return p.args(-1)
+}
+
+type parser struct {
+	input string
+	/* Byte offset of the next character. */
+	pos int
+}
+
+func (p *parser) done() bool { return p.pos >= len(p.input) }
+
+func (p *parser) peek() rune {
+	r, _ := utf8.DecodeRuneInString(p.input[p.pos:])
+	return r
+}
+
+func (p *parser) errorf(offset int, format string, args ...interface{}) error {
+	if offset > len(p.input) {
+		offset = len(p.input)
+	}
+	return &ErrSyntax{p.input, utf8.RuneCountInString(p.input[:offset]) + 1, fmt.Sprintf(format, args...)}
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+/* Consumes the name at the start of an invocation, which must be followed by the end of the invocation
+or an opening parenthesis. */
+func (p *parser) taskName() (string, error) {
+	name := p.word()
+	switch {
+	case name == "" && p.done():
+		return "", p.errorf(p.pos, "expected a task name")
+	case name == "":
+		return "", p.errorf(p.pos, "unexpected %q, expected a task name", p.peek())
+	case !p.done() && p.peek() != '(':
+		return "", p.errorf(p.pos, "unexpected %q after the task name", p.peek())
+	}
+	return name, nil
+}
+
+/* Consumes and returns a run of letters, digits and underscores. */
+func (p *parser) word() string {
+	start := p.pos
+	for !p.done() && isWordByte(p.input[p.pos]) {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *parser) skipSpace() {
+	for !p.done() && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+/* Parses arguments up to and including the closing parenthesis. open is the offset of the opening parenthesis,
+or negative if there is none, in which case the arguments end at the end of the input instead. */
+func (p *parser) args(open int) (Args, error) {
+	args := Args{Named: make(map[string]string)}
+	p.skipSpace()
+	if p.closes(open) {
+		return args, nil
+	}
+	for {
+		p.skipSpace()
+		start := p.pos
+		/* A name followed by "=" makes the argument named. Otherwise, the argument is positional. */
+		key := ""
+		if name := p.word(); name != "" && !('0' <= name[0] && name[0] <= '9') {
+			p.skipSpace()
+			if !p.done() && p.input[p.pos] == '=' {
+				if _, ok := args.Named[name]; ok {
+					return args, p.errorf(start, "argument %q given more than once", name)
+				}
+				key = name
+				p.pos++
+			} else {
+				p.pos = start
+			}
+		} else {
+			p.pos = start
+		}
+		value, err := p.value(open)
+		if err != nil {
+			return args, err
+		}
+		if key != "" {
+			args.Named[key] = value
+		} else {
+			args.Positional = append(args.Positional, value)
+		}
+		switch {
+		case p.closes(open):
+			return args, nil
+		case p.done():
+			return args, p.errorf(open, "unclosed \"(\"")
+		case p.input[p.pos] == ')':
+			return args, p.errorf(p.pos, "unexpected %q", ')')
+		}
+		/* The value stops at a comma or a closing parenthesis. */
+		p.pos++
+	}
+}
+
+/* Consumes the end of the arguments if it is next, returning true if it was. */
+func (p *parser) closes(open int) bool {
+	if open < 0 {
+		return p.done()
+	}
+	if !p.done() && p.input[p.pos] == ')' {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+/* Parses a value, stopping before the comma or parenthesis after it. */
+func (p *parser) value(open int) (string, error) {
+	p.skipSpace()
+	if p.done() {
+		if open < 0 {
+			return "", p.errorf(p.pos, "expected an argument")
+		}
+		return "", p.errorf(open, "unclosed \"(\"")
+	}
+	switch c := p.input[p.pos]; c {
+	case '"':
+		value, err := p.quoted()
+		if err != nil {
+			return "", err
+		}
+		p.skipSpace()
+		if !p.done() && p.input[p.pos] != ',' && p.input[p.pos] != ')' {
+			return "", p.errorf(p.pos, "unexpected %q after a quoted string, expected \",\" or \")\"", p.peek())
+		}
+		return value, nil
+	case ',', ')':
+		return "", p.errorf(p.pos, "expected an argument before %q", c)
+	}
+	return p.bare()
+}
+
+/* Parses a quoted string, unescaping it. */
+func (p *parser) quoted() (string, error) {
+	start := p.pos
+	p.pos++
+	var value strings.Builder
+	for !p.done() {
+		switch c := p.input[p.pos]; c {
+		case '"':
+			p.pos++
+			return value.String(), nil
+		case '\\':
+			if p.pos+1 >= len(p.input) {
+				return "", p.errorf(start, "unterminated string")
+			}
+			switch escaped := p.input[p.pos+1]; escaped {
+			case '"', '\\':
+				value.WriteByte(escaped)
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'r':
+				value.WriteByte('\r')
+			default:
+				p.pos++
+				return "", p.errorf(p.pos-1, "unknown escape \"\\%c\"", p.peek())
+			}
+			p.pos += 2
+		default:
+			value.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", p.errorf(start, "unterminated string")
+}
+
+/* Parses bare text, up to a comma or closing parenthesis outside of any nested parentheses and quoted strings. */
+func (p *parser) bare() (string, error) {
+	start := p.pos
+	/* Offsets of the nested parentheses that are still open. */
+	var nested []int
+	for !p.done() {
+		switch p.input[p.pos] {
+		case '(':
+			nested = append(nested, p.pos)
+		case ')':
+			if len(nested) == 0 {
+				return strings.TrimRight(p.input[start:p.pos], " \t"), nil
+			}
+			nested = nested[:len(nested)-1]
+		case ',':
+			if len(nested) == 0 {
+				return strings.TrimRight(p.input[start:p.pos], " \t"), nil
+			}
+		case '"':
+			if len(nested) > 0 {
+				/* Quoted strings within nested parentheses are kept as they are, but may hold parentheses. */
+				if _, err := p.quoted(); err != nil {
+					return "", err
+				}
+				continue
+			}
+		}
+		p.pos++
+	}
+	if len(nested) > 0 {
+		return "", p.errorf(nested[len(nested)-1], "unclosed \"(\"")
+	}
+	return strings.TrimRight(p.input[start:], " \t"), nil
+}
@@ -0,0 +1,155 @@
+package ntr
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+func TestParseInvocation(t *testing.T) {
+	named := func(pairs ...string) map[string]string {
+		m := make(map[string]string)
+		for i := 0; i < len(pairs); i += 2 {
+			m[pairs[i]] = pairs[i+1]
+		}
+		return m
+	}
+	tests := []struct {
+		input      string
+		name, raw  string
+		positional []string
+		named      map[string]string
+	}{
+		{input: `build`, name: `build`, named: named()},
+		{input: `build()`, name: `build`, named: named()},
+		{input: `build( )`, name: `build`, raw: ` `, named: named()},
+		{input: `two(and a quarter)`, name: `two`, raw: `and a quarter`, positional: []string{`and a quarter`}, named: named()},
+		{input: `cc(a, b ,c)`, name: `cc`, raw: `a, b ,c`, positional: []string{`a`, `b`, `c`}, named: named()},
+		{
+			input: `deploy(prod, region = eu-west-1, dry_run=true)`, name: `deploy`, raw: `prod, region = eu-west-1, dry_run=true`,
+			positional: []string{`prod`}, named: named(`region`, `eu-west-1`, `dry_run`, `true`),
+		},
+		{
+			input: `say("hello, world", "a \"quoted\" \\ (paren)\n")`, name: `say`, raw: `"hello, world", "a \"quoted\" \\ (paren)\n"`,
+			positional: []string{`hello, world`, "a \"quoted\" \\ (paren)\n"}, named: named(),
+		},
+		{
+			input: `run(target=lib(foo, bar(baz)), f(")"))`, name: `run`, raw: `target=lib(foo, bar(baz)), f(")")`,
+			positional: []string{`f(")")`}, named: named(`target`, `lib(foo, bar(baz))`),
+		},
+		/* An "=" after something other than a name is part of a positional value. */
+		{input: `env(1=2, "k=v")`, name: `env`, raw: `1=2, "k=v"`, positional: []string{`1=2`, `k=v`}, named: named()},
+		{input: `x(key=a=b)`, name: `x`, raw: `key=a=b`, named: named(`key`, `a=b`)},
+		{input: `x(é, ü)`, name: `x`, raw: `é, ü`, positional: []string{`é`, `ü`}, named: named()},
+	}
+	for i, test := range tests {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			invocation, err := ParseInvocation(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := &Invocation{test.name, test.raw, Args{test.positional, test.named}}
+			if !reflect.DeepEqual(invocation, expected) {
+				t.Errorf(`parsed %#v, expected %#v`, invocation, expected)
+			}
+		})
+	}
+}
+
+func TestParseInvocationErrors(t *testing.T) {
+	tests := []struct {
+		input  string
+		column int
+	}{
+		{``, 1},
+		{`(a)`, 1},
+		{`foo bar`, 4},
+		{`a(`, 2},
+		{`a(b`, 2},
+		{`a(b))`, 5},
+		{`a(b)c`, 5},
+		{`a(,b)`, 3},
+		{`a(b,)`, 5},
+		{`a(b,,c)`, 5},
+		{`a(k=)`, 5},
+		{`a(k=1, k=2)`, 8},
+		{`a("unterminated)`, 3},
+		{`a("bad \q")`, 8},
+		{`a("x" y)`, 7},
+		{`a(f(x)`, 2},
+		{`a(f(g(x), y)`, 2},
+		{`a(f(g(x, y)`, 4},
+		{`a(f("(", x)`, 2},
+		{`é(x)`, 1},
+		{`x(é, "\é")`, 7},
+	}
+	for i, test := range tests {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			_, err := ParseInvocation(test.input)
+			var syntax *ErrSyntax
+			if !errors.As(err, &syntax) {
+				t.Fatalf(`expected a syntax error, got %v`, err)
+			}
+			if syntax.Column != test.column || syntax.Invocation != test.input {
+				t.Errorf(`error at column %d of %q, expected column %d: %v`, syntax.Column, syntax.Invocation, test.column, err)
+			}
+		})
+	}
+}
+
+func TestErrSyntaxPointer(t *testing.T) {
+	_, err := ParseInvocation(`a(b,)`)
+	if pointer := err.(*ErrSyntax).Pointer(); pointer != "a(b,)\n    ^" {
+		t.Errorf(`unexpected pointer %q`, pointer)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	args, err := ParseArgs(`a, k="v"`)
+	if err != nil || !reflect.DeepEqual(args, Args{[]string{`a`}, map[string]string{`k`: `v`}}) {
+		t.Errorf(`parsed %#v, %v`, args, err)
+	}
+	for _, test := range []struct {
+		input  string
+		column int
+	}{
+		{`a, (`, 4},
+		{`a)`, 2},
+		{`"a`, 1},
+		{`a,`, 3},
+	} {
+		var syntax *ErrSyntax
+		if _, err := ParseArgs(test.input); !errors.As(err, &syntax) || syntax.Column != test.column || syntax.Invocation != test.input {
+			t.Errorf(`parsing %q: expected an error at column %d, got %v`, test.input, test.column, err)
+		}
+	}
+}
+
+func TestWithArgs(t *testing.T) {
+	var received []Args
+	registeredTasks := map[string]TaskSupplier{
+		"deploy": WithArgs(func(args Args) (nbt.Task, error) {
+			received = append(received, args)
+			return mockTask(len(received)), nil
+		}),
+	}
+	if _, err := New(registeredTasks, []string{`deploy`, `deploy(prod, region="eu, west")`}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Args{
+		{nil, map[string]string{}},
+		{[]string{`prod`}, map[string]string{`region`: `eu, west`}},
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf(`received %#v, expected %#v`, received, expected)
+	}
+	var syntax *ErrSyntax
+	if _, err := New(registeredTasks, []string{`deploy(prod`}); !errors.As(err, &syntax) || syntax.Column != 7 {
+		t.Errorf(`expected a syntax error at column 7, got %v`, err)
+	}
+}
@@ -0,0 +1,417 @@
+package ntr
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* How a task registered with Register is described by --list and help. */
+type Doc struct {
+	/* What the task does. The first line is shown when listing tasks, and the whole of it in the help for the task. */
+	Description string
+	/* How the task is invoked, such as "deploy(environment)". Defaults to the name followed by "[(arguments)]". */
+	Usage string
+}
+
+type registration struct {
+	name string
+	/* Set for the tasks registered by NewRegistry, which are replaced by tasks registered under the same names. */
+	builtin bool
+	doc     Doc
+	/* Set for tasks registered with Register. */
+	supplier TaskSupplier
+	/* Set for tasks registered with RegisterTyped. */
+	schema  *Schema
+	factory Factory
+}
+
+/* Tasks registered under names, from which invocations are made into tasks. */
+type Registry struct {
+	tasks map[string]*registration
+}
+
+/* Returns a registry holding only the help task, which prints the help for the task named by its argument, or an
+overview of all tasks without one. */
+func NewRegistry() *Registry {
+	r := &Registry{make(map[string]*registration)}
+	help := Schema{
+		Description: "Prints the help for a task, or an overview of all tasks.",
+		Params:      []Param{{Name: "task", Description: "The task to describe. Describes all tasks if empty."}},
+	}
+	r.RegisterTyped("help", help, func(v Values) (nbt.Task, error) {
+		if name := v.String("task"); name != "" {
+			if _, ok := r.tasks[name]; !ok {
+				return nil, r.notFound(name)
+			}
+		}
+		return &helpTask{r, v.String("task")}, nil
+	})
+	r.tasks["help"].builtin = true
+	return r
+}
+
+/* Error type returned when a task cannot be registered, such as when its name is taken or its schema is invalid. */
+type ErrInvalidRegistration struct {
+	TaskName, Reason string
+}
+
+func (eir *ErrInvalidRegistration) Error() string {
+	return fmt.Sprintf("cannot register task %q: %s", eir.TaskName, eir.Reason)
+}
+
+func (r *Registry) add(reg *registration) error {
+	if reg.name == "" || !isWordName(reg.name) {
+		return &ErrInvalidRegistration{reg.name, "names may only contain letters, digits and underscores"}
+	}
+	if existing, ok := r.tasks[reg.name]; ok && !existing.builtin {
+		return &ErrInvalidRegistration{reg.name, "the name is already registered"}
+	}
+	r.tasks[reg.name] = reg
+	return nil
+}
+
+func isWordName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isWordByte(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+/* Registers a task which parses its own arguments. */
+func (r *Registry) Register(name string, supplier TaskSupplier, doc Doc) error {
+	if doc.Usage == "" {
+		doc.Usage = name + "[(arguments)]"
+	}
+	return r.add(&registration{name: name, doc: doc, supplier: supplier})
+}
+
+/* Registers a task with declared parameters. The arguments of invocations are checked against the schema and
+converted before the factory is called, and the schema is used for help output and shell completion. */
+func (r *Registry) RegisterTyped(name string, schema Schema, factory Factory) error {
+	if err := schema.validate(name); err != nil {
+		return err
+	}
+	doc := Doc{schema.Description, schema.signature(name)}
+	return r.add(&registration{name: name, doc: doc, schema: &schema, factory: factory})
+}
+
+/* Returns the names of the registered tasks, sorted. */
+func (r *Registry) names() []string {
+	names := make([]string, 0, len(r.tasks))
+	for name := range r.tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* Returns an error for a task that is not registered, suggesting the registered names closest to the given one. */
+func (r *Registry) notFound(name string) *ErrTaskNotFound {
+	return &ErrTaskNotFound{name, suggest(name, r.names())}
+}
+
+/*
+Creates a named task requirer from command-line arguments, each of which is an invocation of a registered task.
+Instead of invocations, the arguments may be "--list", "--help", optionally followed by the name of a task, or
+"--complete" followed by a partial invocation, in which case the task returned prints the list of tasks, the help or
+the completion candidates when performed.
+Tasks registered with a TaskSupplier are given the text between the outermost parentheses of their invocation as it
+is, while the arguments of typed tasks must follow the syntax of ParseInvocation.
+Malformed invocations give an *ErrInvalidInvocation, and arguments not fitting the schema of a typed task give an
+*ErrInvalidArgument.
+*/
+func (r *Registry) New(args []string) (nbt.Task, error) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "--list":
+			if len(args) > 1 {
+				return nil, &ErrInvalidInvocation{strings.Join(args, " "), fmt.Errorf("--list takes no arguments")}
+			}
+			return &listTask{r}, nil
+		case "--help":
+			if len(args) > 2 {
+				return nil, &ErrInvalidInvocation{strings.Join(args, " "), fmt.Errorf("--help takes at most one task name")}
+			}
+			help := &helpTask{registry: r}
+			if len(args) == 2 {
+				if _, ok := r.tasks[args[1]]; !ok {
+					return nil, r.notFound(args[1])
+				}
+				help.taskName = args[1]
+			}
+			return help, nil
+		case "--complete":
+			partial := ""
+			if len(args) > 1 {
+				partial = args[1]
+			}
+			return &completeTask{r, partial}, nil
+		}
+	}
+	var t task
+	for _, namedTask := range args {
+		name, rawArgs, err := splitInvocation(namedTask)
+		if err != nil {
+			return nil, &ErrInvalidInvocation{namedTask, err}
+		}
+		reg, ok := r.tasks[name]
+		if !ok {
+			return nil, r.notFound(name)
+		}
+		var made nbt.Task
+		if reg.schema != nil {
+			invocation, err := ParseInvocation(namedTask)
+			if err != nil {
+				return nil, &ErrInvalidInvocation{namedTask, err}
+			}
+			values, err := reg.schema.bind(reg.name, invocation.Args)
+			if err != nil {
+				return nil, err
+			}
+			made, err = reg.factory(values)
+			if err != nil {
+				return nil, &ErrTaskConstruction{reg.name, rawArgs, err}
+			}
+		} else if made, err = reg.supplier(rawArgs); err != nil {
+			return nil, &ErrTaskConstruction{reg.name, rawArgs, err}
+		}
+		t.toPerform = append(t.toPerform, made)
+	}
+	return &t, nil
+}
+
+/* Writes help for the task with the given name, or an overview of all tasks if the name is empty. */
+func (r *Registry) Help(w io.Writer, taskName string) error {
+	if taskName == "" {
+		return r.writeOverview(w)
+	}
+	reg, ok := r.tasks[taskName]
+	if !ok {
+		return r.notFound(taskName)
+	}
+	fmt.Fprintf(w, "Usage: %s\n", reg.doc.Usage)
+	if reg.doc.Description != "" {
+		fmt.Fprintf(w, "\n%s\n", strings.TrimRight(reg.doc.Description, "\n"))
+	}
+	if reg.schema == nil || len(reg.schema.Params) == 0 {
+		return nil
+	}
+	rows := make([][]string, len(reg.schema.Params))
+	for i, param := range reg.schema.Params {
+		requirement := fmt.Sprintf("default %q", param.Default)
+		if param.Required {
+			requirement = "required"
+		}
+		rows[i] = []string{param.Name, param.typeDescription(), requirement, param.Description}
+	}
+	fmt.Fprintln(w, "\nParameters:")
+	return writeTable(w, "  ", rows)
+}
+
+func (r *Registry) writeOverview(w io.Writer) error {
+	fmt.Fprintf(w, "Usage: %s [task invocation]...\n\nTasks:\n", filepath.Base(os.Args[0]))
+	rows := make([][]string, 0, len(r.tasks))
+	for _, name := range r.names() {
+		rows = append(rows, []string{r.tasks[name].doc.Usage, summary(r.tasks[name].doc.Description)})
+	}
+	if err := writeTable(w, "  ", rows); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w, "\nRun with --help <task>, or invoke help(<task>), for the parameters of a task.")
+	return err
+}
+
+/* Writes the names of the registered tasks, one per line, with the first lines of their descriptions. */
+func (r *Registry) List(w io.Writer) error {
+	rows := make([][]string, 0, len(r.tasks))
+	for _, name := range r.names() {
+		rows = append(rows, []string{name, summary(r.tasks[name].doc.Description)})
+	}
+	return writeTable(w, "", rows)
+}
+
+/* Returns the first line of a description. */
+func summary(description string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(description), "\n")
+	return line
+}
+
+/* Writes the rows with their cells aligned in columns, each row starting with the indent. */
+func writeTable(w io.Writer, indent string, rows [][]string) error {
+	var table strings.Builder
+	tw := tabwriter.NewWriter(&table, 0, 4, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s%s\n", indent, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+	/* Rows with empty last cells would otherwise leave padding at the ends of their lines. */
+	for _, line := range strings.SplitAfter(table.String(), "\n") {
+		if line == "" {
+			break
+		}
+		if _, err := fmt.Fprintln(w, strings.TrimRight(line, " \n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Returns the completions of a partial invocation, such as task names starting with the partial text, or the
+parameter names and enum values of a typed task once the invocation has an opening parenthesis. Each completion
+is the whole invocation up to the completed part. */
+func (r *Registry) Complete(partial string) []string {
+	open := strings.IndexByte(partial, '(')
+	if open < 0 {
+		var candidates []string
+		for _, name := range r.names() {
+			if strings.HasPrefix(name, partial) {
+				candidates = append(candidates, name)
+			}
+		}
+		return candidates
+	}
+	reg, ok := r.tasks[partial[:open]]
+	if !ok || reg.schema == nil {
+		return nil
+	}
+	argsText := partial[open+1:]
+	last := lastSeparator(argsText)
+	previous := Args{Named: make(map[string]string)}
+	if last >= 0 {
+		if parsed, err := ParseArgs(argsText[:last]); err == nil {
+			previous = parsed
+		}
+	}
+	current := argsText[last+1:]
+	trimmed := strings.TrimLeft(current, " ")
+	done := partial[:open+1+last+1+len(current)-len(trimmed)]
+
+	var candidates []string
+	if eq := strings.IndexByte(trimmed, '='); eq >= 0 {
+		if param, ok := reg.schema.param(trimmed[:eq]); ok {
+			for _, value := range param.complete(trimmed[eq+1:]) {
+				candidates = append(candidates, done+trimmed[:eq+1]+value)
+			}
+		}
+		return candidates
+	}
+	position := len(previous.Positional)
+	if len(previous.Named) == 0 && position < len(reg.schema.Params) {
+		for _, value := range reg.schema.Params[position].complete(trimmed) {
+			candidates = append(candidates, done+value)
+		}
+	}
+	for i, param := range reg.schema.Params {
+		if _, named := previous.Named[param.Name]; i < position || named {
+			continue
+		}
+		if strings.HasPrefix(param.Name+"=", trimmed) {
+			candidates = append(candidates, done+param.Name+"=")
+		}
+	}
+	return candidates
+}
+
+/* Returns the offset of the last comma separating arguments, outside of nested parentheses and quoted strings,
+or -1 if there is none. */
+func lastSeparator(args string) int {
+	last, depth, quoted := -1, 0, false
+	for i := 0; i < len(args); i++ {
+		switch c := args[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			last = i
+		}
+	}
+	return last
+}
+
+/* Returns a bash script enabling completion of the invocations of the program, which must create its root task
+with (*Registry).New. The script is meant to be sourced, such as from ~/.bashrc. */
+func BashCompletion(program string) string {
+	function := "_" + strings.Map(func(r rune) rune {
+		if r < 128 && isWordByte(byte(r)) {
+			return r
+		}
+		return '_'
+	}, filepath.Base(program)) + "_complete"
+	/* Bash splits words at characters such as "(" and "=", so the whole invocation is taken from the line, and the
+	part before the current word is removed from the candidates. */
+	return fmt.Sprintf(`%[1]s() {
+	local line=${COMP_LINE:0:COMP_POINT}
+	local word=${line##*[[:space:]]}
+	local prefix=${word%%"${COMP_WORDS[COMP_CWORD]}"}
+	local IFS=$'\n'
+	COMPREPLY=($(%[2]s --complete "$word" 2>/dev/null))
+	COMPREPLY=("${COMPREPLY[@]#"$prefix"}")
+}
+complete -o nospace -F %[1]s %[2]s
+`, function, shellQuote(program))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+/* Prints help for the registry when performed. */
+type helpTask struct {
+	registry *Registry
+	/* Empty for an overview of all tasks. */
+	taskName string
+}
+
+func (t *helpTask) Hash() uint64 { return 0 }
+func (t *helpTask) Matches(other nbt.Task) bool {
+	converted, ok := other.(*helpTask)
+	return ok && converted.registry == t.registry && converted.taskName == t.taskName
+}
+func (t *helpTask) Perform(nbt.Handler) error { return t.registry.Help(os.Stdout, t.taskName) }
+
+/* Prints the list of registered tasks when performed. */
+type listTask struct {
+	registry *Registry
+}
+
+func (t *listTask) Hash() uint64 { return 0 }
+func (t *listTask) Matches(other nbt.Task) bool {
+	converted, ok := other.(*listTask)
+	return ok && converted.registry == t.registry
+}
+func (t *listTask) Perform(nbt.Handler) error { return t.registry.List(os.Stdout) }
+
+/* Prints the completions of a partial invocation, one per line, when performed. */
+type completeTask struct {
+	registry *Registry
+	partial  string
+}
+
+func (t *completeTask) Hash() uint64 { return 0 }
+func (t *completeTask) Matches(other nbt.Task) bool {
+	converted, ok := other.(*completeTask)
+	return ok && converted.registry == t.registry && converted.partial == t.partial
+}
+func (t *completeTask) Perform(nbt.Handler) error {
+	for _, candidate := range t.registry.Complete(t.partial) {
+		if _, err := fmt.Fprintln(os.Stdout, candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package ntr
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+	"gitlab.com/kyle_anderson/nbt/pkg/nbttest"
+)
+
+/* A task recording the values it was made from. */
+type valuesTask struct {
+	values Values
+}
+
+func (*valuesTask) Hash() uint64                  { return 0 }
+func (t *valuesTask) Matches(other nbt.Task) bool { return other == t }
+func (*valuesTask) Perform(nbt.Handler) error     { return nil }
+
+func newTestRegistry(t *testing.T) *Registry {
+	r := NewRegistry()
+	if err := r.RegisterTyped(`compile`, Schema{Description: "Compiles a source file.\nThe object is written to build/.", Params: []Param{
+		{Name: `source`, Type: TypePath, Required: true, Description: `The file to compile.`},
+		{Name: `mode`, Type: TypeEnum, Values: []string{`debug`, `release`}, Default: `debug`},
+		{Name: `jobs`, Type: TypeInt, Default: `1`},
+		{Name: `verbose`, Type: TypeBool, Default: `false`},
+	}}, func(v Values) (nbt.Task, error) { return &valuesTask{v}, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(`clean`, func(string) (nbt.Task, error) { return mockTask(1), nil }, Doc{Description: `Removes the outputs.`}); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRegistryTyped(t *testing.T) {
+	r := newTestRegistry(t)
+	for i, test := range []struct {
+		invocation string
+		source     string
+		mode       string
+		jobs       int
+		verbose    bool
+		/* The parameter of the expected *ErrInvalidArgument, or "-" if there should be no error. */
+		invalid string
+	}{
+		{`compile(a.c)`, `a.c`, `debug`, 1, false, `-`},
+		{`compile(./src/../a.c, release, 4, true)`, `a.c`, `release`, 4, true, `-`},
+		{`compile(a.c, jobs=8, verbose=1)`, `a.c`, `debug`, 8, true, `-`},
+		{`compile(source="b c.c", mode=release)`, `b c.c`, `release`, 1, false, `-`},
+		{`compile`, ``, ``, 0, false, `source`},
+		{`compile(a.c, fast)`, ``, ``, 0, false, `mode`},
+		{`compile(a.c, jobs=many)`, ``, ``, 0, false, `jobs`},
+		{`compile(a.c, verbose=maybe)`, ``, ``, 0, false, `verbose`},
+		{`compile(a.c, source=b.c)`, ``, ``, 0, false, `source`},
+		{`compile(a.c, level=3)`, ``, ``, 0, false, `level`},
+		{`compile(a.c, debug, 1, true, extra)`, ``, ``, 0, false, ``},
+		{`compile("")`, ``, ``, 0, false, `source`},
+	} {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			root, err := r.New([]string{test.invocation})
+			if test.invalid != `-` {
+				var invalid *ErrInvalidArgument
+				if !errors.As(err, &invalid) || invalid.Param != test.invalid || invalid.TaskName != `compile` {
+					t.Errorf(`expected an invalid argument error for parameter %q, got %#v`, test.invalid, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(`unexpected error: `, err)
+			}
+			var handler nbttest.Recorder
+			root.Perform(&handler)
+			required := handler.Required(nbt.EdgeRequired)
+			if len(required) != 1 {
+				t.Fatalf(`expected one required task, got %v`, required)
+			}
+			v := required[0].(*valuesTask).values
+			if v.String(`source`) != test.source || v.String(`mode`) != test.mode || v.Int(`jobs`) != test.jobs ||
+				v.Bool(`verbose`) != test.verbose {
+				t.Errorf(`unexpected values %v`, v.values)
+			}
+		})
+	}
+
+	t.Run(`optional paths`, func(t *testing.T) {
+		r := NewRegistry()
+		if err := r.RegisterTyped(`link`, Schema{Params: []Param{{Name: `out`, Type: TypePath}}}, func(v Values) (nbt.Task, error) {
+			return &valuesTask{v}, nil
+		}); err != nil {
+			t.Fatal(`optional paths should accept an empty default: `, err)
+		}
+		for invocation, expected := range map[string]string{`link`: ``, `link(bin/../a.out)`: `a.out`} {
+			root, err := r.New([]string{invocation})
+			if err != nil {
+				t.Fatalf(`%s: %v`, invocation, err)
+			}
+			var handler nbttest.Recorder
+			root.Perform(&handler)
+			if out := handler.Required(nbt.EdgeRequired)[0].(*valuesTask).values.String(`out`); out != expected {
+				t.Errorf(`%s: got path %q, expected %q`, invocation, out, expected)
+			}
+		}
+	})
+
+	t.Run(`factory errors`, func(t *testing.T) {
+		failure := errors.New(`failure`)
+		r := NewRegistry()
+		r.RegisterTyped(`fail`, Schema{}, func(Values) (nbt.Task, error) { return nil, failure })
+		var construction *ErrTaskConstruction
+		if _, err := r.New([]string{`fail`}); !errors.As(err, &construction) || !errors.Is(err, failure) {
+			t.Errorf(`unexpected error %#v`, err)
+		}
+	})
+}
+
+func TestRegistryRegistration(t *testing.T) {
+	factory := func(Values) (nbt.Task, error) { return mockTask(1), nil }
+	for i, test := range []struct {
+		name   string
+		schema Schema
+	}{
+		{`compile`, Schema{}},
+		{`bad name`, Schema{}},
+		{``, Schema{}},
+		{`x`, Schema{Params: []Param{{Name: `1st`}}}},
+		{`x`, Schema{Params: []Param{{Name: `a`}, {Name: `a`}}}},
+		{`x`, Schema{Params: []Param{{Name: `a`, Type: TypeEnum}}}},
+		{`x`, Schema{Params: []Param{{Name: `a`, Type: TypeInt, Default: `one`}}}},
+		{`x`, Schema{Params: []Param{{Name: `a`, Type: TypeEnum, Values: []string{`b`}, Default: `c`}}}},
+	} {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			var invalid *ErrInvalidRegistration
+			if err := newTestRegistry(t).RegisterTyped(test.name, test.schema, factory); !errors.As(err, &invalid) {
+				t.Errorf(`expected an invalid registration error, got %#v`, err)
+			}
+		})
+	}
+	if err := NewRegistry().RegisterTyped(`x`, Schema{Params: []Param{
+		{Name: `a`, Type: TypeEnum, Values: []string{`b`}, Required: true},
+	}}, factory); err != nil {
+		t.Error(`required parameters should not need a valid default: `, err)
+	}
+}
+
+func TestRegistryHelp(t *testing.T) {
+	r := newTestRegistry(t)
+	var overview strings.Builder
+	if err := r.Help(&overview, ``); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"  clean[(arguments)]                                  Removes the outputs.\n",
+		"  compile(source, mode=debug, jobs=1, verbose=false)  Compiles a source file.\n",
+		"  help(task=\"\")                                       Prints the help for a task, or an overview of all tasks.\n",
+	} {
+		if !strings.Contains(overview.String(), expected) {
+			t.Errorf(`overview %q does not contain %q`, overview.String(), expected)
+		}
+	}
+
+	var help strings.Builder
+	if err := r.Help(&help, `compile`); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Usage: compile(source, mode=debug, jobs=1, verbose=false)
+
+Compiles a source file.
+The object is written to build/.
+
+Parameters:
+  source   path                   required         The file to compile.
+  mode     one of debug, release  default "debug"
+  jobs     int                    default "1"
+  verbose  bool                   default "false"
+`
+	if help.String() != expected {
+		t.Errorf("unexpected help:\n%s\nexpected:\n%s", help.String(), expected)
+	}
+
+	var notFound *ErrTaskNotFound
+	if err := r.Help(&help, `missing`); !errors.As(err, &notFound) {
+		t.Errorf(`expected a task not found error, got %#v`, err)
+	}
+	if _, err := r.New([]string{`--help`, `missing`}); !errors.As(err, &notFound) {
+		t.Errorf(`expected a task not found error from --help, got %#v`, err)
+	}
+	if task, err := r.New([]string{`--help`, `compile`}); err != nil || !task.Matches(&helpTask{r, `compile`}) {
+		t.Errorf(`unexpected result of --help: %v, %v`, task, err)
+	}
+
+	t.Run(`help task`, func(t *testing.T) {
+		for i, test := range []struct {
+			invocation string
+			taskName   string
+		}{
+			{`help`, ``},
+			{`help(compile)`, `compile`},
+			{`help(task=clean)`, `clean`},
+		} {
+			test := test // Capture
+			t.Run(fmt.Sprint(i), func(t *testing.T) {
+				root, err := r.New([]string{test.invocation})
+				if err != nil {
+					t.Fatal(`unexpected error: `, err)
+				}
+				var handler nbttest.Recorder
+				root.Perform(&handler)
+				if required := handler.Required(nbt.EdgeRequired); len(required) != 1 ||
+					!required[0].Matches(&helpTask{r, test.taskName}) {
+					t.Errorf(`unexpected tasks %v`, required)
+				}
+			})
+		}
+		if _, err := r.New([]string{`help(compiel)`}); !errors.As(err, &notFound) || notFound.taskName != `compiel` {
+			t.Errorf(`expected a task not found error, got %#v`, err)
+		}
+
+		custom := NewRegistry()
+		if err := custom.Register(`help`, func(string) (nbt.Task, error) { return mockTask(1), nil }, Doc{}); err != nil {
+			t.Error(`the help task could not be replaced: `, err)
+		}
+	})
+}
+
+func TestRegistryList(t *testing.T) {
+	r := newTestRegistry(t)
+	var list strings.Builder
+	if err := r.List(&list); err != nil {
+		t.Fatal(err)
+	}
+	expected := `clean    Removes the outputs.
+compile  Compiles a source file.
+help     Prints the help for a task, or an overview of all tasks.
+`
+	if list.String() != expected {
+		t.Errorf("unexpected list:\n%s\nexpected:\n%s", list.String(), expected)
+	}
+	if task, err := r.New([]string{`--list`}); err != nil || !task.Matches(&listTask{r}) {
+		t.Errorf(`unexpected result of --list: %v, %v`, task, err)
+	}
+	var invalid *ErrInvalidInvocation
+	if _, err := r.New([]string{`--list`, `compile`}); !errors.As(err, &invalid) {
+		t.Errorf(`expected an invalid invocation error, got %#v`, err)
+	}
+}
+
+func TestSuggestions(t *testing.T) {
+	r := newTestRegistry(t)
+	r.Register(`cleanall`, func(string) (nbt.Task, error) { return mockTask(2), nil }, Doc{})
+	r.Register(`test`, func(string) (nbt.Task, error) { return mockTask(3), nil }, Doc{})
+	r.Register(`text`, func(string) (nbt.Task, error) { return mockTask(4), nil }, Doc{})
+	for i, test := range []struct {
+		name     string
+		expected []string
+		message  string
+	}{
+		{`complie`, []string{`compile`}, `task "complie" not found, did you mean "compile"?`},
+		{`Compile`, []string{`compile`}, `task "Compile" not found, did you mean "compile"?`},
+		{`clea`, []string{`clean`}, `task "clea" not found, did you mean "clean"?`},
+		{`teet`, []string{`test`, `text`}, `task "teet" not found, did you mean one of "test", "text"?`},
+		{`hlep`, []string{`help`}, `task "hlep" not found, did you mean "help"?`},
+		{`x`, nil, `task "x" not found`},
+		{`deploy`, nil, `task "deploy" not found`},
+	} {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			_, err := r.New([]string{test.name})
+			var notFound *ErrTaskNotFound
+			if !errors.As(err, &notFound) {
+				t.Fatalf(`expected a task not found error, got %#v`, err)
+			}
+			if !reflect.DeepEqual(notFound.Suggestions(), test.expected) || err.Error() != test.message {
+				t.Errorf(`unexpected suggestions %q with message %q`, notFound.Suggestions(), err.Error())
+			}
+		})
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for i, test := range []struct {
+		a, b     string
+		expected int
+	}{
+		{``, ``, 0},
+		{`abc`, ``, 3},
+		{``, `abc`, 3},
+		{`abc`, `abc`, 0},
+		{`abc`, `abd`, 1},
+		{`abc`, `acb`, 1},
+		{`kitten`, `sitting`, 3},
+		{`ca`, `abc`, 3},
+		{`ABC`, `abc`, 0},
+		{`héllo`, `hello`, 1},
+	} {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			if actual := editDistance(test.a, test.b); actual != test.expected {
+				t.Errorf(`distance between %q and %q: expected %d, got %d`, test.a, test.b, test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRegistryComplete(t *testing.T) {
+	r := newTestRegistry(t)
+	for i, test := range []struct {
+		partial  string
+		expected []string
+	}{
+		{``, []string{`clean`, `compile`, `help`}},
+		{`co`, []string{`compile`}},
+		{`x`, nil},
+		{`clean(`, nil},
+		{`compile(`, []string{`compile(source=`, `compile(mode=`, `compile(jobs=`, `compile(verbose=`}},
+		{`compile(a.c, `, []string{`compile(a.c, debug`, `compile(a.c, release`, `compile(a.c, mode=`,
+			`compile(a.c, jobs=`, `compile(a.c, verbose=`}},
+		{`compile(a.c, r`, []string{`compile(a.c, release`}},
+		{`compile(a.c,mode=`, []string{`compile(a.c,mode=debug`, `compile(a.c,mode=release`}},
+		{`compile(a.c, mode=release, v`, []string{`compile(a.c, mode=release, verbose=`}},
+		{`compile(a.c, release, 2, `, []string{`compile(a.c, release, 2, false`, `compile(a.c, release, 2, true`,
+			`compile(a.c, release, 2, verbose=`}},
+		{`compile("a,b", verbose=t`, []string{`compile("a,b", verbose=true`}},
+	} {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			if actual := r.Complete(test.partial); !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf(`completions of %q: expected %q, got %q`, test.partial, test.expected, actual)
+			}
+		})
+	}
+	if task, err := r.New([]string{`--complete`, `co`}); err != nil || !task.Matches(&completeTask{r, `co`}) {
+		t.Errorf(`unexpected result of --complete: %v, %v`, task, err)
+	}
+	if script := BashCompletion(`./my-build`); !strings.Contains(script, `complete -o nospace -F _my_build_complete './my-build'`) {
+		t.Errorf("unexpected completion script:\n%s", script)
+	}
+}
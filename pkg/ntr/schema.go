@@ -0,0 +1,273 @@
+package ntr
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* The type of a parameter, determining how its arguments are checked and converted. */
+type ParamType uint
+
+const (
+	/* Any text. */
+	TypeString ParamType = iota
+	/* A decimal integer, converted to int. */
+	TypeInt
+	/* One of the forms accepted by strconv.ParseBool, such as "true" or "0", converted to bool. */
+	TypeBool
+	/* A file path, which is cleaned. Only optional parameters may be empty, such as to leave the path unset
+	with an empty Default. */
+	TypePath
+	/* One of the Values of the parameter. */
+	TypeEnum
+)
+
+func (t ParamType) String() (name string) {
+	switch t {
+	case TypeString:
+		name = "string"
+	case TypeInt:
+		name = "int"
+	case TypeBool:
+		name = "bool"
+	case TypePath:
+		name = "path"
+	case TypeEnum:
+		name = "enum"
+	default:
+		name = "ERROR - UNKNOWN PARAMETER TYPE"
+	}
+	return
+}
+
+/* A parameter of a task. */
+type Param struct {
+	/* Letters, digits and underscores, not starting with a digit, so that the parameter may be named in invocations. */
+	Name string
+	Type ParamType
+	/* The allowed values of a TypeEnum parameter. */
+	Values []string
+	/* The argument used when none is given. Ignored if Required is set. */
+	Default     string
+	Required    bool
+	Description string
+}
+
+/* The parameters of a task, which may be given positionally in this order, or by name. */
+type Schema struct {
+	/* What the task does. The first line is shown when listing tasks, and the whole of it in the help for the task. */
+	Description string
+	Params      []Param
+}
+
+/* The converted arguments of a task, by parameter name. */
+type Values struct {
+	values map[string]interface{}
+}
+
+func (v Values) get(name, kind string) interface{} {
+	value, ok := v.values[name]
+	if !ok {
+		panic(fmt.Sprintf("ntr: no parameter %q", name))
+	}
+	switch value.(type) {
+	case string:
+		ok = kind == "string"
+	case int:
+		ok = kind == "int"
+	case bool:
+		ok = kind == "bool"
+	}
+	if !ok {
+		panic(fmt.Sprintf("ntr: parameter %q is not of type %s", name, kind))
+	}
+	return value
+}
+
+/* Returns the value of a TypeString, TypePath or TypeEnum parameter.
+Panics if there is no such parameter, or if it has another type. */
+func (v Values) String(name string) string { return v.get(name, "string").(string) }
+
+/* Returns the value of a TypeInt parameter. Panics if there is no such parameter, or if it has another type. */
+func (v Values) Int(name string) int { return v.get(name, "int").(int) }
+
+/* Returns the value of a TypeBool parameter. Panics if there is no such parameter, or if it has another type. */
+func (v Values) Bool(name string) bool { return v.get(name, "bool").(bool) }
+
+/* Makes a task from the converted arguments of its invocation. */
+type Factory func(Values) (nbt.Task, error)
+
+/* Error type returned when the arguments of an invocation do not fit the schema of the task. */
+type ErrInvalidArgument struct {
+	TaskName string
+	/* The parameter the argument was for, or empty if it matched no parameter. */
+	Param  string
+	Reason string
+}
+
+func (eia *ErrInvalidArgument) Error() string {
+	if eia.Param == "" {
+		return fmt.Sprintf("task %q: %s", eia.TaskName, eia.Reason)
+	}
+	return fmt.Sprintf("task %q: parameter %q: %s", eia.TaskName, eia.Param, eia.Reason)
+}
+
+func (s *Schema) param(name string) (*Param, bool) {
+	for i := range s.Params {
+		if s.Params[i].Name == name {
+			return &s.Params[i], true
+		}
+	}
+	return nil, false
+}
+
+func (s *Schema) validate(taskName string) error {
+	seen := make(map[string]bool)
+	for _, param := range s.Params {
+		if param.Name == "" || !isName(param.Name) {
+			return &ErrInvalidRegistration{taskName, fmt.Sprintf("invalid parameter name %q", param.Name)}
+		}
+		if seen[param.Name] {
+			return &ErrInvalidRegistration{taskName, fmt.Sprintf("parameter %q declared more than once", param.Name)}
+		}
+		seen[param.Name] = true
+		if param.Type == TypeEnum && len(param.Values) == 0 {
+			return &ErrInvalidRegistration{taskName, fmt.Sprintf("enum parameter %q has no values", param.Name)}
+		}
+		if !param.Required {
+			if _, err := param.convert(param.Default); err != nil {
+				return &ErrInvalidRegistration{taskName, fmt.Sprintf("default of parameter %q: %v", param.Name, err)}
+			}
+		}
+	}
+	return nil
+}
+
+func isName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isWordByte(s[i]) {
+			return false
+		}
+	}
+	return !('0' <= s[0] && s[0] <= '9')
+}
+
+/* Converts an argument to the type of the parameter. */
+func (p *Param) convert(arg string) (interface{}, error) {
+	switch p.Type {
+	case TypeInt:
+		value, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", arg)
+		}
+		return value, nil
+	case TypeBool:
+		value, err := strconv.ParseBool(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", arg)
+		}
+		return value, nil
+	case TypePath:
+		if arg == "" {
+			if p.Required {
+				return nil, fmt.Errorf("the path is empty")
+			}
+			return "", nil
+		}
+		return filepath.Clean(arg), nil
+	case TypeEnum:
+		for _, value := range p.Values {
+			if arg == value {
+				return arg, nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not one of %s", arg, strings.Join(p.Values, ", "))
+	}
+	return arg, nil
+}
+
+/* Checks the arguments against the schema and converts them. */
+func (s *Schema) bind(taskName string, args Args) (Values, error) {
+	if len(args.Positional) > len(s.Params) {
+		return Values{}, &ErrInvalidArgument{taskName, "", fmt.Sprintf(
+			"%d positional arguments given, but the task takes at most %d", len(args.Positional), len(s.Params),
+		)}
+	}
+	given := make(map[string]string, len(s.Params))
+	for i, arg := range args.Positional {
+		given[s.Params[i].Name] = arg
+	}
+	for name, arg := range args.Named {
+		if _, ok := s.param(name); !ok {
+			return Values{}, &ErrInvalidArgument{taskName, name, "no such parameter"}
+		}
+		if _, ok := given[name]; ok {
+			return Values{}, &ErrInvalidArgument{taskName, name, "given both positionally and by name"}
+		}
+		given[name] = arg
+	}
+	values := Values{make(map[string]interface{}, len(s.Params))}
+	for _, param := range s.Params {
+		arg, ok := given[param.Name]
+		if !ok {
+			if param.Required {
+				return Values{}, &ErrInvalidArgument{taskName, param.Name, "missing required argument"}
+			}
+			arg = param.Default
+		}
+		value, err := param.convert(arg)
+		if err != nil {
+			return Values{}, &ErrInvalidArgument{taskName, param.Name, err.Error()}
+		}
+		values.values[param.Name] = value
+	}
+	return values, nil
+}
+
+/* Returns the signature of an invocation of the task, such as "compile(source, opt=O2)". */
+func (s *Schema) signature(taskName string) string {
+	if len(s.Params) == 0 {
+		return taskName
+	}
+	params := make([]string, len(s.Params))
+	for i, param := range s.Params {
+		params[i] = param.Name
+		if !param.Required && param.Default == "" {
+			params[i] += `=""`
+		} else if !param.Required {
+			params[i] += "=" + param.Default
+		}
+	}
+	return taskName + "(" + strings.Join(params, ", ") + ")"
+}
+
+/* Describes the type of a parameter for help output, such as "int" or "one of debug, release". */
+func (p *Param) typeDescription() string {
+	if p.Type == TypeEnum {
+		return "one of " + strings.Join(p.Values, ", ")
+	}
+	return p.Type.String()
+}
+
+/* Returns the candidates for an argument of the parameter starting with prefix. */
+func (p *Param) complete(prefix string) []string {
+	var candidates []string
+	values := p.Values
+	switch p.Type {
+	case TypeBool:
+		values = []string{"false", "true"}
+	case TypeEnum:
+	default:
+		return nil
+	}
+	for _, value := range values {
+		if strings.HasPrefix(value, prefix) {
+			candidates = append(candidates, value)
+		}
+	}
+	return candidates
+}
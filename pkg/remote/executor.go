@@ -0,0 +1,305 @@
+package remote
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/kyle_anderson/nbt/internal/atomicfile"
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* Limit on the time taken to connect to a worker. */
+const dialTimeout = 5 * time.Second
+
+/* Default limit on the time taken by a worker to run an action. */
+const DefaultTimeout = 10 * time.Minute
+
+/* Runs the commands of remotable actions on workers. Connections to the workers are opened as needed
+and reused by later actions. Safe for concurrent use. */
+type Executor struct {
+	/* Limit on the time taken by a worker to run an action and respond with its outputs, after which the
+	connection to the worker is closed. Zero means no limit. NewExecutor sets it to DefaultTimeout, and it may
+	be changed before the executor is used. */
+	Timeout   time.Duration
+	root      string
+	token     string
+	addresses []string
+	/* Index of the next address to connect to, so that actions are spread across the workers. */
+	next atomic.Uint64
+	/* Where the output of commands is relayed. */
+	stdout, stderr io.Writer
+	outputMu       sync.Mutex
+
+	mu   sync.Mutex
+	idle []*conn
+}
+
+var _ nbt.RemoteExecutor = (*Executor)(nil)
+
+/* Returns an executor for the workers at the given addresses, authenticating to them with the token.
+Relative paths of inputs and outputs are resolved against the current directory, and are then sent to workers
+relative to root. The output of commands is relayed to stdout and stderr, which may be nil to discard it. */
+func NewExecutor(root, token string, stdout, stderr io.Writer, addresses ...string) (*Executor, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("no worker addresses given")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	if stderr == nil {
+		stderr = io.Discard
+	}
+	return &Executor{Timeout: DefaultTimeout, root: root, token: token, addresses: addresses, stdout: stdout, stderr: stderr}, nil
+}
+
+/* Counts the bytes read through it. */
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+/* A connection to a worker. */
+type conn struct {
+	net.Conn
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+	/* Counts the bytes received from the worker. */
+	received *countingReader
+}
+
+/* Opens a connection to the worker at the address and authenticates to it. */
+func (x *Executor) connect(address string) (*conn, error) {
+	c, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	received := &countingReader{Reader: c}
+	result := &conn{c, gob.NewEncoder(c), gob.NewDecoder(received), received}
+	var reply helloReply
+	if err := result.encoder.Encode(&hello{x.token}); err == nil {
+		err = result.decoder.Decode(&reply)
+	}
+	switch {
+	case err != nil:
+	case reply.Err != "":
+		err = &ErrWorker{reply.Err}
+	default:
+		return result, nil
+	}
+	c.Close()
+	return nil, fmt.Errorf("connecting to %s: %w", address, err)
+}
+
+/* Returns an idle connection, if there is one. */
+func (x *Executor) takeIdle() *conn {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	n := len(x.idle)
+	if n == 0 {
+		return nil
+	}
+	c := x.idle[n-1]
+	x.idle = x.idle[:n-1]
+	return c
+}
+
+/* Opens a new connection to one of the workers, trying each worker once, starting with the next in turn. */
+func (x *Executor) dial() (*conn, error) {
+	var err error
+	start := x.next.Add(1)
+	for i := range x.addresses {
+		address := x.addresses[(start+uint64(i))%uint64(len(x.addresses))]
+		var c *conn
+		if c, err = x.connect(address); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+func (x *Executor) release(c *conn) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.idle = append(x.idle, c)
+}
+
+/* Closes the idle connections to workers. */
+func (x *Executor) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, c := range x.idle {
+		c.Close()
+	}
+	x.idle = nil
+	return nil
+}
+
+/* Returns the path relative to the root. */
+func (x *Executor) relative(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(x.root, abs)
+	if err != nil {
+		return "", &ErrOutsideRoot{path}
+	}
+	return checkRelative(rel)
+}
+
+func (x *Executor) Execute(action nbt.ActionSpec) error {
+	req, err := x.newRequest(&action)
+	if err != nil {
+		/* The action cannot be sent, but may still be performed locally. */
+		return &nbt.ErrExecutorUnavailable{Err: err}
+	}
+	var result *response
+	if c := x.takeIdle(); c != nil {
+		/* The worker may have gone away since the connection was last used, in which case the request is retried
+		on a new connection. Outputs are only written locally once a request succeeds, so retrying is safe
+		as long as the worker has not responded, and so has not relayed any output. */
+		var noResponse *errNoResponse
+		if result, err = x.sendOrClose(c, req); err != nil && !errors.As(err, &noResponse) {
+			return err
+		}
+	}
+	if result == nil {
+		c, err := x.dial()
+		if err != nil {
+			return &nbt.ErrExecutorUnavailable{Err: err}
+		}
+		var noResponse *errNoResponse
+		if result, err = x.sendOrClose(c, req); errors.As(err, &noResponse) {
+			return &nbt.ErrExecutorUnavailable{Err: err}
+		} else if err != nil {
+			return err
+		}
+	}
+	switch {
+	case result.Err != "":
+		return &ErrWorker{result.Err}
+	case result.ExitCode != 0:
+		return &ErrCommandFailed{action.Command, result.ExitCode}
+	case len(result.Outputs) != len(action.Outputs):
+		return &ErrWorker{fmt.Sprintf("returned %d outputs, expected %d", len(result.Outputs), len(action.Outputs))}
+	}
+	/* Nothing is written unless every output is the one requested, so that a worker cannot write anywhere else. */
+	for i, output := range result.Outputs {
+		path, err := checkRelative(output.Path)
+		if err != nil {
+			return err
+		}
+		if path != req.Outputs[i] {
+			return &ErrWorker{fmt.Sprintf("returned output %q in place of %q", output.Path, req.Outputs[i])}
+		}
+	}
+	for i, output := range result.Outputs {
+		if err := atomicfile.WriteFile(action.Outputs[i], output.Data, output.Mode); err != nil {
+			return fmt.Errorf("writing output %q: %w", action.Outputs[i], err)
+		}
+	}
+	return nil
+}
+
+func (x *Executor) newRequest(action *nbt.ActionSpec) (*request, error) {
+	req := &request{Command: action.Command, Env: action.Env, Outputs: make([]string, len(action.Outputs))}
+	/* The headers found by an earlier run are sent along, although the worker may need ones not yet listed. */
+	inputs, err := action.AllInputs()
+	if err != nil {
+		return nil, err
+	}
+	for _, input := range inputs {
+		path, err := x.relative(input)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(input)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(input)
+		if err != nil {
+			return nil, err
+		}
+		req.Inputs = append(req.Inputs, file{path, info.Mode().Perm(), data})
+	}
+	for i, output := range action.Outputs {
+		path, err := x.relative(output)
+		if err != nil {
+			return nil, err
+		}
+		req.Outputs[i] = path
+	}
+	return req, nil
+}
+
+/* Error given by sendOrClose when the worker failed before responding, so the request may be sent again. */
+type errNoResponse struct {
+	err error
+}
+
+func (err *errNoResponse) Error() string { return fmt.Sprintf("no response from the worker: %v", err.err) }
+func (err *errNoResponse) Unwrap() error { return err.err }
+
+/* Sends the request over the connection with send, releasing the connection afterwards, or closing it if it
+failed. If the worker had already responded, the error is an ErrConnectionLost, and otherwise it is an
+errNoResponse. */
+func (x *Executor) sendOrClose(c *conn, req *request) (*response, error) {
+	before := c.received.count
+	result, err := x.send(c, req)
+	switch {
+	case err == nil:
+		x.release(c)
+		return result, nil
+	case c.received.count != before:
+		c.Close()
+		return nil, &ErrConnectionLost{err}
+	default:
+		c.Close()
+		return nil, &errNoResponse{err}
+	}
+}
+
+/* Sends the request over the connection, relaying output until the final response, which is returned.
+Fails once the timeout of the executor passes, leaving the connection unusable. */
+func (x *Executor) send(c *conn, req *request) (*response, error) {
+	if x.Timeout > 0 {
+		if err := c.SetDeadline(time.Now().Add(x.Timeout)); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.encoder.Encode(req); err != nil {
+		return nil, err
+	}
+	for {
+		var message response
+		if err := c.decoder.Decode(&message); err != nil {
+			return nil, err
+		}
+		if message.Done {
+			return &message, c.SetDeadline(time.Time{})
+		}
+		x.outputMu.Lock()
+		x.stdout.Write(message.Stdout)
+		x.stderr.Write(message.Stderr)
+		x.outputMu.Unlock()
+	}
+}
@@ -0,0 +1,100 @@
+/*
+remote: Runs the commands of remotable nbt tasks on worker processes, over TCP.
+A client first authenticates to a worker with a token shared by the clients and the worker,
+which the worker checks before accepting any request. Since the token and files are sent in the clear,
+workers should only be reachable from a trusted network, or through a tunnel. The client then sends
+a request holding the command line, environment and input files of an action over a connection
+to a worker. The worker runs the command in a scratch directory, relaying its output as it is produced,
+and finally responds with the action's output files. Paths are relative to the root of the build,
+and commands are run with the scratch directory as their working directory, so they should only refer
+to inputs and outputs by relative paths. Messages are encoded with encoding/gob.
+*/
+package remote
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+/* A file sent over a connection. */
+type file struct {
+	/* Path relative to the root of the build. */
+	Path string
+	Mode fs.FileMode
+	Data []byte
+}
+
+/* The first message from a client on a connection. */
+type hello struct {
+	Token string
+}
+
+/* The reply of the worker to hello. Err is set if the client was rejected, after which the connection is closed. */
+type helloReply struct {
+	Err string
+}
+
+/* A request to run an action. */
+type request struct {
+	Command []string
+	Env     []string
+	Inputs  []file
+	Outputs []string
+}
+
+/* A message from the worker about a running request. Every message other than the last relays output of the command. */
+type response struct {
+	Stdout, Stderr []byte
+	/* Set on the last message for a request. */
+	Done     bool
+	ExitCode int
+	/* Description of a failure to run the command, such as the command not existing or an output not being written. */
+	Err     string
+	Outputs []file
+}
+
+/* Error given when the command of an action exits with a non-zero status. */
+type ErrCommandFailed struct {
+	Command  []string
+	ExitCode int
+}
+
+func (err *ErrCommandFailed) Error() string {
+	return fmt.Sprintf("command %q exited with status %d", err.Command, err.ExitCode)
+}
+
+/* Error given when a worker fails to run the command of an action. */
+type ErrWorker struct {
+	Message string
+}
+
+func (err *ErrWorker) Error() string { return "remote worker: " + err.Message }
+
+/* Error given when the connection to a worker is lost after it started to respond to a request. The action is
+not retried, since the output the worker relayed would be relayed again. */
+type ErrConnectionLost struct {
+	Err error
+}
+
+func (err *ErrConnectionLost) Error() string {
+	return fmt.Sprintf("connection to the worker lost during the action: %v", err.Err)
+}
+func (err *ErrConnectionLost) Unwrap() error { return err.Err }
+
+/* Error given for paths which are not within the root of the build. */
+type ErrOutsideRoot struct {
+	Path string
+}
+
+func (err *ErrOutsideRoot) Error() string { return fmt.Sprintf("path %q is outside the root of the build", err.Path) }
+
+/* Checks that the path is relative and does not leave the directory it is relative to, returning it cleaned. */
+func checkRelative(path string) (string, error) {
+	cleaned := filepath.Clean(path)
+	if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", &ErrOutsideRoot{path}
+	}
+	return cleaned, nil
+}
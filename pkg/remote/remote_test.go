@@ -0,0 +1,379 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* The token shared by the workers and clients of the tests. */
+const testToken = `secret`
+
+/* Starts a worker on localhost, returning its address. */
+func startWorker(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go NewWorker(4, testToken).Serve(listener)
+	return listener.Addr().String()
+}
+
+func requireShell(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath(`sh`); err != nil {
+		t.Skip(`sh is needed to run commands: `, err)
+	}
+}
+
+func TestExecutor(t *testing.T) {
+	requireShell(t)
+	root := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	x, err := NewExecutor(root, testToken, &stdout, &stderr, startWorker(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	input := filepath.Join(root, `in.txt`)
+	if err := os.WriteFile(input, []byte(`input`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run(`runs commands on the worker`, func(t *testing.T) {
+		output := filepath.Join(root, `out`, `result.txt`)
+		err := x.Execute(nbt.ActionSpec{
+			Inputs:  []string{input},
+			Outputs: []string{output},
+			Command: []string{`sh`, `-c`, `cat in.txt > out/result.txt; echo "$GREETING"; echo problem >&2`},
+			Env:     []string{`GREETING=relayed`},
+		})
+		if err != nil {
+			t.Fatal(`Execute: `, err)
+		}
+		if data, err := os.ReadFile(output); err != nil || string(data) != `input` {
+			t.Errorf(`unexpected output %q, error %v`, data, err)
+		}
+		if stdout.String() != "relayed\n" || stderr.String() != "problem\n" {
+			t.Errorf(`unexpected relayed output %q and %q`, stdout.String(), stderr.String())
+		}
+	})
+
+	for i, test := range []struct {
+		action nbt.ActionSpec
+		check  func(error) bool
+	}{
+		{
+			nbt.ActionSpec{Command: []string{`sh`, `-c`, `exit 3`}},
+			func(err error) bool {
+				var failed *ErrCommandFailed
+				return errors.As(err, &failed) && failed.ExitCode == 3
+			},
+		},
+		{
+			nbt.ActionSpec{Command: []string{`sh`, `-c`, `true`}, Outputs: []string{filepath.Join(root, `never-written`)}},
+			func(err error) bool {
+				var workerErr *ErrWorker
+				return errors.As(err, &workerErr)
+			},
+		},
+		{
+			nbt.ActionSpec{Command: []string{`nbt-no-such-command`}},
+			func(err error) bool {
+				var workerErr *ErrWorker
+				return errors.As(err, &workerErr)
+			},
+		},
+		{
+			nbt.ActionSpec{Command: []string{`sh`, `-c`, `true`}, Inputs: []string{filepath.Join(root, `..`, `outside`)}},
+			func(err error) bool {
+				var unavailable *nbt.ErrExecutorUnavailable
+				var outside *ErrOutsideRoot
+				return errors.As(err, &unavailable) && errors.As(err, &outside)
+			},
+		},
+	} {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			if err := x.Execute(test.action); !test.check(err) {
+				t.Errorf(`unexpected error: %v`, err)
+			}
+		})
+	}
+
+	t.Run(`does not pass the environment of the worker`, func(t *testing.T) {
+		t.Setenv(`NBT_WORKER_SECRET`, `leaked`)
+		var stdout bytes.Buffer
+		x, _ := NewExecutor(root, testToken, &stdout, nil, startWorker(t))
+		defer x.Close()
+		err := x.Execute(nbt.ActionSpec{Command: []string{`sh`, `-c`, `echo "${NBT_WORKER_SECRET-unset}"`}})
+		if err != nil || stdout.String() != "unset\n" {
+			t.Errorf(`unexpected output %q, error %v`, stdout.String(), err)
+		}
+	})
+
+	t.Run(`rejects invalid tokens`, func(t *testing.T) {
+		x, _ := NewExecutor(root, `wrong`, nil, nil, startWorker(t))
+		defer x.Close()
+		var unavailable *nbt.ErrExecutorUnavailable
+		var workerErr *ErrWorker
+		if err := x.Execute(nbt.ActionSpec{Command: []string{`true`}}); !errors.As(err, &unavailable) || !errors.As(err, &workerErr) {
+			t.Errorf(`expected ErrExecutorUnavailable from the worker, got %v`, err)
+		}
+	})
+
+	t.Run(`unreachable workers`, func(t *testing.T) {
+		listener, _ := net.Listen(`tcp`, `127.0.0.1:0`)
+		address := listener.Addr().String()
+		listener.Close()
+		x, _ := NewExecutor(root, testToken, nil, nil, address)
+		var unavailable *nbt.ErrExecutorUnavailable
+		if err := x.Execute(nbt.ActionSpec{Command: []string{`true`}}); !errors.As(err, &unavailable) {
+			t.Errorf(`expected ErrExecutorUnavailable, got %v`, err)
+		}
+	})
+}
+
+/* Starts a fake worker on localhost which accepts any client and answers each request with respond, which is told
+whether the request is the first of its connection and returns false to hang up. Returns the address of the worker
+and a count of the requests. */
+func startFakeWorker(t *testing.T, respond func(first bool, req *request, encoder *gob.Encoder) bool) (string, *atomic.Int32) {
+	t.Helper()
+	listener, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var requests atomic.Int32
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				decoder, encoder := gob.NewDecoder(c), gob.NewEncoder(c)
+				var h hello
+				if decoder.Decode(&h) != nil || encoder.Encode(&helloReply{}) != nil {
+					return
+				}
+				for first := true; ; first = false {
+					var req request
+					if decoder.Decode(&req) != nil {
+						return
+					}
+					requests.Add(1)
+					if !respond(first, &req, encoder) {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), &requests
+}
+
+/* Starts a fake worker which completes the first request of each connection. On later requests, it relays some
+output and then hangs up. */
+func startFailingWorker(t *testing.T) (string, *atomic.Int32) {
+	return startFakeWorker(t, func(first bool, req *request, encoder *gob.Encoder) bool {
+		encoder.Encode(&response{Stdout: []byte(`partial `)})
+		if !first {
+			return false
+		}
+		encoder.Encode(&response{Done: true})
+		return true
+	})
+}
+
+func TestRetries(t *testing.T) {
+	address, requests := startFailingWorker(t)
+	var stdout bytes.Buffer
+	x, _ := NewExecutor(t.TempDir(), testToken, &stdout, nil, address)
+	defer x.Close()
+	if err := x.Execute(nbt.ActionSpec{Command: []string{`true`}}); err != nil {
+		t.Fatal(`first action: `, err)
+	}
+	/* The pooled connection fails after the worker relayed output, so retrying would relay it again. */
+	var lost *ErrConnectionLost
+	var unavailable *nbt.ErrExecutorUnavailable
+	if err := x.Execute(nbt.ActionSpec{Command: []string{`true`}}); !errors.As(err, &lost) || errors.As(err, &unavailable) {
+		t.Errorf(`expected ErrConnectionLost, got %v`, err)
+	}
+	if count := requests.Load(); count != 2 {
+		t.Errorf(`worker received %d requests, expected 2`, count)
+	}
+	if output := stdout.String(); output != `partial partial ` {
+		t.Errorf(`unexpected relayed output %q`, output)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	/* The worker accepts the request but never responds. */
+	address, _ := startFakeWorker(t, func(bool, *request, *gob.Encoder) bool { return true })
+	x, _ := NewExecutor(t.TempDir(), testToken, nil, nil, address)
+	defer x.Close()
+	x.Timeout = 50 * time.Millisecond
+	done := make(chan error)
+	go func() { done <- x.Execute(nbt.ActionSpec{Command: []string{`true`}}) }()
+	select {
+	case err := <-done:
+		var unavailable *nbt.ErrExecutorUnavailable
+		var netErr net.Error
+		if !errors.As(err, &unavailable) || !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf(`expected ErrExecutorUnavailable from a timeout, got %v`, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal(`Execute did not return after its timeout`)
+	}
+}
+
+func TestUnexpectedOutputs(t *testing.T) {
+	for i, test := range []struct {
+		path  string
+		check func(error) bool
+	}{
+		{`../escaped`, func(err error) bool {
+			var outside *ErrOutsideRoot
+			return errors.As(err, &outside)
+		}},
+		{`/escaped`, func(err error) bool {
+			var outside *ErrOutsideRoot
+			return errors.As(err, &outside)
+		}},
+		{`other`, func(err error) bool {
+			var workerErr *ErrWorker
+			return errors.As(err, &workerErr)
+		}},
+	} {
+		test := test // Capture
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			address, _ := startFakeWorker(t, func(_ bool, req *request, encoder *gob.Encoder) bool {
+				encoder.Encode(&response{Done: true, Outputs: []file{{Path: test.path, Mode: 0o644, Data: []byte(`bad`)}}})
+				return true
+			})
+			root := filepath.Join(t.TempDir(), `root`)
+			x, _ := NewExecutor(root, testToken, nil, nil, address)
+			defer x.Close()
+			output := filepath.Join(root, `out`)
+			if err := x.Execute(nbt.ActionSpec{Outputs: []string{output}, Command: []string{`true`}}); !test.check(err) {
+				t.Errorf(`unexpected error: %v`, err)
+			}
+			for _, path := range []string{output, filepath.Join(root, test.path), filepath.Join(filepath.Dir(root), `escaped`)} {
+				if _, err := os.Stat(path); err == nil {
+					t.Errorf(`%s was written`, path)
+				}
+			}
+		})
+	}
+}
+
+/* A task which copies its input to its output, either with a command on a worker or locally. */
+type copyTask struct {
+	input, output string
+	requires      []nbt.Task
+	runs          atomic.Int32
+}
+
+func (t *copyTask) Hash() uint64 { return uint64(len(t.output)) }
+func (t *copyTask) Matches(other nbt.Task) bool {
+	converted, ok := other.(*copyTask)
+	return ok && converted.output == t.output
+}
+func (t *copyTask) Perform(nbt.Handler) error {
+	t.runs.Add(1)
+	data, err := os.ReadFile(t.input)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(t.output, data, 0o644)
+}
+func (t *copyTask) Action() nbt.ActionSpec {
+	return nbt.ActionSpec{
+		Requires:  t.requires,
+		Inputs:    []string{t.input},
+		Outputs:   []string{t.output},
+		Command:   []string{`cp`, filepath.Base(t.input), filepath.Base(t.output)},
+		Remotable: true,
+	}
+}
+
+/* A task requiring all of the given tasks. */
+type groupTask []nbt.Task
+
+func (groupTask) Hash() uint64                { return 0 }
+func (groupTask) Matches(other nbt.Task) bool { _, ok := other.(groupTask); return ok }
+func (g groupTask) Perform(h nbt.Handler) error {
+	h.RequireAll(g...)
+	return nil
+}
+
+func TestRemoteBuild(t *testing.T) {
+	requireShell(t)
+	root := t.TempDir()
+	source := filepath.Join(root, `source`)
+	os.WriteFile(source, []byte(`contents`), 0o644)
+	/* Half of the tasks copy the source, and the others copy the copies, so that inputs generated on one worker
+	are sent to another. */
+	var tasks []*copyTask
+	for i := 0; i < 20; i++ {
+		first := &copyTask{input: source, output: filepath.Join(root, fmt.Sprint(`first`, i))}
+		second := &copyTask{input: first.output, output: filepath.Join(root, fmt.Sprint(`second`, i)), requires: []nbt.Task{first}}
+		tasks = append(tasks, first, second)
+	}
+	build := func(x nbt.RemoteExecutor) *nbt.Result {
+		group := make(groupTask, len(tasks))
+		for i, task := range tasks {
+			group[i] = task
+		}
+		return nbt.StartWithOptions(group, nbt.Options{MaxParallelTasks: 8, Executor: x})
+	}
+
+	x, err := NewExecutor(root, testToken, nil, nil, startWorker(t), startWorker(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	if result := build(x); !result.Succeeded() {
+		t.Fatal(`build failed: `, result.Failed)
+	}
+	for _, task := range tasks {
+		if runs := task.runs.Load(); runs != 0 {
+			t.Errorf(`%s was performed locally %d times`, task.output, runs)
+		}
+		if data, err := os.ReadFile(task.output); err != nil || string(data) != `contents` {
+			t.Errorf(`unexpected contents %q of %s, error %v`, data, task.output, err)
+		}
+	}
+
+	t.Run(`falls back to local execution`, func(t *testing.T) {
+		listener, _ := net.Listen(`tcp`, `127.0.0.1:0`)
+		address := listener.Addr().String()
+		listener.Close()
+		x, _ := NewExecutor(root, testToken, nil, nil, address)
+		for _, task := range tasks {
+			os.Remove(task.output)
+		}
+		if result := build(x); !result.Succeeded() {
+			t.Fatal(`build failed: `, result.Failed)
+		}
+		for _, task := range tasks {
+			if runs := task.runs.Load(); runs != 1 {
+				t.Errorf(`%s was performed %d times, expected once`, task.output, runs)
+			}
+		}
+	})
+}
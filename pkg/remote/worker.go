@@ -0,0 +1,197 @@
+package remote
+
+import (
+	"crypto/subtle"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/* Limit on the time a client takes to authenticate after connecting. */
+const helloTimeout = 10 * time.Second
+
+/* Runs the actions requested by clients. */
+type Worker struct {
+	/* The environment of every command, followed by the variables of the request. None of the other variables
+	of the worker are passed on, since they may hold its secrets. Defaults to the PATH of the worker, so that
+	commands find the same programs as the worker does. */
+	Env   []string
+	token []byte
+	/* Limits the number of commands running at the same time. */
+	slots chan struct{}
+}
+
+/* Returns a worker running at most maxParallel commands at the same time, which must be positive,
+for the clients presenting the given token, which must not be empty. */
+func NewWorker(maxParallel uint, token string) *Worker {
+	if maxParallel <= 0 {
+		panic("maxParallel must be positive!")
+	}
+	if token == "" {
+		panic("token must not be empty!")
+	}
+	return &Worker{[]string{"PATH=" + os.Getenv("PATH")}, []byte(token), make(chan struct{}, maxParallel)}
+}
+
+/* Serves connections from the listener until it is closed. */
+func (w *Worker) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go w.serveConn(conn)
+	}
+}
+
+/* Handles the requests of a connection one at a time, until the client hangs up. */
+func (w *Worker) serveConn(conn net.Conn) {
+	defer conn.Close()
+	decoder, encoder := gob.NewDecoder(conn), gob.NewEncoder(conn)
+	if err := w.authenticate(conn, decoder, encoder); err != nil {
+		log.Printf("nbt worker: %v: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	for {
+		var req request
+		if err := decoder.Decode(&req); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("nbt worker: %v: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if err := w.run(&req, encoder); err != nil {
+			log.Printf("nbt worker: %v: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+/* Reads the hello of the client and checks its token, replying to it. Returns an error if the client was rejected. */
+func (w *Worker) authenticate(conn net.Conn, decoder *gob.Decoder, encoder *gob.Encoder) error {
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	var h hello
+	if err := decoder.Decode(&h); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	if subtle.ConstantTimeCompare([]byte(h.Token), w.token) != 1 {
+		encoder.Encode(&helloReply{"invalid token"})
+		return errors.New("rejected a client with an invalid token")
+	}
+	return encoder.Encode(&helloReply{})
+}
+
+/* Relays the output of a command as it is written. */
+type relay struct {
+	mu      *sync.Mutex
+	encoder *gob.Encoder
+	stderr  bool
+	/* The first error encountered sending to the client. */
+	err *error
+}
+
+func (r relay) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if *r.err != nil {
+		return 0, *r.err
+	}
+	message := response{Stdout: p}
+	if r.stderr {
+		message = response{Stderr: p}
+	}
+	if err := r.encoder.Encode(&message); err != nil {
+		*r.err = err
+		return 0, err
+	}
+	return len(p), nil
+}
+
+/* Runs the request, sending its responses with the encoder. Only errors communicating with the client are returned. */
+func (w *Worker) run(req *request, encoder *gob.Encoder) error {
+	w.slots <- struct{}{}
+	defer func() { <-w.slots }()
+	var mu sync.Mutex
+	var sendErr error
+	result := w.execute(req, relay{&mu, encoder, false, &sendErr}, relay{&mu, encoder, true, &sendErr})
+	mu.Lock()
+	defer mu.Unlock()
+	if sendErr != nil {
+		return sendErr
+	}
+	result.Done = true
+	return encoder.Encode(&result)
+}
+
+func (w *Worker) execute(req *request, stdout, stderr io.Writer) response {
+	fail := func(err error) response { return response{ExitCode: -1, Err: err.Error()} }
+	if len(req.Command) == 0 {
+		return fail(errors.New("empty command"))
+	}
+	dir, err := os.MkdirTemp("", "nbt-worker-")
+	if err != nil {
+		return fail(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, input := range req.Inputs {
+		path, err := checkRelative(input.Path)
+		if err != nil {
+			return fail(err)
+		}
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fail(err)
+		}
+		if err := os.WriteFile(path, input.Data, input.Mode); err != nil {
+			return fail(err)
+		}
+	}
+	outputs := make([]string, len(req.Outputs))
+	for i, output := range req.Outputs {
+		path, err := checkRelative(output)
+		if err != nil {
+			return fail(err)
+		}
+		outputs[i] = filepath.Join(dir, path)
+		/* Commands expect the directories of their outputs to exist, as they do locally. */
+		if err := os.MkdirAll(filepath.Dir(outputs[i]), 0o755); err != nil {
+			return fail(err)
+		}
+	}
+
+	cmd := exec.Command(req.Command[0], req.Command[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(append([]string(nil), w.Env...), req.Env...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return response{ExitCode: exitErr.ExitCode()}
+		}
+		return fail(err)
+	}
+
+	var result response
+	for i, path := range outputs {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fail(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fail(err)
+		}
+		result.Outputs = append(result.Outputs, file{req.Outputs[i], info.Mode().Perm(), data})
+	}
+	return result
+}
@@ -0,0 +1,136 @@
+//go:build linux
+
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+/* Events on the directories of watched files that may mean a watched file changed. Directories rather than files
+are watched, since editors often replace files by renaming new ones over them. */
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+/* A watcher using inotify. */
+type inotify struct {
+	file    *os.File
+	changes chan string
+	done    chan struct{}
+	once    sync.Once
+
+	mu sync.Mutex
+	/* Watched directories by their watch descriptors, and the other way around. */
+	dirs        map[int32]string
+	descriptors map[string]int32
+	files       map[string]bool
+}
+
+func newNative() (Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotify{
+		/* The descriptor is non-blocking, so reads go through the runtime's poller and are interrupted by Close. */
+		file:        os.NewFile(uintptr(fd), "inotify"),
+		changes:     make(chan string),
+		done:        make(chan struct{}),
+		dirs:        make(map[int32]string),
+		descriptors: make(map[string]int32),
+		files:       make(map[string]bool),
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *inotify) Watch(paths []string) error {
+	files := pathSet(paths)
+	dirs := make(map[string]bool)
+	for file := range files {
+		dirs[filepath.Dir(file)] = true
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files = files
+	for dir, wd := range w.descriptors {
+		if !dirs[dir] {
+			/* Fails if the directory was removed, in which case the watch is already gone. */
+			syscall.InotifyRmWatch(int(w.file.Fd()), uint32(wd))
+			delete(w.descriptors, dir)
+			delete(w.dirs, wd)
+		}
+	}
+	/* Directories that cannot be watched are skipped, and the first failure is returned. */
+	var firstErr error
+	for dir := range dirs {
+		if _, ok := w.descriptors[dir]; ok {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(int(w.file.Fd()), dir, inotifyMask)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+			}
+			continue
+		}
+		w.descriptors[dir] = int32(wd)
+		w.dirs[int32(wd)] = dir
+	}
+	return firstErr
+}
+
+func (w *inotify) Changes() <-chan string { return w.changes }
+
+func (w *inotify) Close() error {
+	var err error
+	w.once.Do(func() {
+		close(w.done)
+		err = w.file.Close()
+	})
+	return err
+}
+
+func (w *inotify) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, path := range w.parse(buf[:n]) {
+			select {
+			case w.changes <- path:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+/* Returns the watched files named by the events in the buffer. */
+func (w *inotify) parse(buf []byte) (changed []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameStart := offset + syscall.SizeofInotifyEvent
+		name := buf[nameStart : nameStart+int(event.Len)]
+		offset = nameStart + int(event.Len)
+		/* Names are padded with null bytes. */
+		for len(name) > 0 && name[len(name)-1] == 0 {
+			name = name[:len(name)-1]
+		}
+		dir, ok := w.dirs[event.Wd]
+		if !ok {
+			continue
+		}
+		if path := filepath.Join(dir, string(name)); w.files[path] {
+			changed = append(changed, path)
+		}
+	}
+	return
+}
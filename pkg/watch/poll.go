@@ -0,0 +1,89 @@
+package watch
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+/* The state of a file, as seen by a polling watcher. */
+type fileState struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func stat(path string) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{true, info.Size(), info.ModTime()}
+}
+
+/* A watcher which checks the files for changes at a fixed interval. Works everywhere, but misses changes that
+leave the size and modification time of a file as they were, and reports changes up to an interval late. */
+type Polling struct {
+	changes chan string
+	done    chan struct{}
+	once    sync.Once
+
+	mu    sync.Mutex
+	files map[string]fileState
+}
+
+func NewPolling(interval time.Duration) *Polling {
+	w := &Polling{changes: make(chan string), done: make(chan struct{}), files: make(map[string]fileState)}
+	go w.poll(interval)
+	return w
+}
+
+func (w *Polling) Watch(paths []string) error {
+	files := make(map[string]fileState, len(paths))
+	for path := range pathSet(paths) {
+		files[path] = stat(path)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files = files
+	return nil
+}
+
+func (w *Polling) Changes() <-chan string { return w.changes }
+
+func (w *Polling) Close() error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
+
+func (w *Polling) poll(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.done:
+			return
+		}
+		for _, path := range w.check() {
+			select {
+			case w.changes <- path:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+/* Returns the files that changed since they were last checked. */
+func (w *Polling) check() (changed []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for path, previous := range w.files {
+		if current := stat(path); current != previous {
+			w.files[path] = current
+			changed = append(changed, path)
+		}
+	}
+	return
+}
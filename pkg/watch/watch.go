@@ -0,0 +1,173 @@
+/*
+watch: Rebuilds whenever the input files of a build change. After each build, the source inputs of the tasks
+that ran are watched, using inotify on Linux or by polling elsewhere. Changes are debounced, and the tasks
+affected by them are run again in the next build of the session. A rebuild is cancelled if further changes
+arrive while it is running. Inputs which are only found during a build are compared with their state from before
+it once it finishes, so that changes made to them while it ran are not missed.
+*/
+package watch
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"time"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* Default interval between checks of a polling watcher. */
+const DefaultPollInterval = 500 * time.Millisecond
+
+/* Default time without further changes to wait for before rebuilding. */
+const DefaultQuiet = 100 * time.Millisecond
+
+/* Reports changes to a set of files. */
+type Watcher interface {
+	/* Replaces the set of files being watched. Paths are cleaned before they are watched. */
+	Watch(paths []string) error
+	/* Receives the paths of watched files as they change, are created or are removed. */
+	Changes() <-chan string
+	Close() error
+}
+
+/* Returns a watcher using the notifications of the operating system if possible, or polling otherwise. */
+func New() Watcher {
+	if w, err := newNative(); err == nil {
+		return w
+	} else {
+		log.Printf("nbt: watching files by polling: %v\n", err)
+	}
+	return NewPolling(DefaultPollInterval)
+}
+
+/* Waits for changes to stop arriving for the quiet period, returning the paths of the files that changed,
+starting with those already known to have changed. */
+func debounce(ctx context.Context, changes <-chan string, first []string, quiet time.Duration) (changed []string, ok bool) {
+	seen := make(map[string]bool)
+	for _, path := range first {
+		if !seen[path] {
+			seen[path] = true
+			changed = append(changed, path)
+		}
+	}
+	timer := time.NewTimer(quiet)
+	defer timer.Stop()
+	for {
+		select {
+		case path := <-changes:
+			if !seen[path] {
+				seen[path] = true
+				changed = append(changed, path)
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(quiet)
+		case <-timer.C:
+			return changed, true
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+/* Options for Loop. */
+type Options struct {
+	/* Options for each build. The Context of the options is replaced by one that is cancelled when a rebuild
+	is abandoned. */
+	Build nbt.Options
+	/* Time without further changes to wait for before rebuilding. DefaultQuiet if zero. */
+	Quiet time.Duration
+	/* Called with the result of every build that was not abandoned, and with the files that caused it,
+	which are nil for the first build. Can be nil. */
+	Report func(result *nbt.Result, changed []string)
+}
+
+/* Builds the main task, then builds it again whenever any of the source inputs of the tasks that ran change,
+until ctx is done. A build is abandoned as soon as more changes arrive, and the next build starts once the
+changes have settled. The watcher is not closed. */
+func Loop(ctx context.Context, session *nbt.Session, mainTask nbt.Task, watcher Watcher, options Options) {
+	quiet := options.Quiet
+	if quiet <= 0 {
+		quiet = DefaultQuiet
+	}
+	var changed []string
+	for {
+		before, started := snapshot(session.Inputs()), time.Now()
+		buildCtx, cancel := context.WithCancel(ctx)
+		buildOptions := options.Build
+		buildOptions.Context = buildCtx
+		done := make(chan *nbt.Result, 1)
+		go func() { done <- session.Build(mainTask, buildOptions) }()
+
+		var next []string
+		select {
+		case result := <-done:
+			if options.Report != nil && ctx.Err() == nil {
+				options.Report(result, changed)
+			}
+		case path := <-watcher.Changes():
+			/* Tasks that were not started fail with ErrCancelled, so the next build runs them again. */
+			cancel()
+			<-done
+			next = []string{path}
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		inputs := session.Inputs()
+		if err := watcher.Watch(inputs); err != nil {
+			/* Files that can be watched still are, so the loop carries on. */
+			log.Printf("nbt: %v\n", err)
+		}
+		/* The watcher only notices changes from now on, so changes made during the build are found by comparing
+		the inputs with their state before it. */
+		next = append(next, changedSince(before, started, inputs)...)
+		if len(next) == 0 {
+			select {
+			case path := <-watcher.Changes():
+				next = []string{path}
+			case <-ctx.Done():
+				return
+			}
+		}
+		var ok bool
+		if changed, ok = debounce(ctx, watcher.Changes(), next, quiet); !ok {
+			return
+		}
+	}
+}
+
+/* Returns the states of the files. */
+func snapshot(paths []string) map[string]fileState {
+	states := make(map[string]fileState, len(paths))
+	for _, path := range paths {
+		states[path] = stat(path)
+	}
+	return states
+}
+
+/* Returns the paths whose files changed since their states were taken, at the given time. Files without a state
+were not known to be inputs then, so they are taken to have changed if they were modified after that time.
+Changes made within the resolution of the modification times of the file system may be missed. */
+func changedSince(before map[string]fileState, when time.Time, paths []string) (changed []string) {
+	for _, path := range paths {
+		current := stat(path)
+		if previous, known := before[path]; known && current != previous ||
+			!known && current.exists && current.modTime.After(when) {
+			changed = append(changed, path)
+		}
+	}
+	return
+}
+
+/* Returns the cleaned paths as a set. */
+func pathSet(paths []string) map[string]bool {
+	set := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		set[filepath.Clean(path)] = true
+	}
+	return set
+}
@@ -0,0 +1,295 @@
+package watch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/kyle_anderson/nbt/pkg/nbt"
+)
+
+/* Long enough for any change to be noticed. */
+const timeout = 5 * time.Second
+
+func expectChange(t *testing.T, w Watcher, expected string) {
+	t.Helper()
+	select {
+	case path := <-w.Changes():
+		if path != expected {
+			t.Errorf(`change to %q, expected %q`, path, expected)
+		}
+	case <-time.After(timeout):
+		t.Fatalf(`no change to %q noticed`, expected)
+	}
+	/* A single write may cause several notifications. */
+	for {
+		select {
+		case <-w.Changes():
+		case <-time.After(50 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func expectNoChange(t *testing.T, w Watcher) {
+	t.Helper()
+	select {
+	case path := <-w.Changes():
+		t.Errorf(`unexpected change to %q`, path)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWatchers(t *testing.T) {
+	native, err := newNative()
+	if err != nil {
+		t.Log(`native watcher unavailable: `, err)
+	}
+	for _, test := range []struct {
+		name    string
+		watcher Watcher
+	}{
+		{`polling`, NewPolling(10 * time.Millisecond)},
+		{`native`, native},
+	} {
+		test := test // Capture
+		t.Run(test.name, func(t *testing.T) {
+			if test.watcher == nil {
+				t.Skip(`unavailable`)
+			}
+			w := test.watcher
+			defer w.Close()
+			dir := t.TempDir()
+			watched, other := filepath.Join(dir, `watched.c`), filepath.Join(dir, `other.c`)
+			os.WriteFile(watched, []byte(`one`), 0o644)
+			if err := w.Watch([]string{watched}); err != nil {
+				t.Fatal(err)
+			}
+
+			os.WriteFile(other, []byte(`unwatched`), 0o644)
+			expectNoChange(t, w)
+			os.WriteFile(watched, []byte(`two`), 0o644)
+			expectChange(t, w, watched)
+
+			/* Editors often save by renaming a new file over the old one. */
+			replacement := filepath.Join(dir, `.watched.c.swp`)
+			os.WriteFile(replacement, []byte(`three!`), 0o644)
+			os.Rename(replacement, watched)
+			expectChange(t, w, watched)
+
+			os.Remove(watched)
+			expectChange(t, w, watched)
+
+			if err := w.Watch([]string{other}); err != nil {
+				t.Fatal(err)
+			}
+			os.WriteFile(watched, []byte(`no longer watched`), 0o644)
+			expectNoChange(t, w)
+			os.WriteFile(other, []byte(`now watched`), 0o644)
+			expectChange(t, w, other)
+		})
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	changes := make(chan string)
+	go func() {
+		for _, path := range []string{`b`, `a`, `b`, `c`} {
+			time.Sleep(5 * time.Millisecond)
+			changes <- path
+		}
+	}()
+	changed, ok := debounce(context.Background(), changes, []string{`a`}, 50*time.Millisecond)
+	if !ok || len(changed) != 3 || changed[0] != `a` || changed[1] != `b` || changed[2] != `c` {
+		t.Errorf(`unexpected changes %q`, changed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := debounce(ctx, changes, []string{`a`}, time.Hour); ok {
+		t.Error(`debounce did not stop when its context was done`)
+	}
+}
+
+/* A cacheable task copying its input to its output, which may be held up while it is being performed. */
+type copyTask struct {
+	input, output string
+	runs          atomic.Int32
+	/* When not nil, the task signals started and waits for release while it is being performed. */
+	gate             atomic.Pointer[chan struct{}]
+	started, release chan struct{}
+}
+
+func (t *copyTask) Hash() uint64 { return uint64(len(t.output)) }
+func (t *copyTask) Matches(other nbt.Task) bool {
+	converted, ok := other.(*copyTask)
+	return ok && converted.output == t.output
+}
+func (t *copyTask) Action() nbt.ActionSpec {
+	return nbt.ActionSpec{Inputs: []string{t.input}, Outputs: []string{t.output}}
+}
+func (t *copyTask) Perform(nbt.Handler) error {
+	t.runs.Add(1)
+	if t.gate.Load() != nil {
+		t.started <- struct{}{}
+		<-t.release
+	}
+	data, err := os.ReadFile(t.input)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(t.output, data, 0o644)
+}
+
+/* Performs its tasks one after the other. */
+type sequenceTask []nbt.Task
+
+func (sequenceTask) Hash() uint64                { return 0 }
+func (sequenceTask) Matches(other nbt.Task) bool { _, ok := other.(sequenceTask); return ok }
+func (s sequenceTask) Perform(h nbt.Handler) error {
+	for _, task := range s {
+		h.RequireAndWait(task)
+	}
+	return nil
+}
+
+type report struct {
+	result  *nbt.Result
+	changed []string
+}
+
+func TestLoop(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, `source`)
+	os.WriteFile(source, []byte(`one`), 0o644)
+	slow := &copyTask{input: source, output: filepath.Join(dir, `slow`), started: make(chan struct{}), release: make(chan struct{})}
+	fast := &copyTask{input: source, output: filepath.Join(dir, `fast`)}
+	reports := make(chan report, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	watcher := NewPolling(10 * time.Millisecond)
+	defer watcher.Close()
+	go func() {
+		defer close(stopped)
+		Loop(ctx, nbt.NewSession(false), sequenceTask{slow, fast}, watcher, Options{
+			Build:  nbt.Options{MaxParallelTasks: 2},
+			Quiet:  20 * time.Millisecond,
+			Report: func(result *nbt.Result, changed []string) { reports <- report{result, changed} },
+		})
+	}()
+	nextReport := func() report {
+		t.Helper()
+		select {
+		case r := <-reports:
+			if !r.result.Succeeded() {
+				t.Fatal(`build failed: `, r.result.Failed)
+			}
+			return r
+		case <-time.After(timeout):
+			t.Fatal(`no build reported`)
+		}
+		return report{}
+	}
+	expectOutputs := func(expected string) {
+		t.Helper()
+		for _, task := range []*copyTask{slow, fast} {
+			if data, _ := os.ReadFile(task.output); string(data) != expected {
+				t.Errorf(`%s contains %q, expected %q`, task.output, data, expected)
+			}
+		}
+	}
+
+	if r := nextReport(); r.changed != nil {
+		t.Errorf(`unexpected changes %q for the first build`, r.changed)
+	}
+	expectOutputs(`one`)
+
+	/* A change arriving while a rebuild is running abandons the rebuild. */
+	gate := make(chan struct{})
+	slow.gate.Store(&gate)
+	os.WriteFile(source, []byte(`two`), 0o644)
+	select {
+	case <-slow.started:
+	case <-time.After(timeout):
+		t.Fatal(`rebuild did not start`)
+	}
+	os.WriteFile(source, []byte(`three!`), 0o644)
+	/* Gives the watcher time to notice the change and cancel the build before the slow task finishes. */
+	time.Sleep(200 * time.Millisecond)
+	slow.gate.Store(nil)
+	slow.release <- struct{}{}
+
+	r := nextReport()
+	if len(r.changed) != 1 || r.changed[0] != source {
+		t.Errorf(`unexpected changes %q`, r.changed)
+	}
+	expectOutputs(`three!`)
+	/* The fast task was never started by the abandoned build. */
+	if runs := fast.runs.Load(); runs != 2 {
+		t.Errorf(`fast task ran %d times, expected 2`, runs)
+	}
+	select {
+	case r := <-reports:
+		t.Errorf(`unexpected extra build with changes %q`, r.changed)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		t.Fatal(`loop did not stop when its context was done`)
+	}
+}
+
+func TestLoopNoticesChangesDuringFirstBuild(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, `source`)
+	os.WriteFile(source, []byte(`one`), 0o644)
+	task := &copyTask{input: source, output: filepath.Join(dir, `output`), started: make(chan struct{}), release: make(chan struct{})}
+	gate := make(chan struct{})
+	task.gate.Store(&gate)
+	reports := make(chan report, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watcher := NewPolling(10 * time.Millisecond)
+	defer watcher.Close()
+	go Loop(ctx, nbt.NewSession(false), task, watcher, Options{
+		Build:  nbt.Options{MaxParallelTasks: 1},
+		Quiet:  20 * time.Millisecond,
+		Report: func(result *nbt.Result, changed []string) { reports <- report{result, changed} },
+	})
+
+	select {
+	case <-task.started:
+	case <-time.After(timeout):
+		t.Fatal(`build did not start`)
+	}
+	/* The input is not known to be one until the build finishes, so it cannot be watched yet. */
+	time.Sleep(10 * time.Millisecond)
+	os.WriteFile(source, []byte(`two`), 0o644)
+	task.gate.Store(nil)
+	task.release <- struct{}{}
+
+	nextReport := func() report {
+		t.Helper()
+		select {
+		case r := <-reports:
+			if !r.result.Succeeded() {
+				t.Fatal(`build failed: `, r.result.Failed)
+			}
+			return r
+		case <-time.After(timeout):
+			t.Fatal(`no build reported`)
+		}
+		return report{}
+	}
+	nextReport()
+	/* The task read the input after it changed, but the loop cannot know that, so it builds again. */
+	if r := nextReport(); len(r.changed) != 1 || r.changed[0] != source {
+		t.Errorf(`unexpected changes %q`, r.changed)
+	}
+}